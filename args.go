@@ -0,0 +1,284 @@
+package victor
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+)
+
+// ArgType defines the type that a command argument's field is converted to
+// before the command's handler is called.
+type ArgType int
+
+const (
+	// ArgString leaves the field as is.
+	ArgString ArgType = iota
+	// ArgInt converts the field to an int.
+	ArgInt
+	// ArgDuration converts the field to a time.Duration using
+	// time.ParseDuration (ex: "90s" or "1h30m").
+	ArgDuration
+	// ArgUser resolves the field to a chat.User using the chat adapter's
+	// GetUser method.
+	ArgUser
+	// ArgChannel resolves the field to a chat.Channel using the chat
+	// adapter's GetChannel method.
+	ArgChannel
+	// ArgEnum checks that the field case insensitively matches one of the
+	// argument's Values.
+	ArgEnum
+)
+
+// String returns the name of the argument type as it is shown in usage text.
+func (t ArgType) String() string {
+	switch t {
+	case ArgInt:
+		return "int"
+	case ArgDuration:
+		return "duration"
+	case ArgUser:
+		return "user"
+	case ArgChannel:
+		return "channel"
+	case ArgEnum:
+		return "enum"
+	default:
+		return "string"
+	}
+}
+
+// Arg declares a single argument of a command. Arguments are matched to a
+// message's fields in the order that they are declared.
+//
+// Only the last argument of a command may be variadic and all optional
+// arguments must come after any required arguments.
+type Arg struct {
+	Name string
+	Type ArgType
+	// Optional arguments may be omitted. If Default is set then it is
+	// converted and used in place of the omitted field.
+	Optional bool
+	// Variadic arguments consume all remaining fields.
+	Variadic bool
+	Default  string
+	// Values are the accepted values of an ArgEnum argument.
+	Values []string
+}
+
+// usage returns the argument's usage text.
+func (a Arg) usage() string {
+	var name string
+	switch a.Type {
+	case ArgString:
+		name = a.Name
+	case ArgEnum:
+		name = strings.Join(a.Values, "|")
+	default:
+		name = a.Name + ":" + a.Type.String()
+	}
+	if a.Variadic {
+		name += "..."
+	}
+	name = "`" + name + "`"
+	if a.Optional {
+		name = "[" + name + "]"
+	}
+	return name
+}
+
+// parse converts a single field to the argument's type.
+func (a Arg) parse(adapter chat.Adapter, field string) (interface{}, error) {
+	switch a.Type {
+	case ArgInt:
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("_%s_ must be a whole number (got _%s_).", a.Name, field)
+		}
+		return value, nil
+	case ArgDuration:
+		value, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, fmt.Errorf("_%s_ must be a duration such as _90s_ or _1h30m_ (got _%s_).", a.Name, field)
+		}
+		return value, nil
+	case ArgUser:
+		if user := adapter.GetUser(field); user != nil {
+			return user, nil
+		}
+		return nil, fmt.Errorf("_%s_ must be a user (got _%s_).", a.Name, field)
+	case ArgChannel:
+		if channel := adapter.GetChannel(field); channel != nil {
+			return channel, nil
+		}
+		return nil, fmt.Errorf("_%s_ must be a channel (got _%s_).", a.Name, field)
+	case ArgEnum:
+		for _, value := range a.Values {
+			if strings.EqualFold(value, field) {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("_%s_ must be one of _%s_ (got _%s_).", a.Name, strings.Join(a.Values, ", "), field)
+	default:
+		return field, nil
+	}
+}
+
+// argsUsage builds a single usage string from a command's arguments.
+func argsUsage(args []Arg) string {
+	var buf bytes.Buffer
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(arg.usage())
+	}
+	return buf.String()
+}
+
+// validateArgs returns an error describing the first argument declared out of
+// order: a required argument after an optional one or a variadic argument
+// that is not the last argument. The arguments of subcommands are checked as
+// well.
+func validateArgs(cmd HandlerDocPair) error {
+	args := cmd.Args()
+	optional := ""
+	for i, arg := range args {
+		if arg.Variadic && i < len(args)-1 {
+			return fmt.Errorf("variadic argument %q of %q must be its last argument", arg.Name, cmd.Name())
+		}
+		if arg.Optional {
+			optional = arg.Name
+		} else if len(optional) > 0 {
+			return fmt.Errorf("required argument %q of %q follows optional argument %q", arg.Name, cmd.Name(), optional)
+		}
+	}
+	for _, sub := range cmd.Subcommands() {
+		if err := validateArgs(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseArgs matches the given fields to the given argument declarations and
+// converts them to their declared types. User and channel arguments are
+// resolved through the given chat adapter. This returns an error describing
+// the first field that could not be converted or the missing/extra fields.
+func parseArgs(adapter chat.Adapter, decls []Arg, fields []string) (Args, error) {
+	args := Args{values: make(map[string]interface{}, len(decls))}
+	pos := 0
+	for _, decl := range decls {
+		if decl.Variadic {
+			var values []interface{}
+			for ; pos < len(fields); pos++ {
+				value, err := decl.parse(adapter, fields[pos])
+				if err != nil {
+					return Args{}, err
+				}
+				values = append(values, value)
+			}
+			if len(values) == 0 && !decl.Optional {
+				return Args{}, fmt.Errorf("Missing argument _%s_.", decl.Name)
+			}
+			args.values[decl.Name] = values
+			continue
+		}
+		field := decl.Default
+		if pos < len(fields) {
+			field = fields[pos]
+			pos++
+		} else if !decl.Optional {
+			return Args{}, fmt.Errorf("Missing argument _%s_.", decl.Name)
+		} else if len(decl.Default) == 0 {
+			continue
+		}
+		value, err := decl.parse(adapter, field)
+		if err != nil {
+			return Args{}, err
+		}
+		args.values[decl.Name] = value
+	}
+	if pos < len(fields) {
+		return Args{}, fmt.Errorf("Too many arguments (unexpected _%s_).", fields[pos])
+	}
+	return args, nil
+}
+
+// Args provides access to a command's parsed arguments by name. The zero
+// value is an empty set of arguments.
+//
+// The typed getters return the type's zero value if the argument was not
+// given (and has no default) or was declared with a different type.
+type Args struct {
+	values map[string]interface{}
+}
+
+// NewArgs returns a set of arguments with the given values. This is intended
+// for building states in tests.
+func NewArgs(values map[string]interface{}) Args {
+	return Args{values: values}
+}
+
+// Has returns true if the argument with the given name was set.
+func (a Args) Has(name string) bool {
+	_, exists := a.values[name]
+	return exists
+}
+
+// Get returns the raw converted value of the argument with the given name or
+// nil if it was not set. Variadic arguments are returned as []interface{}.
+func (a Args) Get(name string) interface{} {
+	return a.values[name]
+}
+
+// String returns the value of a string or enum argument.
+func (a Args) String(name string) string {
+	value, _ := a.values[name].(string)
+	return value
+}
+
+// Int returns the value of an int argument.
+func (a Args) Int(name string) int {
+	value, _ := a.values[name].(int)
+	return value
+}
+
+// Duration returns the value of a duration argument.
+func (a Args) Duration(name string) time.Duration {
+	value, _ := a.values[name].(time.Duration)
+	return value
+}
+
+// User returns the value of a user argument.
+func (a Args) User(name string) chat.User {
+	value, _ := a.values[name].(chat.User)
+	return value
+}
+
+// Channel returns the value of a channel argument.
+func (a Args) Channel(name string) chat.Channel {
+	value, _ := a.values[name].(chat.Channel)
+	return value
+}
+
+// List returns the values of a variadic argument.
+func (a Args) List(name string) []interface{} {
+	value, _ := a.values[name].([]interface{})
+	return value
+}
+
+// Strings returns the values of a variadic string or enum argument.
+func (a Args) Strings(name string) []string {
+	list := a.List(name)
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		if value, ok := item.(string); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,111 @@
+package victor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/chat/mockAdapter"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var deployArgs = []Arg{
+	{Name: "env", Type: ArgEnum, Values: []string{"staging", "production"}},
+	{Name: "count", Type: ArgInt, Optional: true, Default: "1"},
+	{Name: "wait", Type: ArgDuration, Optional: true},
+	{Name: "notify", Type: ArgUser, Optional: true, Variadic: true},
+}
+
+func TestArgsUsage(t *testing.T) {
+	assert.Equal(t, "`staging|production` [`count:int`] [`wait:duration`] [`notify:user...`]",
+		argsUsage(deployArgs), "Incorrect generated usage.")
+	doc := &HandlerDoc{CmdArgs: deployArgs, CmdUsage: []string{"ignored"}}
+	assert.Equal(t, []string{argsUsage(deployArgs)}, doc.Usage(), "Declared args should replace CmdUsage.")
+}
+
+func TestParseArgs(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat()
+
+	args, err := parseArgs(adapter, deployArgs, []string{"STAGING"})
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", args.String("env"), "Enum should be normalized to its declared value.")
+	assert.Equal(t, 1, args.Int("count"), "Default should be used for omitted optional args.")
+	assert.False(t, args.Has("wait"), "Optional args without defaults should be unset.")
+	assert.Empty(t, args.List("notify"), "Omitted variadic args should be empty.")
+
+	args, err = parseArgs(adapter, deployArgs, []string{"production", "3", "90s", "a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, args.Int("count"))
+	assert.Equal(t, 90*time.Second, args.Duration("wait"))
+	assert.Len(t, args.List("notify"), 2, "Variadic args should consume all remaining fields.")
+
+	_, err = parseArgs(adapter, deployArgs, []string{})
+	assert.Error(t, err, "Missing required args should fail.")
+	_, err = parseArgs(adapter, deployArgs, []string{"dev"})
+	assert.Error(t, err, "Unknown enum values should fail.")
+	_, err = parseArgs(adapter, deployArgs, []string{"staging", "three"})
+	assert.Error(t, err, "Invalid ints should fail.")
+	_, err = parseArgs(adapter, []Arg{{Name: "a"}}, []string{"x", "y"})
+	assert.Error(t, err, "Extra fields should fail.")
+
+	adapter.(*mockAdapter.MockChatAdapter).UserRet = nil
+	_, err = parseArgs(adapter, deployArgs, []string{"staging", "1", "1s", "nobody"})
+	assert.Error(t, err, "Unresolved users should fail.")
+}
+
+func TestArgsThroughBot(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	var count int
+	calls := 0
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "repeat",
+		CmdArgs: []Arg{{Name: "count", Type: ArgInt}},
+		CmdHandler: func(s State) {
+			calls++
+			count = s.Args().Int("count")
+		},
+	})
+	msg := &chat.BaseMessage{
+		MsgText:     "repeat 4",
+		MsgIsDirect: true,
+		MsgChannel:  testChannel,
+	}
+	bot.ProcessMessage(msg)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 4, count)
+
+	msg.MsgText = "repeat four"
+	bot.ProcessMessage(msg)
+	assert.Equal(t, 1, calls, "Handler should not be called with invalid args.")
+	assert.Len(t, adapter.Sent, 1, "Usage should be sent on invalid args.")
+	assert.Contains(t, adapter.Sent[0].Text(), "repeat `count:int`")
+}
+
+func TestValidateArgs(t *testing.T) {
+	assert.NoError(t, validateArgs(&HandlerDoc{CmdArgs: []Arg{
+		{Name: "a"},
+		{Name: "b", Optional: true},
+		{Name: "c", Optional: true, Variadic: true},
+	}}))
+	assert.Error(t, validateArgs(&HandlerDoc{CmdArgs: []Arg{
+		{Name: "a", Optional: true},
+		{Name: "b"},
+	}}), "Required arguments should not follow optional ones.")
+	assert.Error(t, validateArgs(&HandlerDoc{CmdArgs: []Arg{
+		{Name: "a", Variadic: true},
+		{Name: "b"},
+	}}), "Variadic arguments should be last.")
+	assert.Error(t, validateArgs(&HandlerDoc{CmdSubcommands: []HandlerDocPair{
+		&HandlerDoc{CmdName: "sub", CmdArgs: []Arg{{Name: "a", Variadic: true}, {Name: "b"}}},
+	}}), "Subcommand arguments should be checked.")
+
+	bot := getMockBot()
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "bad",
+		CmdArgs: []Arg{{Name: "a", Optional: true}, {Name: "b"}},
+	})
+	assert.NotContains(t, bot.Commands(), "bad", "Commands with invalid arguments should not be added.")
+}
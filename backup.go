@@ -0,0 +1,148 @@
+package victor
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+// Name of the built in backup command that is added on a call to
+// *dispatch.EnableBackupCommand().
+const backupCommandName = "backup"
+
+// backupTimeFormat is used to name backup files so they sort by the time at
+// which they were taken.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// backupExt is the extension of backup files.
+const backupExt = ".jsonl"
+
+// Set up base default backup handler. Before use a copy must be made and the
+// CmdHandler property must be set.
+var defaultBackupHandlerDoc = HandlerDoc{
+	CmdName:        backupCommandName,
+	CmdDescription: "Back up the bot's store or list existing backups.",
+	CmdUsage: []string{
+		"",
+		"list",
+	},
+	CmdRoles: []string{AdminRole},
+}
+
+// EnableBackupCommand registers the built in "backup" command which allows
+// admins to export the robot's store (see store.Export) to a new file in the
+// given directory and to list the backups in it. The directory is created if
+// it does not exist. This will log a message if there is already a handler
+// registered under that name.
+//
+// Backups of an encrypted store hold its encrypted entries (see store.Sealer)
+// and can only be restored into an encrypted store with the same keys.
+func (d *dispatch) EnableBackupCommand(dir string) {
+	if _, exists := d.commands[backupCommandName]; exists {
+		log.Println("Enabling built in backup command and overriding set backup command.")
+	}
+	backupHandler := defaultBackupHandlerDoc
+	backupHandler.CmdHandler = func(s State) {
+		defaultBackupHandler(s, d, dir)
+	}
+	d.HandleCommand(&backupHandler)
+}
+
+// defaultBackupHandler either takes a new backup or lists the existing ones
+// depending on the state's fields.
+func defaultBackupHandler(s State, d *dispatch, dir string) {
+	fields := s.Fields()
+	switch {
+	case len(fields) == 0:
+		name, err := backupStore(d.robot.ContextStore(), dir, time.Now())
+		if err != nil {
+			log.Println("Unable to back up store:", err.Error())
+			s.Reply("Sorry, the backup failed.")
+			return
+		}
+		s.Reply(fmt.Sprintf("Saved backup _%s_.", name))
+	case len(fields) == 1 && strings.ToLower(fields[0]) == "list":
+		backups, err := listBackups(dir)
+		if err != nil {
+			log.Println("Unable to list backups:", err.Error())
+			s.Reply("Sorry, I couldn't list the backups.")
+			return
+		}
+		if len(backups) == 0 {
+			s.Reply("There are no backups.")
+			return
+		}
+		var buf bytes.Buffer
+		buf.WriteString("Backups:\n")
+		for _, backup := range backups {
+			buf.WriteString(fmt.Sprintf("%s (%d bytes)\n", backup.Name(), backup.Size()))
+		}
+		s.Reply(buf.String())
+	default:
+		s.Reply("Unrecognized usage. Type *`help backup`* to view usage.")
+	}
+}
+
+// backupStore exports the store to a new file in dir named after the given
+// time and returns the file's name. The export is written to a temporary
+// file which is renamed once it is complete so a failed backup never leaves
+// a partial file behind.
+func backupStore(s store.ContextAdapter, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := "backup-" + now.UTC().Format(backupTimeFormat) + backupExt
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := store.Export(s, tmp); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// listBackups returns the backup files in dir with the newest first. A
+// missing directory has no backups.
+func listBackups(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	backups := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "backup-") || !strings.HasSuffix(entry.Name(), backupExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name() > backups[j].Name()
+	})
+	return backups, nil
+}
@@ -0,0 +1,53 @@
+package victor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/chat/mockAdapter"
+	"github.com/FogCreek/victor/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupCommand(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backups")
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	bot.EnableBackupCommand(dir)
+	bot.Store().Set("karma.bob", "2")
+	msg := &chat.BaseMessage{
+		MsgText:     "backup list",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "can't let you do that", "Only admins should run backups.")
+
+	bot.Roles().Grant(testUser.ID(), AdminRole)
+	bot.ProcessMessage(msg)
+	assert.Equal(t, "There are no backups.", adapter.Sent[1].Text())
+
+	msg.MsgText = "backup"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[2].Text(), "Saved backup")
+	backups, err := listBackups(dir)
+	if !assert.NoError(t, err) || !assert.Len(t, backups, 1) {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(dir, backups[0].Name()))
+	assert.NoError(t, err)
+	restored := getMockBot()
+	assert.NoError(t, store.Import(bytes.NewReader(data), restored.ContextStore()), "Backups should be importable.")
+	val, _ := restored.Store().Get("karma.bob")
+	assert.Equal(t, "2", val)
+
+	msg.MsgText = "backup list"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[3].Text(), backups[0].Name(), "Backups should be listed.")
+}
@@ -0,0 +1,139 @@
+package victor
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+)
+
+// defaultAskTimeout is used by State.Ask if it is not given a timeout greater
+// than zero.
+const defaultAskTimeout = 5 * time.Minute
+
+var (
+	// ErrAskTimeout is returned by State.Ask when no answer is received
+	// before the timeout elapses.
+	ErrAskTimeout = errors.New("timed out waiting for an answer")
+
+	// ErrAlreadyAsking is returned by State.Ask when a question is already
+	// waiting for an answer from the same user in the same channel.
+	ErrAlreadyAsking = errors.New("already waiting for an answer from this user")
+)
+
+// conversationKey identifies a single user in a single channel.
+type conversationKey struct {
+	userID,
+	channelID string
+}
+
+// keyForMessage returns the conversation key for the given message's user and
+// channel. The second return value is false if the message has no user or
+// channel and therefore cannot be part of a conversation.
+func keyForMessage(m chat.Message) (conversationKey, bool) {
+	if m == nil || m.User() == nil || m.Channel() == nil {
+		return conversationKey{}, false
+	}
+	return conversationKey{
+		userID:    m.User().ID(),
+		channelID: m.Channel().ID(),
+	}, true
+}
+
+// conversations is a registry of handlers that are waiting for the next
+// message from a user in a channel.
+type conversations struct {
+	mutex   *sync.Mutex
+	waiting map[conversationKey]chan chat.Message
+}
+
+// newConversations returns a new, empty conversation registry.
+func newConversations() *conversations {
+	return &conversations{
+		mutex:   &sync.Mutex{},
+		waiting: make(map[conversationKey]chan chat.Message),
+	}
+}
+
+// deliver passes the given message to a handler waiting on its user and
+// channel. This returns true if the message was delivered and should not be
+// routed any further.
+func (c *conversations) deliver(m chat.Message) bool {
+	key, ok := keyForMessage(m)
+	if !ok {
+		return false
+	}
+	c.mutex.Lock()
+	answer, exists := c.waiting[key]
+	if exists {
+		delete(c.waiting, key)
+	}
+	c.mutex.Unlock()
+	if exists {
+		// buffered so this never blocks even if the waiter has given up
+		answer <- m
+	}
+	return exists
+}
+
+// register adds a waiter for the given key. It returns ErrAlreadyAsking if
+// there is already a waiter for the key.
+func (c *conversations) register(key conversationKey) (chan chat.Message, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.waiting[key]; exists {
+		return nil, ErrAlreadyAsking
+	}
+	answer := make(chan chat.Message, 1)
+	c.waiting[key] = answer
+	return answer, nil
+}
+
+// unregister removes the given waiter for the given key if it has not already
+// been removed by a delivery.
+func (c *conversations) unregister(key conversationKey, answer chan chat.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.waiting[key] == answer {
+		delete(c.waiting, key)
+	}
+}
+
+// Ask replies to the current message with the given prompt (if it is not
+// empty) and then waits for the next message from the same user in the same
+// channel. That message is returned to the caller and is not routed to any
+// other handler.
+//
+// This returns ErrAskTimeout if no message arrives before the timeout elapses
+// (a timeout of zero or less waits for 5 minutes) or the context's error if the
+// handler's context is cancelled first. The handler's worker is occupied while
+// it waits so other messages from the same channel are queued until it
+// returns.
+func (s *state) Ask(prompt string, timeout time.Duration) (chat.Message, error) {
+	key, ok := keyForMessage(s.message)
+	if !ok || s.conversations == nil {
+		return nil, errors.New("cannot ask a question without a user and channel")
+	}
+	answer, err := s.conversations.register(key)
+	if err != nil {
+		return nil, err
+	}
+	defer s.conversations.unregister(key, answer)
+	if len(prompt) > 0 {
+		s.Reply(prompt)
+	}
+	if timeout <= 0 {
+		timeout = defaultAskTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m := <-answer:
+		return m, nil
+	case <-timer.C:
+		return nil, ErrAskTimeout
+	case <-s.Context().Done():
+		return nil, s.Context().Err()
+	}
+}
@@ -0,0 +1,131 @@
+package victor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsk(t *testing.T) {
+	bot := getMockBot()
+	otherHandle := HandlerMock{t: t}
+	answers := make(chan string)
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "confirm",
+		CmdHandler: func(s State) {
+			m, err := s.Ask("Are you sure?", time.Second)
+			assert.NoError(t, err)
+			answers <- m.Text()
+		},
+	})
+	bot.HandleCommand(&HandlerDoc{
+		CmdName:    "yes",
+		CmdHandler: otherHandle.Func(),
+	})
+	otherUser := &chat.BaseUser{UserID: "UOther"}
+	go bot.ProcessMessage(&chat.BaseMessage{
+		MsgText:     "confirm",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	})
+	// wait for the question to be registered
+	for i := 0; i < 100; i++ {
+		bot.conversations.mutex.Lock()
+		waiting := len(bot.conversations.waiting)
+		bot.conversations.mutex.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// a different user should be routed normally
+	bot.ProcessMessage(&chat.BaseMessage{
+		MsgText:     "yes",
+		MsgIsDirect: true,
+		MsgUser:     otherUser,
+		MsgChannel:  testChannel,
+	})
+	otherHandle.HasRun(1)
+	// the same user should answer the question
+	bot.ProcessMessage(&chat.BaseMessage{
+		MsgText:     "yes",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	})
+	otherHandle.HasRun(1)
+	select {
+	case answer := <-answers:
+		assert.Equal(t, "yes", answer, "Answer should be the next message's text.")
+	case <-time.After(time.Second):
+		assert.Fail(t, "Answer was not delivered.")
+	}
+}
+
+func TestAskTimeout(t *testing.T) {
+	bot := getMockBot()
+	var askErr error
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "confirm",
+		CmdHandler: func(s State) {
+			_, askErr = s.Ask("", 10*time.Millisecond)
+		},
+	})
+	msg := &chat.BaseMessage{
+		MsgText:     "confirm",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+	bot.ProcessMessage(msg)
+	assert.Equal(t, ErrAskTimeout, askErr)
+	assert.Empty(t, bot.conversations.waiting, "Timed out questions should be unregistered.")
+}
+
+func TestAskDoesNotBlockHandlers(t *testing.T) {
+	bot := getMockBot()
+	asked := make(chan struct{})
+	done := make(chan struct{})
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "confirm",
+		CmdHandler: func(s State) {
+			defer close(done)
+			close(asked)
+			s.Ask("", time.Second)
+		},
+	})
+	msg := &chat.BaseMessage{
+		MsgText:     "confirm",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+	go bot.ProcessMessage(msg)
+	<-asked
+	added := make(chan struct{})
+	go func() {
+		bot.HandleCommand(&HandlerDoc{CmdName: "later"})
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Adding a command should not wait for a handler asking a question.")
+	}
+	// answer the question so the handler returns
+	for {
+		bot.conversations.mutex.Lock()
+		waiting := len(bot.conversations.waiting)
+		bot.conversations.mutex.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bot.ProcessMessage(msg)
+	<-done
+}
@@ -2,12 +2,14 @@ package victor
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/FogCreek/victor/pkg/chat"
@@ -33,6 +35,10 @@ type HandlerDocPair interface {
 	IsHidden() bool
 	AliasNames() []string
 	AddAliasName(string) bool
+	Timeout() time.Duration
+	Roles() []string
+	Args() []Arg
+	Subcommands() []HandlerDocPair
 }
 
 // HandlerDoc provides a base implementation of the HandlerDocPair interface.
@@ -42,6 +48,10 @@ type HandlerDoc struct {
 	CmdDescription string
 	CmdUsage       []string
 	CmdIsHidden    bool
+	CmdTimeout     time.Duration
+	CmdRoles       []string
+	CmdArgs        []Arg
+	CmdSubcommands []HandlerDocPair
 	cmdRegexp      *regexp.Regexp
 	cmdAliasNames  []string
 }
@@ -83,10 +93,43 @@ func (d *HandlerDoc) Description() string {
 // Usage returns an array of acceptable usages for this command.
 // The usages should not have the command's name in them in order to work
 // with the default help handler.
+//
+// If the command declares arguments then its usage is generated from them and
+// the CmdUsage property is ignored.
 func (d *HandlerDoc) Usage() []string {
+	if len(d.CmdArgs) > 0 {
+		return []string{argsUsage(d.CmdArgs)}
+	}
 	return d.CmdUsage
 }
 
+// Args returns the command's declared arguments. If any are declared then a
+// message's fields are validated and converted before the handler is called.
+func (d *HandlerDoc) Args() []Arg {
+	return d.CmdArgs
+}
+
+// Timeout returns the maximum amount of time that the command's handler should
+// run for. Once it elapses the handler's context is cancelled. A zero value
+// means that the command has no timeout.
+func (d *HandlerDoc) Timeout() time.Duration {
+	return d.CmdTimeout
+}
+
+// Roles returns the roles that are permitted to run this command. A user must
+// have at least one of these roles (or the admin role) in order to run it. If
+// no roles are set then anyone may run the command.
+func (d *HandlerDoc) Roles() []string {
+	return d.CmdRoles
+}
+
+// Subcommands returns the command's child commands. The first field of a
+// message is matched (case insensitively) against the subcommands' names
+// before the command's own handler is considered.
+func (d *HandlerDoc) Subcommands() []HandlerDocPair {
+	return d.CmdSubcommands
+}
+
 // AliasNames returns a sorted copy of the internal alias names slice. The
 // returned slice is safe to modify and will never be nil although it could be
 // a zero-length slice.
@@ -149,6 +192,8 @@ type dispatch struct {
 	regexpCommands []HandlerDocPair
 	commandNames   []string
 	patterns       []HandlerRegExpPair
+	middleware     []Middleware
+	conversations  *conversations
 	botNameRegex   *regexp.Regexp
 	handlerMutex   *sync.RWMutex
 }
@@ -162,6 +207,7 @@ func newDispatch(bot Robot) *dispatch {
 		commands:       make(map[string]HandlerDocPair),
 		botNameRegex:   regexp.MustCompile(fmt.Sprintf(botNameRegexFormat, bot.Name())),
 		handlerMutex:   &sync.RWMutex{},
+		conversations:  newConversations(),
 	}
 }
 
@@ -230,6 +276,9 @@ func (d *dispatch) EnableHelpCommand() {
 // on the command name of a message that is considered a potential command
 // (either sent @ the bot's name or in a direct message).
 //
+// Commands whose arguments are declared out of order (see Arg) are logged and
+// not added.
+//
 // This opens a write lock on the handlerMutex or will wait until one can be
 // opened. This is therefore safe to use concurrently with other handler
 // functions and/or message processing.
@@ -237,6 +286,10 @@ func (d *dispatch) HandleCommand(cmd HandlerDocPair) {
 	d.handlerMutex.Lock()
 	defer d.handlerMutex.Unlock()
 	lowerName := strings.ToLower(cmd.Name())
+	if err := validateArgs(cmd); err != nil {
+		log.Printf("Cannot add command \"%s\": %s.", lowerName, err)
+		return
+	}
 	if _, exists := d.commands[lowerName]; exists {
 		log.Printf("\"%s\" has been set more than once.", lowerName)
 	}
@@ -246,6 +299,10 @@ func (d *dispatch) HandleCommand(cmd HandlerDocPair) {
 		CmdDescription: cmd.Description(),
 		CmdUsage:       cmd.Usage(),
 		CmdIsHidden:    cmd.IsHidden(),
+		CmdTimeout:     cmd.Timeout(),
+		CmdRoles:       cmd.Roles(),
+		CmdArgs:        cmd.Args(),
+		CmdSubcommands: cmd.Subcommands(),
 	}
 	d.commands[lowerName] = newCmd
 	d.commandNames = appendInOrderWithoutRepeats(d.commandNames, lowerName)
@@ -283,12 +340,20 @@ func (d *dispatch) HandleCommandRegexp(exp *regexp.Regexp, cmd HandlerDocPair) {
 		log.Panicf("Cannot add nil regular expression command under name \"%s\"\n.", lowerName)
 		return
 	}
+	if err := validateArgs(cmd); err != nil {
+		log.Printf("Cannot add command \"%s\": %s.", lowerName, err)
+		return
+	}
 	newCmd := &HandlerDoc{
 		CmdHandler:     cmd.Handler(),
 		CmdName:        cmd.Name(),
 		CmdDescription: cmd.Description(),
 		CmdUsage:       cmd.Usage(),
 		CmdIsHidden:    cmd.IsHidden(),
+		CmdTimeout:     cmd.Timeout(),
+		CmdRoles:       cmd.Roles(),
+		CmdArgs:        cmd.Args(),
+		CmdSubcommands: cmd.Subcommands(),
 		cmdRegexp:      exp,
 	}
 	d.regexpCommands = append(d.regexpCommands, newCmd)
@@ -329,6 +394,10 @@ func (d *dispatch) HandleCommandAlias(originalName, aliasName string) {
 		CmdHandler:     doc.Handler(),
 		CmdDescription: doc.Description(),
 		CmdUsage:       doc.Usage(),
+		CmdTimeout:     doc.Timeout(),
+		CmdRoles:       doc.Roles(),
+		CmdArgs:        doc.Args(),
+		CmdSubcommands: doc.Subcommands(),
 	}
 	// release our lock before actually adding the command
 	d.handlerMutex.Unlock()
@@ -390,6 +459,10 @@ func (d *dispatch) HandleCommandAliasRegexp(originalName, aliasName string, exp
 		CmdHandler:     doc.Handler(),
 		CmdDescription: doc.Description(),
 		CmdUsage:       doc.Usage(),
+		CmdTimeout:     doc.Timeout(),
+		CmdRoles:       doc.Roles(),
+		CmdArgs:        doc.Args(),
+		CmdSubcommands: doc.Subcommands(),
 	}
 	// release our lock before actually adding the alias
 	d.handlerMutex.Unlock()
@@ -448,6 +521,58 @@ func (d *dispatch) SetDefaultHandler(handler HandlerFunc) {
 	d.defaultHandler = handler
 }
 
+// Use adds a given middleware to the dispatch's middleware chain. Every
+// handler invocation (commands, regexp commands, patterns, and the default
+// handler) is wrapped by all added middleware. Middleware is run in the order
+// that it was added so the first added middleware is the outermost wrapper.
+//
+// This opens a write lock on the handlerMutex or will wait until one can be
+// opened. This is therefore safe to use concurrently with other handler
+// functions and/or message processing.
+func (d *dispatch) Use(m Middleware) {
+	d.handlerMutex.Lock()
+	defer d.handlerMutex.Unlock()
+	if m == nil {
+		log.Println("Cannot add nil middleware.")
+		return
+	}
+	d.middleware = append(d.middleware, m)
+}
+
+// invoke wraps the given handler with the given middleware and then calls it
+// with a new state for the given message, fields, and parsed arguments. The
+// state's context is derived from the robot's context and is cancelled once
+// the handler returns or the given timeout elapses (if it is greater than
+// zero).
+//
+// This does not acquire a lock on the handlerMutex and should be called
+// without holding one. The middleware must be a copy of the dispatch's
+// middleware taken while holding a read lock.
+func (d *dispatch) invoke(middleware []Middleware, handler HandlerFunc, timeout time.Duration,
+	m chat.Message, fields []string, args Args) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.robot.Context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(d.robot.Context())
+	}
+	defer cancel()
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	if handler != nil {
+		handler.Handle(&state{
+			robot:         d.robot,
+			message:       m,
+			fields:        fields,
+			args:          args,
+			ctx:           ctx,
+			conversations: d.conversations,
+		})
+	}
+}
+
 // ProcessMessage finds a match for a message and runs its Handler.
 // If the message is considered a potential command (either sent @ the bot's
 // name or in a direct message) then the next word after the bot's name is
@@ -459,47 +584,68 @@ func (d *dispatch) SetDefaultHandler(handler HandlerFunc) {
 // If the message is not a potential command then it is checked against all
 // registered patterns (with an empty fields array upon a match).
 //
-// This opens a read lock on the handlerMutex so new commands cannot be added
-// while a message is being processed (they will block until processing is
-// completed)
+// If a handler is waiting for an answer from the message's user in the
+// message's channel (see State.Ask) then the message is passed to that
+// handler instead and is not routed any further.
+//
+// This opens a read lock on the handlerMutex while the message is matched (see
+// match) but releases it before the matched handler is run.
 func (d *dispatch) ProcessMessage(m chat.Message) {
-	d.handlerMutex.RLock()
-	defer d.handlerMutex.RUnlock()
+	// answers are delivered before matching since the handler waiting for
+	// them is still running
+	if d.conversations.deliver(m) {
+		return
+	}
 	defer func() {
 		if e := recover(); e != nil {
 			log.Println("Unexpected Panic Processing Message:", m.Text(), " -- Error:", e)
 			return
 		}
 	}()
+	if run := d.match(m); run != nil {
+		run()
+	}
+}
+
+// match finds the handler for a message as described by ProcessMessage. It
+// returns a function which runs the handler or nil if nothing matched.
+//
+// This opens a read lock on the handlerMutex so new commands cannot be added
+// while a message is being matched. The lock is released before the returned
+// function is run so a long running handler (ex: one waiting in State.Ask)
+// cannot hold up a pending write lock and with it all other message
+// processing.
+func (d *dispatch) match(m chat.Message) func() {
+	d.handlerMutex.RLock()
+	defer d.handlerMutex.RUnlock()
 	messageText := m.Text()
 	nameMatch := d.botNameRegex.FindString(messageText)
 	if len(nameMatch) > 0 || m.IsDirectMessage() {
 		// slices are cheap (reference original) so if no match then it's ok
 		messageText = messageText[len(nameMatch):]
-		if !d.matchCommands(m, messageText) {
-			d.callDefault(m, messageText)
+		if run := d.matchCommands(m, messageText); run != nil {
+			return run
 		}
-	} else if len(nameMatch) == 0 {
-		d.matchPatterns(m)
+		return d.matchDefault(m, messageText)
 	}
+	return d.matchPatterns(m)
 }
 
-// callDefault invokes the default message handler if one is set.
-// If one is not set then it logs the unhandled occurrance but otherwise does
-// not fail.
+// matchDefault returns a function which invokes the default message handler if
+// one is set. If one is not set then it logs the unhandled occurrance and
+// returns nil.
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
-func (d *dispatch) callDefault(m chat.Message, messageText string) {
-	fields := parseFields(messageText)
-	if d.defaultHandler != nil {
-		d.defaultHandler.Handle(&state{
-			robot:   d.robot,
-			message: m,
-			fields:  fields,
-		})
-	} else {
+func (d *dispatch) matchDefault(m chat.Message, messageText string) func() {
+	if d.defaultHandler == nil {
 		log.Println("Default handler invoked but none is set.")
+		return nil
+	}
+	fields := parseFields(messageText)
+	handler, middleware := d.defaultHandler, d.middleware
+	return func() {
+		d.invoke(middleware, handler, 0, m, fields, Args{})
 	}
 }
 
@@ -507,14 +653,15 @@ func (d *dispatch) callDefault(m chat.Message, messageText string) {
 // commands. It performs case-insensitive matching and will return true upon
 // the first match. It expects the second parameter to be the message's text
 // with the bot's name and any follwing text up until the next word whitespace
-// removed. This returns true if a match is made and false otherwise.
+// removed. This returns a function which runs the matched command or nil if
+// no match is made.
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
-func (d *dispatch) matchCommands(m chat.Message, messageText string) bool {
+func (d *dispatch) matchCommands(m chat.Message, messageText string) func() {
 	fullFields := parseFields(messageText)
 	if len(fullFields) == 0 {
-		return false
+		return nil
 	}
 	commandName := strings.ToLower(fullFields[0])
 	fields := fullFields[1:]
@@ -522,37 +669,95 @@ func (d *dispatch) matchCommands(m chat.Message, messageText string) bool {
 	if !defined || command.IsRegexpCommand() {
 		return d.matchCommandRegexp(m, messageText, commandName, fields)
 	}
-	command.Handler().Handle(&state{
-		robot:   d.robot,
-		message: m,
-		fields:  fields,
-	})
-	return true
+	middleware := d.middleware
+	return func() {
+		d.runCommand(middleware, command, m, fields)
+	}
 }
 
 // matchCommandRegexp attemps to match a given command word from the given
 // message to one of the added regular expression commands. It expects the
 // second parameter to be the message's text with the bot's name and any
-// following whitespace removed. This returns true if a match is made and false
-// otherwise.
+// following whitespace removed. This returns a function which runs the matched
+// command or nil if no match is made.
 //
 // This performs a linear search through the slice of regular expression
 // commands so their priority is the same as the insertion order.
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
-func (d *dispatch) matchCommandRegexp(m chat.Message, messageText, commandName string, fields []string) bool {
+func (d *dispatch) matchCommandRegexp(m chat.Message, messageText, commandName string,
+	fields []string) func() {
 	cmd := d.findCommandRegexp(commandName)
 	if cmd == nil {
-		return false
+		return nil
 	}
-	cmd.Handler().Handle(&state{
-		robot:   d.robot,
-		message: m,
-		fields:  fields,
-	})
-	return true
+	middleware := d.middleware
+	return func() {
+		d.runCommand(middleware, cmd, m, fields)
+	}
+}
+
+// runCommand invokes the given command's handler if the message's sender is
+// permitted to run it. Otherwise the sender is sent a refusal message. If the
+// command declares arguments then the fields are parsed first and the sender
+// is sent the error and the command's usage if they are invalid.
+//
+// If the first field matches one of the command's subcommands then the
+// subcommand is run with the remaining fields instead. A command with
+// subcommands but without a handler replies with its help text.
+//
+// This does not acquire a lock on the handlerMutex and should be called
+// without holding one (see invoke).
+func (d *dispatch) runCommand(middleware []Middleware, cmd HandlerDocPair, m chat.Message,
+	fields []string) {
+	d.runSubcommand(middleware, strings.ToLower(cmd.Name()), cmd, m, fields)
+}
+
+// runSubcommand performs the work of runCommand for a command shown under the
+// given name (the path of command names used to reach it).
+//
+// This does not acquire a lock on the handlerMutex and should be called
+// without holding one (see invoke).
+func (d *dispatch) runSubcommand(middleware []Middleware, cmdName string, cmd HandlerDocPair,
+	m chat.Message, fields []string) {
+	if !canRun(d.robot.Roles(), cmd, m.User()) {
+		refuse(d.robot, m)
+		return
+	}
+	if len(fields) > 0 {
+		if sub := findSubcommand(cmd, fields[0]); sub != nil {
+			subName := cmdName + " " + strings.ToLower(sub.Name())
+			d.runSubcommand(middleware, subName, sub, m, fields[1:])
+			return
+		}
+	}
+	if cmd.Handler() == nil && len(cmd.Subcommands()) > 0 {
+		d.robot.Chat().Send(m.Channel().ID(), commandHelpText(d, cmdName, cmd, m.User()))
+		return
+	}
+	var args Args
+	if len(cmd.Args()) > 0 {
+		var err error
+		args, err = parseArgs(d.robot.Chat(), cmd.Args(), fields)
+		if err != nil {
+			d.robot.Chat().Send(m.Channel().ID(), fmt.Sprintf("%s\nUsage: %s %s",
+				err.Error(), cmdName, argsUsage(cmd.Args())))
+			return
+		}
+	}
+	d.invoke(middleware, cmd.Handler(), cmd.Timeout(), m, fields, args)
+}
 
+// findSubcommand returns the subcommand of the given command with the given
+// name (case insensitive) or nil if there is no such subcommand.
+func findSubcommand(cmd HandlerDocPair, name string) HandlerDocPair {
+	for _, sub := range cmd.Subcommands() {
+		if strings.EqualFold(sub.Name(), name) {
+			return sub
+		}
+	}
+	return nil
 }
 
 // findCommandRegexp searches the dispatch's internal slice of regexpCommands
@@ -574,22 +779,21 @@ func (d *dispatch) findCommandRegexp(commandPart string) HandlerDocPair {
 
 // matchPatterns iterates through the array of registered regular expressions
 // (patterns) in the order of insertion and checks if they match any part of
-// the given message's text. If they do then they are invoked with an empty
-// fields array.
+// the given message's text. If one does then this returns a function which
+// invokes its handler with an empty fields array or nil otherwise.
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
-func (d *dispatch) matchPatterns(m chat.Message) bool {
+func (d *dispatch) matchPatterns(m chat.Message) func() {
 	for _, pair := range d.patterns {
 		if pair.Exp().MatchString(m.Text()) {
-			pair.Handler().Handle(&state{
-				robot:   d.robot,
-				message: m,
-			})
-			return true
+			handler, middleware := pair.Handler(), d.middleware
+			return func() {
+				d.invoke(middleware, handler, 0, m, nil, Args{})
+			}
 		}
 	}
-	return false
+	return nil
 }
 
 // defaultHelpHandler either shows all available (and non-hidden) commands or
@@ -609,7 +813,8 @@ func defaultHelpHandler(s State, d *dispatch) {
 }
 
 // showAllCommands is used by the default help handler to show a list of all
-// non-hidden commands regsitered to the dispatch.
+// non-hidden commands regsitered to the dispatch that the message's sender is
+// permitted to run.
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
@@ -623,7 +828,7 @@ func showAllCommands(s State, d *dispatch) {
 	buf.WriteString(">>>")
 	for _, name := range d.commandNames {
 		docPair, ok := d.commands[name]
-		if !ok || docPair.IsHidden() {
+		if !ok || docPair.IsHidden() || !canRun(d.robot.Roles(), docPair, s.Message().User()) {
 			continue
 		}
 		buf.WriteString(fmt.Sprintf("*%s*", docPair.Name()))
@@ -636,9 +841,10 @@ func showAllCommands(s State, d *dispatch) {
 	s.Reply(buf.String())
 }
 
-// showCommandHelp shows the description, usage, and aliases if they are set
-// for a given command name. The command name should be the first element in
-// the state's Fields.
+// showCommandHelp shows the description, usage, aliases, and subcommands if
+// they are set for a given command name. The command name should be the first
+// element in the state's Fields and any following elements are treated as
+// a path of subcommand names (ex: "help deploy status").
 //
 // This does not acquire a lock on the handlerMutex but one should be acquired
 // for reading before calling this method.
@@ -650,12 +856,34 @@ func showCommandHelp(s State, d *dispatch) {
 	docPair, exists := d.commands[cmdName]
 	if !exists {
 		docPair = d.findCommandRegexp(cmdName)
-		if docPair == nil {
-			textFmt := "Unrecognized command _%s_.  Type *`help`* to view a list of all available commands."
-			s.Chat().Send(s.Message().Channel().ID(), fmt.Sprintf(textFmt, cmdName))
+	}
+	if docPair == nil || !canRun(d.robot.Roles(), docPair, s.Message().User()) {
+		textFmt := "Unrecognized command _%s_.  Type *`help`* to view a list of all available commands."
+		s.Chat().Send(s.Message().Channel().ID(), fmt.Sprintf(textFmt, cmdName))
+		return
+	}
+	for _, subName := range s.Fields()[1:] {
+		subName = strings.ToLower(subName)
+		sub := findSubcommand(docPair, subName)
+		if sub == nil || !canRun(d.robot.Roles(), sub, s.Message().User()) {
+			textFmt := "Unrecognized subcommand _%s_ of _%s_.  " +
+				"Type *`help %s`* to view a list of its subcommands."
+			s.Chat().Send(s.Message().Channel().ID(), fmt.Sprintf(textFmt, subName, cmdName, cmdName))
 			return
 		}
+		cmdName += " " + subName
+		docPair = sub
 	}
+	s.Reply(commandHelpText(d, cmdName, docPair, s.Message().User()))
+}
+
+// commandHelpText builds the help text for a given command (or subcommand)
+// which is shown under the given name. Subcommands which the given user is not
+// permitted to run or that are hidden are not listed.
+//
+// This does not acquire a lock on the handlerMutex but one should be acquired
+// for reading before calling this method.
+func commandHelpText(d *dispatch, cmdName string, docPair HandlerDocPair, user chat.User) string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("*%s*", cmdName))
 	if len(docPair.Description()) > 0 {
@@ -673,6 +901,21 @@ func showCommandHelp(s State, d *dispatch) {
 		}
 		buf.WriteString("_\n")
 	}
+	if len(docPair.Subcommands()) > 0 {
+		buf.WriteString("Subcommands:\n")
+		for _, sub := range docPair.Subcommands() {
+			if sub.IsHidden() || !canRun(d.robot.Roles(), sub, user) {
+				continue
+			}
+			buf.WriteString(fmt.Sprintf("*%s %s*", cmdName, strings.ToLower(sub.Name())))
+			if len(sub.Description()) > 0 {
+				buf.WriteString(fmt.Sprintf(" - _%s_", sub.Description()))
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fmt.Sprintf(
+			"\nFor help with a subcommand, type `help %s [subcommand name]`.\n", cmdName))
+	}
 	if len(docPair.Usage()) > 0 {
 		buf.WriteString(">>>")
 		for _, use := range docPair.Usage() {
@@ -682,7 +925,7 @@ func showCommandHelp(s State, d *dispatch) {
 			buf.WriteString("\n")
 		}
 	}
-	s.Reply(buf.String())
+	return buf.String()
 }
 
 var quoteCharacters = &unicode.RangeTable{
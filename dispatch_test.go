@@ -1,10 +1,12 @@
 package victor
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/FogCreek/victor/pkg/chat"
-	_ "github.com/FogCreek/victor/pkg/chat/mockAdapter"
+	"github.com/FogCreek/victor/pkg/chat/mockAdapter"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -443,3 +445,244 @@ func TestCommandPatternsFields(t *testing.T) {
 	bot.ProcessMessage(msg)
 	handler.HasRun(4)
 }
+
+func TestMiddlewareOrder(t *testing.T) {
+	bot := getMockBot()
+	handler := HandlerMock{t: t}
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(s State) {
+				calls = append(calls, name)
+				next(s)
+			}
+		}
+	}
+	bot.Use(record("first"))
+	bot.Use(record("second"))
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: handler.Func(),
+		CmdName:    "test",
+	})
+	bot.ProcessMessage(&chat.BaseMessage{MsgText: "test", MsgIsDirect: true})
+	handler.HasRun(1)
+	assert.Equal(t, []string{"first", "second"}, calls, "Middleware should run in the order it was added.")
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	bot := getMockBot()
+	commandHandle := HandlerMock{t: t}
+	regexpHandle := HandlerMock{t: t}
+	patternHandle := HandlerMock{t: t}
+	defaultHandle := HandlerMock{t: t}
+	allow := false
+	bot.Use(func(next HandlerFunc) HandlerFunc {
+		return func(s State) {
+			if allow {
+				next(s)
+			}
+		}
+	})
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: commandHandle.Func(),
+		CmdName:    "test",
+	})
+	bot.HandleCommandPattern("(?i)[t]?hank[s]?", &HandlerDoc{
+		CmdHandler: regexpHandle.Func(),
+		CmdName:    "thanks",
+	})
+	bot.HandlePattern("(?i)pattern", patternHandle.Func())
+	bot.SetDefaultHandler(defaultHandle.Func())
+	messages := []*chat.BaseMessage{
+		{MsgText: "test", MsgIsDirect: true},
+		{MsgText: "thanks", MsgIsDirect: true},
+		{MsgText: "pattern"},
+		{MsgText: "unknown", MsgIsDirect: true},
+	}
+
+	for _, msg := range messages {
+		bot.ProcessMessage(msg)
+	}
+	commandHandle.HasRun(0)
+	regexpHandle.HasRun(0)
+	patternHandle.HasRun(0)
+	defaultHandle.HasRun(0)
+
+	allow = true
+	for _, msg := range messages {
+		bot.ProcessMessage(msg)
+	}
+	commandHandle.HasRun(1)
+	regexpHandle.HasRun(1)
+	patternHandle.HasRun(1)
+	defaultHandle.HasRun(1)
+}
+
+func TestHandlerContextTimeout(t *testing.T) {
+	bot := getMockBot()
+	var ctxErr error
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: func(s State) {
+			<-s.Context().Done()
+			ctxErr = s.Context().Err()
+		},
+		CmdName:    "slow",
+		CmdTimeout: 10 * time.Millisecond,
+	})
+	bot.ProcessMessage(&chat.BaseMessage{MsgText: "slow", MsgIsDirect: true})
+	assert.Equal(t, context.DeadlineExceeded, ctxErr, "Handler context should time out.")
+}
+
+func TestHandlerContextStop(t *testing.T) {
+	bot := getMockBot()
+	started := make(chan struct{})
+	done := make(chan error)
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: func(s State) {
+			close(started)
+			<-s.Context().Done()
+			done <- s.Context().Err()
+		},
+		CmdName: "wait",
+	})
+	go bot.ProcessMessage(&chat.BaseMessage{MsgText: "wait", MsgIsDirect: true})
+	<-started
+	bot.Stop()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err, "Handler context should be cancelled on stop.")
+	case <-time.After(time.Second):
+		assert.Fail(t, "Handler context was not cancelled on stop.")
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	bot := getMockBot()
+	parentHandle := HandlerMock{t: t}
+	startHandle := HandlerMock{t: t}
+	statusHandle := HandlerMock{t: t}
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: parentHandle.Func(),
+		CmdName:    "deploy",
+		CmdSubcommands: []HandlerDocPair{
+			&HandlerDoc{CmdHandler: startHandle.Func(), CmdName: "start"},
+			&HandlerDoc{CmdHandler: statusHandle.Func(), CmdName: "Status"},
+		},
+	})
+	msg := &chat.BaseMessage{MsgIsDirect: true}
+
+	msg.MsgText = "deploy status"
+	statusHandle.ExpectFields([]string{})
+	bot.ProcessMessage(msg)
+	parentHandle.HasRun(0)
+	startHandle.HasRun(0)
+	statusHandle.HasRun(1)
+
+	msg.MsgText = "deploy START now"
+	startHandle.ExpectFields([]string{"now"})
+	bot.ProcessMessage(msg)
+	parentHandle.HasRun(0)
+	startHandle.HasRun(1)
+	statusHandle.HasRun(1)
+
+	msg.MsgText = "deploy other"
+	parentHandle.ExpectFields([]string{"other"})
+	bot.ProcessMessage(msg)
+	parentHandle.HasRun(1)
+	startHandle.HasRun(1)
+	statusHandle.HasRun(1)
+}
+
+func TestSubcommandHelp(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	bot.EnableHelpCommand()
+	bot.HandleCommand(&HandlerDoc{
+		CmdName:        "deploy",
+		CmdDescription: "Manage deploys.",
+		CmdSubcommands: []HandlerDocPair{
+			&HandlerDoc{CmdName: "start", CmdDescription: "Start a deploy."},
+			&HandlerDoc{
+				CmdName:        "status",
+				CmdDescription: "Show deploy status.",
+				CmdUsage:       []string{"`deploy id`"},
+			},
+		},
+	})
+	msg := &chat.BaseMessage{MsgIsDirect: true, MsgChannel: testChannel}
+
+	msg.MsgText = "help deploy"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "*deploy start* - _Start a deploy._")
+	assert.Contains(t, adapter.Sent[0].Text(), "*deploy status* - _Show deploy status._")
+
+	adapter.Clear()
+	msg.MsgText = "help deploy status"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "*deploy status* - _Show deploy status._")
+	assert.Contains(t, adapter.Sent[0].Text(), "deploy status `deploy id`")
+
+	adapter.Clear()
+	msg.MsgText = "deploy"
+	bot.ProcessMessage(msg)
+	assert.Len(t, adapter.Sent, 1, "A parent without a handler should reply with its help.")
+	assert.Contains(t, adapter.Sent[0].Text(), "*deploy start*")
+}
+
+func TestReplyInThread(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "test",
+		CmdHandler: func(s State) {
+			s.Reply("in channel")
+			s.ReplyInThread("in thread")
+		},
+	})
+	bot.ProcessMessage(&chat.BaseMessage{
+		MsgText:     "test",
+		MsgIsDirect: true,
+		MsgChannel:  testChannel,
+		MsgThreadID: "1234.5678",
+	})
+	if !assert.Len(t, adapter.Sent, 2) {
+		return
+	}
+	assert.Equal(t, "", adapter.Sent[0].ThreadID(), "Reply should post to the channel.")
+	assert.Equal(t, "1234.5678", adapter.Sent[1].ThreadID(), "ReplyInThread should post to the message's thread.")
+	assert.Equal(t, testChannel.ID(), adapter.Sent[1].ChannelID())
+	assert.Equal(t, "in thread", adapter.Sent[1].Text())
+}
+
+func TestPostEditDelete(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "test",
+		CmdHandler: func(s State) {
+			working, err := s.Chat().Post(s.Message().Channel().ID(), "", "working...")
+			if !assert.NoError(t, err) {
+				return
+			}
+			extra, _ := s.Chat().Post(s.Message().Channel().ID(), s.Message().ThreadID(), "extra")
+			assert.NoError(t, working.Edit("done"))
+			assert.NoError(t, extra.Delete())
+			assert.NotEqual(t, working.ID(), extra.ID(), "Sent messages should have unique IDs.")
+		},
+	})
+	bot.ProcessMessage(&chat.BaseMessage{
+		MsgText:     "test",
+		MsgIsDirect: true,
+		MsgChannel:  testChannel,
+		MsgThreadID: "1234.5678",
+	})
+	if !assert.Len(t, adapter.Posted, 2) {
+		return
+	}
+	assert.Equal(t, "done", adapter.Posted[0].Text)
+	assert.Equal(t, []string{"done"}, adapter.Posted[0].Edits, "Edits should be recorded.")
+	assert.False(t, adapter.Posted[0].Deleted)
+	assert.True(t, adapter.Posted[1].Deleted, "Deletes should be recorded.")
+	assert.Equal(t, "working...", adapter.Sent[0].Text(), "Posted messages should be sent.")
+	assert.Equal(t, "1234.5678", adapter.Sent[1].ThreadID())
+}
@@ -28,7 +28,10 @@ func main() {
 	signal.Notify(sigs, os.Interrupt)
 	<-sigs
 
-	bot.Stop()
+	// waits for running handlers to finish before disconnecting
+	if err := bot.Stop(); err != nil {
+		log.Println("Error stopping bot:", err)
+	}
 }
 
 func monitorErrors(errorChannel chan events.ErrorEvent) {
@@ -16,21 +16,14 @@ const SLACK_TOKEN = "SLACK_TOKEN"
 const BOT_NAME = "BOT_NAME"
 
 func main() {
-
-	defer func() {
-		// this is only necessary since the slack api used by the slack adapter
-		// does not currently implement a "Stop" or "Disconnect" method
-		if e := recover(); e != nil {
-			fmt.Println("bot.Stop() exited with panic: ", e)
-			os.Exit(1)
-		}
-	}()
-
-	bot := victor.New(victor.Config{
+	bot, err := victor.NewE(victor.Config{
 		ChatAdapter:   "slackRealtime",
 		AdapterConfig: slackRealtime.NewConfig(SLACK_TOKEN),
 		Name:          BOT_NAME,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	addHandlers(bot)
 	// optional help built in help command
 	bot.EnableHelpCommand()
@@ -42,7 +35,10 @@ func main() {
 	signal.Notify(sigs, os.Interrupt)
 	<-sigs
 
-	bot.Stop()
+	// waits for running handlers to finish before disconnecting
+	if err := bot.Stop(); err != nil {
+		log.Println("Error stopping bot:", err)
+	}
 }
 
 func monitorErrors(errorChannel <-chan events.ErrorEvent) {
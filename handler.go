@@ -1,6 +1,9 @@
 package victor
 
 import (
+	"context"
+	"time"
+
 	"github.com/FogCreek/victor/pkg/chat"
 )
 
@@ -18,6 +21,11 @@ func (f HandlerFunc) Handle(s State) {
 	f(s)
 }
 
+// Middleware wraps a HandlerFunc in order to run cross-cutting logic (logging,
+// permission checks, metrics, etc.) around every handler invocation. A
+// middleware may short-circuit the call by not calling the wrapped handler.
+type Middleware func(HandlerFunc) HandlerFunc
+
 // State defines an interface to provide a handler all of the necessary
 // information to reply to a message
 type State interface {
@@ -25,13 +33,20 @@ type State interface {
 	Chat() chat.Adapter
 	Message() chat.Message
 	Fields() []string
+	Args() Args
 	Reply(string)
+	ReplyInThread(string)
+	Ask(string, time.Duration) (chat.Message, error)
+	Context() context.Context
 }
 
 type state struct {
-	robot   Robot
-	message chat.Message
-	fields  []string
+	robot         Robot
+	message       chat.Message
+	fields        []string
+	args          Args
+	ctx           context.Context
+	conversations *conversations
 }
 
 // Reply is a convience method to reply to the current message.
@@ -42,6 +57,17 @@ func (s *state) Reply(msg string) {
 	s.robot.Chat().Send(s.message.Channel().ID(), msg)
 }
 
+// ReplyInThread is a convience method to reply to the current message in its
+// thread. If the message is at the root of a channel then this starts a new
+// thread from it.
+//
+// Calling "state.ReplyInThread(msg) is equivalent to calling
+// "state.Chat().SendInThread(state.Message().Channel().ID(),
+// state.Message().ThreadID(), msg)"
+func (s *state) ReplyInThread(msg string) {
+	s.robot.Chat().SendInThread(s.message.Channel().ID(), s.message.ThreadID(), msg)
+}
+
 // Returns the Robot
 func (s *state) Robot() Robot {
 	return s.robot
@@ -60,3 +86,19 @@ func (s *state) Message() chat.Message {
 func (s *state) Fields() []string {
 	return s.fields
 }
+
+// Args returns the command's parsed arguments. This is empty unless the
+// command declares arguments in its HandlerDoc.
+func (s *state) Args() Args {
+	return s.args
+}
+
+// Context returns the handler's context. It is derived from the robot's
+// context so it is cancelled when the robot is stopped or when the command's
+// timeout (if one is set) elapses.
+func (s *state) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
@@ -0,0 +1,294 @@
+package victor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+// AdminRole is the name of the built in administrator role. Users with this
+// role may run any command regardless of the command's required roles and are
+// the only users that may run the built in "roles" command.
+const AdminRole = "admin"
+
+// Name of the built in role management command that is added on a call to
+// *dispatch.EnableRoleCommands().
+const rolesCommandName = "roles"
+
+// rolesKeyPrefix is prepended to a user's ID to build the store key under
+// which that user's roles are saved.
+const rolesKeyPrefix = "victor.roles."
+
+// ErrInvalidRole is returned by Roles.Grant for a role name that is empty or
+// contains a comma since it could not be stored in a user's role list.
+var ErrInvalidRole = errors.New("role names must not be empty or contain commas")
+
+// Roles provides role based access control for commands. Roles are assigned
+// to users by their chat ID and persisted in the robot's store adapter.
+type Roles interface {
+	Grant(userID, role string) error
+	Revoke(userID, role string) error
+	UserRoles(userID string) []string
+	HasRole(userID, role string) bool
+	Users(role string) []string
+}
+
+// storeRoles implements the Roles interface on top of a store.ContextAdapter.
+// Each user's roles are saved as a sorted comma separated list.
+type storeRoles struct {
+	store store.ContextAdapter
+	mutex *sync.Mutex
+}
+
+// newStoreRoles returns a new Roles instance which persists roles to the given
+// store adapter.
+func newStoreRoles(s store.ContextAdapter) *storeRoles {
+	return &storeRoles{
+		store: s,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Grant adds the given role to the given user. This does nothing if the user
+// already has the role and returns ErrInvalidRole if the role's name is not
+// valid (see validRole) or the store's error if the role could not be saved.
+func (r *storeRoles) Grant(userID, role string) error {
+	role = normalizeRole(role)
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	roles, err := r.get(userID)
+	if err != nil {
+		return err
+	}
+	roles = appendInOrderWithoutRepeats(roles, role)
+	return r.store.Set(context.Background(), rolesKeyPrefix+userID, strings.Join(roles, ","))
+}
+
+// Revoke removes the given role from the given user. This does nothing if the
+// user does not have the role and returns the store's error if the change
+// could not be saved.
+func (r *storeRoles) Revoke(userID, role string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	role = normalizeRole(role)
+	roles, err := r.get(userID)
+	if err != nil {
+		return err
+	}
+	pos := sort.SearchStrings(roles, role)
+	if pos == len(roles) || roles[pos] != role {
+		return nil
+	}
+	roles = append(roles[:pos], roles[pos+1:]...)
+	if len(roles) == 0 {
+		return r.store.Delete(context.Background(), rolesKeyPrefix+userID)
+	}
+	return r.store.Set(context.Background(), rolesKeyPrefix+userID, strings.Join(roles, ","))
+}
+
+// UserRoles returns a sorted slice of all roles assigned to the given user.
+// Errors reading from the store are logged and no roles are returned.
+func (r *storeRoles) UserRoles(userID string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	roles, err := r.get(userID)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return roles
+}
+
+// HasRole returns true if the given user has been assigned the given role.
+func (r *storeRoles) HasRole(userID, role string) bool {
+	roles := r.UserRoles(userID)
+	role = normalizeRole(role)
+	pos := sort.SearchStrings(roles, role)
+	return pos < len(roles) && roles[pos] == role
+}
+
+// Users returns a sorted slice of the IDs of all users that have been assigned
+// the given role.
+func (r *storeRoles) Users(role string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	role = normalizeRole(role)
+	var users []string
+	err := r.store.Scan(context.Background(), rolesKeyPrefix, func(key, value string) bool {
+		for _, userRole := range strings.Split(value, ",") {
+			if userRole == role {
+				users = appendInOrderWithoutRepeats(users, key[len(rolesKeyPrefix):])
+				break
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return users
+}
+
+// get returns the stored roles for a user. The mutex should be held before
+// calling this method.
+func (r *storeRoles) get(userID string) ([]string, error) {
+	value, exists, err := r.store.Get(context.Background(), rolesKeyPrefix+userID)
+	if err != nil {
+		return []string{}, err
+	}
+	if !exists || len(value) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(value, ","), nil
+}
+
+// normalizeRole returns the role name in the format that it is stored in.
+func normalizeRole(role string) string {
+	return strings.ToLower(strings.TrimSpace(role))
+}
+
+// validRole returns true if the given normalized role name can be stored. Roles
+// are saved as a comma separated list so names must not be empty or contain
+// a comma.
+func validRole(role string) bool {
+	return len(role) > 0 && !strings.Contains(role, ",")
+}
+
+// canRun returns true if the given user is permitted to run the given
+// command. Commands without any required roles may be run by anyone while
+// commands with required roles may only be run by users with at least one of
+// those roles or the admin role.
+func canRun(roles Roles, cmd HandlerDocPair, user chat.User) bool {
+	required := cmd.Roles()
+	if len(required) == 0 {
+		return true
+	}
+	if user == nil || roles == nil {
+		return false
+	}
+	if roles.HasRole(user.ID(), AdminRole) {
+		return true
+	}
+	for _, role := range required {
+		if roles.HasRole(user.ID(), role) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse replies to the given message's sender that they are not permitted to
+// run a command.
+func refuse(r Robot, m chat.Message) {
+	name := ""
+	if m.User() != nil {
+		name = m.User().Name()
+	}
+	r.Chat().Send(m.Channel().ID(), fmt.Sprintf("Sorry, %s. I can't let you do that.", name))
+}
+
+// Set up base default roles handler. Before use a copy must be made and the
+// CmdHandler property must be set.
+var defaultRolesHandlerDoc = HandlerDoc{
+	CmdName:        rolesCommandName,
+	CmdDescription: "View and manage user roles.",
+	CmdUsage: []string{
+		"`user`",
+		"grant `user` `role`",
+		"revoke `user` `role`",
+		"members `role`",
+	},
+	CmdRoles: []string{AdminRole},
+}
+
+// EnableRoleCommands registers the built in "roles" command which allows
+// admins to grant, revoke, and list user roles from chat. This will log a
+// message if there is already a handler registered under that name.
+//
+// At least one user must be granted the admin role through Roles().Grant
+// before the command can be used.
+func (d *dispatch) EnableRoleCommands() {
+	if _, exists := d.commands[rolesCommandName]; exists {
+		log.Println("Enabling built in roles command and overriding set roles command.")
+	}
+	rolesHandler := defaultRolesHandlerDoc
+	rolesHandler.CmdHandler = func(s State) {
+		defaultRolesHandler(s, d)
+	}
+	d.HandleCommand(&rolesHandler)
+}
+
+// defaultRolesHandler either shows a user's roles, grants or revokes a role,
+// or lists all members of a role depending on the state's fields.
+func defaultRolesHandler(s State, d *dispatch) {
+	fields := s.Fields()
+	roles := d.robot.Roles()
+	switch {
+	case len(fields) == 1:
+		user := s.Chat().GetUser(fields[0])
+		if user == nil {
+			s.Reply(fmt.Sprintf("Unrecognized user _%s_.", fields[0]))
+			return
+		}
+		userRoles := roles.UserRoles(user.ID())
+		if len(userRoles) == 0 {
+			s.Reply(fmt.Sprintf("%s has no roles.", user.Name()))
+			return
+		}
+		s.Reply(fmt.Sprintf("%s has roles: _%s_", user.Name(), strings.Join(userRoles, ", ")))
+	case len(fields) == 3 && (strings.ToLower(fields[0]) == "grant" || strings.ToLower(fields[0]) == "revoke"):
+		user := s.Chat().GetUser(fields[1])
+		if user == nil {
+			s.Reply(fmt.Sprintf("Unrecognized user _%s_.", fields[1]))
+			return
+		}
+		role := normalizeRole(fields[2])
+		if !validRole(role) {
+			s.Reply("Role names must not be empty or contain commas. Type *`help roles`* to view usage.")
+			return
+		}
+		if strings.ToLower(fields[0]) == "grant" {
+			if err := roles.Grant(user.ID(), role); err != nil {
+				s.Reply(fmt.Sprintf("Failed to grant _%s_ to %s: %s", role, user.Name(), err))
+				return
+			}
+			s.Reply(fmt.Sprintf("Granted _%s_ to %s.", role, user.Name()))
+		} else {
+			if err := roles.Revoke(user.ID(), role); err != nil {
+				s.Reply(fmt.Sprintf("Failed to revoke _%s_ from %s: %s", role, user.Name(), err))
+				return
+			}
+			s.Reply(fmt.Sprintf("Revoked _%s_ from %s.", role, user.Name()))
+		}
+	case len(fields) == 2 && strings.ToLower(fields[0]) == "members":
+		role := normalizeRole(fields[1])
+		var buf bytes.Buffer
+		users := roles.Users(role)
+		if len(users) == 0 {
+			s.Reply(fmt.Sprintf("No users have the _%s_ role.", role))
+			return
+		}
+		buf.WriteString(fmt.Sprintf("Users with the _%s_ role:\n", role))
+		for _, userID := range users {
+			if user := s.Chat().GetUser(userID); user != nil {
+				buf.WriteString(user.Name())
+			} else {
+				buf.WriteString(userID)
+			}
+			buf.WriteString("\n")
+		}
+		s.Reply(buf.String())
+	default:
+		s.Reply("Unrecognized usage. Type *`help roles`* to view usage.")
+	}
+}
@@ -0,0 +1,185 @@
+package victor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/chat/mockAdapter"
+	"github.com/FogCreek/victor/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testUser = &chat.BaseUser{
+		UserID:   "UTestUser",
+		UserName: "Test User",
+	}
+	testChannel = &chat.BaseChannel{
+		ChannelID:   "CTestChannel",
+		ChannelName: "Test Channel",
+	}
+)
+
+func TestRolesGrantRevoke(t *testing.T) {
+	bot := getMockBot()
+	roles := bot.Roles()
+	assert.Empty(t, roles.UserRoles("U1"), "A new user should have no roles.")
+	roles.Grant("U1", "Deploy")
+	roles.Grant("U1", "ops")
+	roles.Grant("U1", "deploy")
+	roles.Grant("U2", "ops")
+	assert.Equal(t, []string{"deploy", "ops"}, roles.UserRoles("U1"), "Roles should be normalized, sorted, and unique.")
+	assert.True(t, roles.HasRole("U1", "DEPLOY"), "HasRole should be case insensitive.")
+	assert.False(t, roles.HasRole("U2", "deploy"), "U2 was not granted deploy.")
+	assert.Equal(t, []string{"U1", "U2"}, roles.Users("ops"), "Both users should have the ops role.")
+	roles.Revoke("U1", "ops")
+	roles.Revoke("U1", "missing")
+	assert.Equal(t, []string{"deploy"}, roles.UserRoles("U1"), "Revoked role should be removed.")
+	roles.Revoke("U1", "deploy")
+	assert.Empty(t, roles.UserRoles("U1"), "All roles should be removed.")
+	_, exists := bot.Store().Get(rolesKeyPrefix + "U1")
+	assert.False(t, exists, "Empty role lists should be deleted from the store.")
+
+	assert.Equal(t, ErrInvalidRole, roles.Grant("U1", "a,b"), "Role names with commas should be rejected.")
+	assert.Equal(t, ErrInvalidRole, roles.Grant("U1", " "), "Empty role names should be rejected.")
+	assert.Empty(t, roles.UserRoles("U1"), "Invalid roles should not be granted.")
+}
+
+func TestCommandRoles(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	handler := HandlerMock{t: t}
+	bot.HandleCommand(&HandlerDoc{
+		CmdHandler: handler.Func(),
+		CmdName:    "deploy",
+		CmdRoles:   []string{"deploy"},
+	})
+	msg := &chat.BaseMessage{
+		MsgText:     "deploy",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+
+	bot.ProcessMessage(msg)
+	handler.HasRunCustom(0, "User without the role should not run the command.")
+	assert.Len(t, adapter.Sent, 1, "User should be sent a refusal.")
+
+	bot.Roles().Grant(testUser.ID(), "deploy")
+	bot.ProcessMessage(msg)
+	handler.HasRunCustom(1, "User with the role should run the command.")
+
+	bot.Roles().Revoke(testUser.ID(), "deploy")
+	bot.Roles().Grant(testUser.ID(), AdminRole)
+	bot.ProcessMessage(msg)
+	handler.HasRunCustom(2, "Admins should run any command.")
+}
+
+func TestHelpHidesRestrictedCommands(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	bot.EnableHelpCommand()
+	bot.HandleCommand(&HandlerDoc{
+		CmdName:  "public",
+		CmdUsage: []string{""},
+	})
+	bot.HandleCommand(&HandlerDoc{
+		CmdName:  "secret",
+		CmdUsage: []string{""},
+		CmdRoles: []string{"ops"},
+	})
+	msg := &chat.BaseMessage{
+		MsgText:     "help",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+	bot.ProcessMessage(msg)
+	assert.Len(t, adapter.Sent, 1, "Help should have replied.")
+	assert.Contains(t, adapter.Sent[0].Text(), "public", "Public commands should be listed.")
+	assert.NotContains(t, adapter.Sent[0].Text(), "secret", "Restricted commands should be hidden.")
+
+	adapter.Clear()
+	msg.MsgText = "help secret"
+	bot.ProcessMessage(msg)
+	assert.True(t, strings.HasPrefix(adapter.Sent[0].Text(), "Unrecognized command"), "Restricted command help should be hidden.")
+
+	adapter.Clear()
+	bot.Roles().Grant(testUser.ID(), "ops")
+	msg.MsgText = "help"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "secret", "Permitted commands should be listed.")
+}
+
+func TestRolesCommand(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	adapter.UserRet = testUser
+	bot.EnableRoleCommands()
+	msg := &chat.BaseMessage{
+		MsgText:     "roles grant UTestUser ops",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+	bot.ProcessMessage(msg)
+	assert.False(t, bot.Roles().HasRole(testUser.ID(), "ops"), "Non admins should not be able to grant roles.")
+
+	bot.Roles().Grant(testUser.ID(), AdminRole)
+	bot.ProcessMessage(msg)
+	assert.True(t, bot.Roles().HasRole(testUser.ID(), "ops"), "Admins should be able to grant roles.")
+
+	msg.MsgText = "roles revoke UTestUser ops"
+	bot.ProcessMessage(msg)
+	assert.False(t, bot.Roles().HasRole(testUser.ID(), "ops"), "Admins should be able to revoke roles.")
+
+	adapter.Clear()
+	msg.MsgText = "roles grant UTestUser a,b"
+	bot.ProcessMessage(msg)
+	assert.Equal(t, []string{AdminRole}, bot.Roles().UserRoles(testUser.ID()), "Invalid roles should not be granted.")
+	assert.Contains(t, adapter.Sent[0].Text(), "must not be empty or contain commas")
+}
+
+// readOnlyStore is a store adapter which fails every write.
+type readOnlyStore struct {
+	store.ContextAdapter
+}
+
+var errReadOnly = errors.New("store is read only")
+
+func (s readOnlyStore) Set(ctx context.Context, key, value string) error {
+	return errReadOnly
+}
+
+func (s readOnlyStore) Delete(ctx context.Context, key string) error {
+	return errReadOnly
+}
+
+func TestRolesStoreErrors(t *testing.T) {
+	bot := getMockBot()
+	adapter := bot.Chat().(*mockAdapter.MockChatAdapter)
+	adapter.UserRet = testUser
+	bot.EnableRoleCommands()
+	bot.Roles().Grant(testUser.ID(), AdminRole)
+	bot.roles = newStoreRoles(readOnlyStore{bot.ContextStore()})
+	assert.Equal(t, errReadOnly, bot.Roles().Grant(testUser.ID(), "ops"), "Grant should return the store's error.")
+	assert.Equal(t, errReadOnly, bot.Roles().Revoke(testUser.ID(), AdminRole), "Revoke should return the store's error.")
+
+	msg := &chat.BaseMessage{
+		MsgText:     "roles grant UTestUser ops",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	}
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "Failed to grant", "Failed grants should be reported.")
+
+	adapter.Clear()
+	msg.MsgText = "roles revoke UTestUser admin"
+	bot.ProcessMessage(msg)
+	assert.Contains(t, adapter.Sent[0].Text(), "Failed to revoke", "Failed revokes should be reported.")
+}
@@ -13,22 +13,56 @@ func Register(name string, init InitFunc) {
 	adapters[name] = init
 }
 
+// Load returns the InitFunc registered under the given name or an
+// *UnknownAdapterError if there is none.
 func Load(name string) (InitFunc, error) {
 	a, ok := adapters[name]
 
 	if !ok {
-		return nil, fmt.Errorf("unkown adapter: %s", name)
+		return nil, &UnknownAdapterError{Name: name}
 	}
 
 	return a, nil
 }
 
-type InitFunc func(Robot) Adapter
+// InitFunc creates a new adapter for the given robot. It should return a
+// *ConfigError if the robot's configuration is missing or invalid for the
+// adapter rather than exiting the process.
+type InitFunc func(Robot) (Adapter, error)
+
+// UnknownAdapterError is returned by Load when no adapter has been registered
+// under the requested name.
+type UnknownAdapterError struct {
+	Name string
+}
+
+func (e *UnknownAdapterError) Error() string {
+	return fmt.Sprintf("unknown chat adapter: %s", e.Name)
+}
+
+// ConfigError is returned by an adapter's InitFunc when the configuration it
+// was given is missing or invalid.
+type ConfigError struct {
+	Adapter,
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration for chat adapter %s: %s", e.Adapter, e.Reason)
+}
 
 type Adapter interface {
 	Run()
 	Send(string, string)
 	SendDirectMessage(string, string)
+	// SendInThread sends a message to the thread with the given ID in the
+	// given channel. The message is sent to the channel itself if the thread
+	// ID is empty or the adapter does not support threads.
+	SendInThread(channelID, threadID, text string)
+	// Post sends a message like SendInThread (with an empty thread ID to send
+	// it to the channel) and returns a handle that can be used to edit or
+	// delete the message afterwards.
+	Post(channelID, threadID, text string) (SentMessage, error)
 	SendTyping(string)
 	Stop()
 	// ID should return a unique ID for that adapter which is guarenteed to
@@ -66,6 +100,24 @@ type Message interface {
 	IsDirectMessage() bool
 	ArchiveLink() string
 	Timestamp() string
+	// ThreadID returns the ID of the thread that replies to the message
+	// belong in. For a message in a thread this is the thread's ID and for a
+	// message at the root of a channel it is the ID of the thread that a
+	// reply would start. It is empty if the adapter does not support threads.
+	ThreadID() string
+}
+
+// SentMessage is a handle to a message sent with Adapter.Post.
+type SentMessage interface {
+	// ID returns the adapter's ID for the message.
+	ID() string
+	// Timestamp returns the time at which the message was sent in the same
+	// format as Message.Timestamp.
+	Timestamp() string
+	// Edit replaces the message's text.
+	Edit(string) error
+	// Delete removes the message.
+	Delete() error
 }
 
 type User interface {
@@ -10,6 +10,7 @@ type BaseMessage struct {
 	MsgIsDirect    bool
 	MsgArchiveLink string
 	MsgTimestamp   string
+	MsgThreadID    string
 }
 
 // User gets the message's user.
@@ -42,3 +43,8 @@ func (m *BaseMessage) ArchiveLink() string {
 func (m *BaseMessage) Timestamp() string {
 	return m.MsgTimestamp
 }
+
+// ThreadID gets the ID of the message's thread.
+func (m *BaseMessage) ThreadID() string {
+	return m.MsgThreadID
+}
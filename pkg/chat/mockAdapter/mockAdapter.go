@@ -3,6 +3,7 @@ package mockAdapter
 import (
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/FogCreek/victor/pkg/chat"
 )
@@ -25,7 +26,7 @@ var (
 // init Registers the mockAdapter with the victor framework under the chat
 // adapter name "mockAdapter".
 func init() {
-	chat.Register("mockAdapter", func(r chat.Robot) chat.Adapter {
+	chat.Register("mockAdapter", func(r chat.Robot) (chat.Adapter, error) {
 		nextIDMutex.Lock()
 		id := strconv.Itoa(nextID)
 		nextID++
@@ -50,7 +51,7 @@ func init() {
 				UserName:  r.Name(),
 				UserIsBot: true,
 			},
-		}
+		}, nil
 	})
 }
 
@@ -64,6 +65,8 @@ type MockChatAdapter struct {
 	Sent,
 	SentPublic,
 	SentDirect []MockMessagePair
+	// Posted holds the handles of messages sent with Post in order.
+	Posted                []*MockSentMessage
 	NameRet               string
 	UserRet               chat.User
 	ChannelRet            chat.Channel
@@ -81,6 +84,7 @@ func (m *MockChatAdapter) Clear() {
 	m.Sent = make([]MockMessagePair, 0, 10)
 	m.SentPublic = make([]MockMessagePair, 0, 10)
 	m.SentDirect = make([]MockMessagePair, 0, 10)
+	m.Posted = nil
 }
 
 func (m *MockChatAdapter) MaxLength() int {
@@ -116,6 +120,37 @@ func (m *MockChatAdapter) Send(channelID, text string) {
 	})
 }
 
+// SendInThread stores the given channelID, threadID, and text to the exported
+// arrays "Sent" and "SentPublic" as a MockMessagePair.
+func (m *MockChatAdapter) SendInThread(channelID, threadID, text string) {
+	m.Sent = append(m.Sent, MockMessagePair{
+		text:      text,
+		channelID: channelID,
+		threadID:  threadID,
+		isDirect:  false,
+	})
+	m.SentPublic = append(m.SentPublic, MockMessagePair{
+		text:      text,
+		channelID: channelID,
+		threadID:  threadID,
+		isDirect:  false,
+	})
+}
+
+// Post stores the message to the exported arrays "Sent" and "SentPublic" like
+// SendInThread and returns a *MockSentMessage which records any edits or
+// deletion. The handle is also added to the exported array "Posted".
+func (m *MockChatAdapter) Post(channelID, threadID, text string) (chat.SentMessage, error) {
+	m.SendInThread(channelID, threadID, text)
+	sent := &MockSentMessage{
+		id:        strconv.Itoa(len(m.Posted) + 1),
+		timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Text:      text,
+	}
+	m.Posted = append(m.Posted, sent)
+	return sent, nil
+}
+
 // SendDirectMessage stores the given userID and text to the exported array
 // "Sent" as a MockMessagePair with the "IsDirect" flag set to true.
 func (m *MockChatAdapter) SendDirectMessage(userID, text string) {
@@ -187,6 +222,7 @@ func (m *MockChatAdapter) IsPotentialChannel(string) bool {
 type MockMessagePair struct {
 	channelID,
 	userID,
+	threadID,
 	text string
 	isDirect bool
 }
@@ -202,6 +238,12 @@ func (mp *MockMessagePair) Text() string {
 	return mp.text
 }
 
+// ThreadID returns the id of the thread that the sent message was intended
+// for. This will not be set unless it was sent with SendInThread.
+func (mp *MockMessagePair) ThreadID() string {
+	return mp.threadID
+}
+
 // UserID returns the id of the user that the message was intended for. This
 // will not be sent unless it is a direct message.
 func (mp *MockMessagePair) UserID() string {
@@ -214,3 +256,38 @@ func (mp *MockMessagePair) UserID() string {
 func (mp *MockMessagePair) IsDirect() bool {
 	return mp.isDirect
 }
+
+// MockSentMessage is returned by the mockAdapter's Post method. Text holds
+// the message's current text, Edits holds the text of each edit in order, and
+// Deleted is set once the message has been deleted.
+type MockSentMessage struct {
+	id,
+	timestamp string
+	Text    string
+	Edits   []string
+	Deleted bool
+}
+
+// ID returns the message's id which is its position in the adapter's "Posted"
+// array starting at 1.
+func (sm *MockSentMessage) ID() string {
+	return sm.id
+}
+
+// Timestamp returns the time at which the message was posted in seconds.
+func (sm *MockSentMessage) Timestamp() string {
+	return sm.timestamp
+}
+
+// Edit records the edit and updates Text.
+func (sm *MockSentMessage) Edit(text string) error {
+	sm.Text = text
+	sm.Edits = append(sm.Edits, text)
+	return nil
+}
+
+// Delete sets Deleted to true.
+func (sm *MockSentMessage) Delete() error {
+	sm.Deleted = true
+	return nil
+}
@@ -1,6 +1,9 @@
 package mockState
 
 import (
+	"context"
+	"time"
+
 	"github.com/FogCreek/victor"
 	"github.com/FogCreek/victor/pkg/chat"
 )
@@ -9,6 +12,10 @@ type MockState struct {
 	MockRobot   victor.Robot
 	MockMessage *chat.BaseMessage
 	MockFields  []string
+	MockArgs    victor.Args
+	// MockAnswers are returned in order by calls to Ask.
+	MockAnswers []string
+	MockContext context.Context
 }
 
 // Reply is a convience method to reply to the current message.
@@ -19,6 +26,37 @@ func (s *MockState) Reply(msg string) {
 	s.MockRobot.Chat().Send(s.Message().Channel().ID(), msg)
 }
 
+// ReplyInThread is a convience method to reply to the current message in its
+// thread.
+//
+// Calling "state.ReplyInThread(msg) is equivalent to calling
+// "state.Chat().SendInThread(state.Message().Channel().ID(),
+// state.Message().ThreadID(), msg)"
+func (s *MockState) ReplyInThread(msg string) {
+	s.MockRobot.Chat().SendInThread(s.Message().Channel().ID(), s.Message().ThreadID(), msg)
+}
+
+// Ask replies with the given prompt (if it is not empty) and then returns the
+// next of the set MockAnswers as a message from the current message's user in
+// the current channel. This returns victor.ErrAskTimeout once all of the
+// answers have been used.
+func (s *MockState) Ask(prompt string, timeout time.Duration) (chat.Message, error) {
+	if len(prompt) > 0 {
+		s.Reply(prompt)
+	}
+	if len(s.MockAnswers) == 0 {
+		return nil, victor.ErrAskTimeout
+	}
+	answer := s.MockAnswers[0]
+	s.MockAnswers = s.MockAnswers[1:]
+	return &chat.BaseMessage{
+		MsgUser:     s.MockMessage.User(),
+		MsgChannel:  s.MockMessage.Channel(),
+		MsgText:     answer,
+		MsgIsDirect: s.MockMessage.IsDirectMessage(),
+	}, nil
+}
+
 // Robot returns the Robot.
 func (s *MockState) Robot() victor.Robot {
 	return s.MockRobot
@@ -38,3 +76,16 @@ func (s *MockState) Message() chat.Message {
 func (s *MockState) Fields() []string {
 	return s.MockFields
 }
+
+// Args returns the set MockArgs.
+func (s *MockState) Args() victor.Args {
+	return s.MockArgs
+}
+
+// Context returns the set MockContext or a background context if it is nil.
+func (s *MockState) Context() context.Context {
+	if s.MockContext == nil {
+		return context.Background()
+	}
+	return s.MockContext
+}
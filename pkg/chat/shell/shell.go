@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"sync"
 	"time"
@@ -14,7 +15,7 @@ import (
 
 const (
 	timeFormat     = "20060102150405"
-	chatNameFormat = "Shell Instance %d"
+	chatNameFormat = "Shell Instance %s"
 )
 
 var (
@@ -30,70 +31,119 @@ var (
 	}
 	nextID      = 0
 	nextIDMutex = &sync.Mutex{}
+
+	// Match "[threadID] text" which is used to reply in a thread.
+	threadRegexp = regexp.MustCompile(`^\[([^\]]+)\]\s*(.*)$`)
 )
 
 func init() {
-	chat.Register("shell", func(r chat.Robot) chat.Adapter {
+	chat.Register("shell", func(r chat.Robot) (chat.Adapter, error) {
 		nextIDMutex.Lock()
 		id := strconv.Itoa(nextID)
 		nextID++
 		nextIDMutex.Unlock()
 		return &Adapter{
-			robot: r,
-			stop:  make(chan bool),
-			id:    id,
-			lines: make(chan string),
+			robot:     r,
+			stop:      make(chan struct{}),
+			done:      make(chan struct{}),
+			stopOnce:  &sync.Once{},
+			sentMutex: &sync.Mutex{},
+			id:        id,
+			lines:     make(chan string),
+			errs:      make(chan error),
 			botUser: &chat.BaseUser{
 				UserID:    id,
 				UserName:  "unknown",
 				UserIsBot: true,
 			},
-		}
+		}, nil
 	})
 }
 
 type Adapter struct {
-	robot   chat.Robot
-	stop    chan bool
-	id      string
-	lines   chan string
-	botUser chat.User
+	robot    chat.Robot
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce *sync.Once
+	running  bool
+	id       string
+	lines    chan string
+	errs     chan error
+	botUser  chat.User
+	// nextThread counts the threads started by lines at the root of the
+	// shell and is used as their IDs.
+	nextThread int
+	// nextSent counts the messages sent with Post and is used as their IDs.
+	nextSent  int
+	sentMutex *sync.Mutex
 }
 
 func (a *Adapter) MaxLength() int {
 	return -1
 }
 
+// Run starts reading lines from stdin. Each line is received by the robot as
+// a direct message from the shell user.
+//
+// Threads are simulated: each line starts a new thread, which replies sent in
+// it are printed with, and a line of the form "[threadID] text" is received
+// in the given thread.
 func (a *Adapter) Run() {
 	reader := bufio.NewReader(os.Stdin)
 
+	// The reader only uses the adapter's own channels since it may still be
+	// blocked reading stdin after the adapter (and robot) have stopped.
 	go func() {
 		for {
-			if line, _, err := reader.ReadLine(); err == nil {
-				a.lines <- string(line)
-			} else {
-				a.robot.ChatErrors() <- &events.BaseError{
-					ErrorObj: err,
+			line, _, err := reader.ReadLine()
+			if err != nil {
+				select {
+				case a.errs <- err:
+				case <-a.stop:
 				}
+				return
+			}
+			select {
+			case a.lines <- string(line):
+			case <-a.stop:
+				return
 			}
 		}
 	}()
+	a.running = true
 	go a.monitorEvents()
 }
 
+// monitorEvents passes lines and errors from the stdin reader on to the robot
+// until the adapter is stopped.
 func (a *Adapter) monitorEvents() {
+	defer close(a.done)
 	for {
 		select {
 		case <-a.stop:
 			return
+		case err := <-a.errs:
+			select {
+			case a.robot.ChatErrors() <- &events.BaseError{ErrorObj: err}:
+			case <-a.stop:
+				return
+			}
 		case line := <-a.lines:
+			var threadID string
+			if match := threadRegexp.FindStringSubmatch(line); match != nil {
+				threadID, line = match[1], match[2]
+			} else {
+				a.nextThread++
+				threadID = strconv.Itoa(a.nextThread)
+			}
 			a.robot.Receive(&chat.BaseMessage{
-				MsgText:        string(line),
+				MsgText:        line,
 				MsgUser:        realUser,
 				MsgChannel:     defaultChannel,
 				MsgIsDirect:    true,
 				MsgArchiveLink: "",
 				MsgTimestamp:   time.Now().Format(timeFormat),
+				MsgThreadID:    threadID,
 			})
 		}
 	}
@@ -107,6 +157,59 @@ func (a *Adapter) Send(channelID, msg string) {
 	fmt.Println("SEND:", msg)
 }
 
+// SendInThread prints the message along with the ID of its thread.
+func (a *Adapter) SendInThread(channelID, threadID, msg string) {
+	if threadID == "" {
+		a.Send(channelID, msg)
+		return
+	}
+	fmt.Printf("SEND [%s]: %s\n", threadID, msg)
+}
+
+// Post prints the message along with an ID that is printed again when the
+// message is edited or deleted.
+func (a *Adapter) Post(channelID, threadID, msg string) (chat.SentMessage, error) {
+	a.sentMutex.Lock()
+	a.nextSent++
+	id := "msg" + strconv.Itoa(a.nextSent)
+	a.sentMutex.Unlock()
+	if threadID == "" {
+		fmt.Printf("SEND (%s): %s\n", id, msg)
+	} else {
+		fmt.Printf("SEND (%s) [%s]: %s\n", id, threadID, msg)
+	}
+	return &sentMessage{
+		id:        id,
+		timestamp: time.Now().Format(timeFormat),
+	}, nil
+}
+
+// sentMessage implements chat.SentMessage for messages printed by Post.
+type sentMessage struct {
+	id,
+	timestamp string
+}
+
+func (m *sentMessage) ID() string {
+	return m.id
+}
+
+func (m *sentMessage) Timestamp() string {
+	return m.timestamp
+}
+
+// Edit reprints the message with its new text.
+func (m *sentMessage) Edit(msg string) error {
+	fmt.Printf("EDIT (%s): %s\n", m.id, msg)
+	return nil
+}
+
+// Delete prints that the message was deleted.
+func (m *sentMessage) Delete() error {
+	fmt.Printf("DELETE (%s)\n", m.id)
+	return nil
+}
+
 func (a *Adapter) SendDirectMessage(userID, msg string) {
 	a.Send("", "DIRECT MESSAGE: "+msg)
 }
@@ -115,9 +218,15 @@ func (a *Adapter) SendTyping(string) {
 	return
 }
 
+// Stop stops the adapter and waits until it will no longer send to the
+// robot's channels.
 func (a *Adapter) Stop() {
-	a.stop <- true
-	close(a.stop)
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+	if a.running {
+		<-a.done
+	}
 }
 
 func (a *Adapter) ID() string {
@@ -3,7 +3,7 @@ package slackRealtime
 import (
 	"fmt"
 	"log"
-	"os"
+	"net/url"
 	"regexp"
 	"strings"
 	"sync"
@@ -62,16 +62,26 @@ type channelGroupInfo struct {
 
 // init registers SlackAdapter to the victor chat framework.
 func init() {
-	chat.Register(AdapterName, func(r chat.Robot) chat.Adapter {
+	chat.Register(AdapterName, func(r chat.Robot) (chat.Adapter, error) {
 		config, configSet := r.AdapterConfig()
 		if !configSet {
-			log.Println("A configuration struct implementing the SlackConfig interface must be set.")
-			os.Exit(1)
+			return nil, &chat.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "a configuration struct implementing the Config interface must be set",
+			}
 		}
 		sConfig, ok := config.(Config)
 		if !ok {
-			log.Println("The bot's config must implement the SlackConfig interface.")
-			os.Exit(1)
+			return nil, &chat.ConfigError{
+				Adapter: AdapterName,
+				Reason:  fmt.Sprintf("the bot's config must implement the Config interface, got %T", config),
+			}
+		}
+		if sConfig.Token() == "" {
+			return nil, &chat.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "a token must be set",
+			}
 		}
 		return &SlackAdapter{
 			robot:           r,
@@ -81,11 +91,14 @@ func init() {
 			directMessageID: make(map[string]string),
 			userInfo:        make(map[string]slack.User),
 			mutex:           &sync.RWMutex{},
+			stop:            make(chan struct{}),
+			stopOnce:        &sync.Once{},
+			wg:              &sync.WaitGroup{},
 			botUser: &chat.BaseUser{
 				UserName:  "unknown", // We don't know our username until the adapter is started
 				UserIsBot: true,
 			},
-		}
+		}, nil
 	})
 }
 
@@ -122,6 +135,9 @@ type SlackAdapter struct {
 	userInfo        map[string]slack.User
 	mutex           *sync.RWMutex
 	botUser         chat.User
+	stop            chan struct{}
+	stopOnce        *sync.Once
+	wg              *sync.WaitGroup
 	formattedSlackID,
 	domain,
 	teamName string
@@ -265,6 +281,7 @@ func (adapter *SlackAdapter) Run() {
 	client := slack.New(adapter.token)
 	client.SetDebug(false)
 	adapter.rtm = client.NewRTM()
+	adapter.wg.Add(1)
 	go adapter.monitorEvents()
 	go adapter.rtm.ManageConnection()
 }
@@ -325,9 +342,43 @@ func (adapter *SlackAdapter) initAdapterInfo(info *slack.Info) {
 	}
 }
 
-// Stop stops the adapter.
+// Stop disconnects from slack and waits until the adapter will no longer send
+// to the robot's error and event channels. It is safe to call more than once.
 func (adapter *SlackAdapter) Stop() {
-	adapter.rtm.Disconnect()
+	adapter.stopOnce.Do(func() {
+		close(adapter.stop)
+		if adapter.rtm != nil {
+			adapter.rtm.Disconnect()
+		}
+	})
+	adapter.wg.Wait()
+}
+
+// spawn runs the given function on a new goroutine which Stop waits for.
+func (adapter *SlackAdapter) spawn(f func()) {
+	adapter.wg.Add(1)
+	go func() {
+		defer adapter.wg.Done()
+		f()
+	}()
+}
+
+// sendError passes an error event to the robot unless the adapter is stopped
+// first.
+func (adapter *SlackAdapter) sendError(e events.ErrorEvent) {
+	select {
+	case adapter.robot.ChatErrors() <- e:
+	case <-adapter.stop:
+	}
+}
+
+// sendEvent passes a chat event to the robot unless the adapter is stopped
+// first.
+func (adapter *SlackAdapter) sendEvent(e events.ChatEvent) {
+	select {
+	case adapter.robot.ChatEvents() <- e:
+	case <-adapter.stop:
+	}
 }
 
 // ID returns a unique ID for this adapter. At the moment this just returns
@@ -406,6 +457,16 @@ func (adapter *SlackAdapter) handleMessage(event *slack.MessageEvent) {
 		} else {
 			archiveLink = "No archive link for Direct Messages"
 		}
+		// the slack client does not parse a message's "thread_ts" so it is
+		// read with the Web API. Replies to a message at the root of a
+		// channel start a thread under the message's own timestamp.
+		threadID, err := adapter.getThreadID(event.ChannelId, event.Timestamp)
+		if err != nil {
+			log.Printf("Error getting thread of message \"%s\": %s", event.Timestamp, err.Error())
+		}
+		if threadID == "" {
+			threadID = event.Timestamp
+		}
 		msg := chat.BaseMessage{
 			MsgUser: &chat.BaseUser{
 				UserID:    user.Id,
@@ -420,6 +481,7 @@ func (adapter *SlackAdapter) handleMessage(event *slack.MessageEvent) {
 			MsgIsDirect:    channel.IsDM,
 			MsgTimestamp:   strings.SplitN(event.Timestamp, ".", 2)[0],
 			MsgArchiveLink: archiveLink,
+			MsgThreadID:    threadID,
 		}
 		adapter.robot.Receive(&msg)
 	}
@@ -473,67 +535,71 @@ func shouldUnformat(part string) bool {
 }
 
 // monitorEvents handles incoming events and filters them to only worry about
-// incoming messages.
+// incoming messages. It returns once the adapter is stopped.
 func (adapter *SlackAdapter) monitorEvents() {
-	errorChannel := adapter.robot.ChatErrors()
-	eventChannel := adapter.robot.ChatEvents()
+	defer adapter.wg.Done()
 	for {
-		event := <-adapter.rtm.IncomingEvents
+		var event slack.SlackEvent
+		select {
+		case <-adapter.stop:
+			return
+		case event = <-adapter.rtm.IncomingEvents:
+		}
 
 		switch e := event.Data.(type) {
 		case *slack.InvalidAuthEvent:
-			errorChannel <- &definedEvents.InvalidAuth{}
+			adapter.sendError(&definedEvents.InvalidAuth{})
 		case *slack.ConnectingEvent:
-			eventChannel <- &definedEvents.ConnectingEvent{}
+			adapter.sendEvent(&definedEvents.ConnectingEvent{})
 		case *slack.ConnectedEvent:
-			go adapter.initAdapterInfo(e.Info)
-			eventChannel <- &definedEvents.ConnectedEvent{}
+			adapter.spawn(func() { adapter.initAdapterInfo(e.Info) })
+			adapter.sendEvent(&definedEvents.ConnectedEvent{})
 		case *slack.SlackWSError:
-			errorChannel <- &events.BaseError{
+			adapter.sendError(&events.BaseError{
 				ErrorObj: e,
-			}
+			})
 		case *slack.DisconnectedEvent:
-			errorChannel <- &definedEvents.Disconnect{
+			adapter.sendError(&definedEvents.Disconnect{
 				Intentional: e.Intentional,
-			}
+			})
 		case *slack.MessageEvent:
-			go adapter.handleMessage(e)
+			adapter.spawn(func() { adapter.handleMessage(e) })
 		case *slack.ChannelJoinedEvent:
-			go adapter.joinedChannel(e.Channel, true)
+			adapter.spawn(func() { adapter.joinedChannel(e.Channel, true) })
 		case *slack.GroupJoinedEvent:
-			go adapter.joinedChannel(e.Channel, false)
+			adapter.spawn(func() { adapter.joinedChannel(e.Channel, false) })
 		case *slack.IMCreatedEvent:
-			go adapter.joinedIM(e)
+			adapter.spawn(func() { adapter.joinedIM(e) })
 		case *slack.ChannelLeftEvent:
-			go adapter.leftChannel(e.ChannelId, true)
+			adapter.spawn(func() { adapter.leftChannel(e.ChannelId, true) })
 		case *slack.GroupLeftEvent:
-			go adapter.leftChannel(e.ChannelId, false)
+			adapter.spawn(func() { adapter.leftChannel(e.ChannelId, false) })
 		case *slack.IMCloseEvent:
-			go adapter.leftIM(e)
+			adapter.spawn(func() { adapter.leftIM(e) })
 		case *slack.TeamDomainChangeEvent:
-			go adapter.domainChanged(e)
+			adapter.spawn(func() { adapter.domainChanged(e) })
 		case *slack.TeamRenameEvent:
-			go adapter.teamNameChanged(e)
+			adapter.spawn(func() { adapter.teamNameChanged(e) })
 		case *slack.UserChangeEvent:
-			go adapter.userChanged(e.User)
+			adapter.spawn(func() { adapter.userChanged(e.User) })
 		case *slack.TeamJoinEvent:
-			go adapter.userChanged(*e.User)
+			adapter.spawn(func() { adapter.userChanged(*e.User) })
 		case *slack.ChannelRenameEvent:
-			go adapter.channelRenamed(e.Channel)
+			adapter.spawn(func() { adapter.channelRenamed(e.Channel) })
 		case *slack.UnmarshallingErrorEvent:
-			errorChannel <- &events.BaseError{
+			adapter.sendError(&events.BaseError{
 				ErrorObj: e.ErrorObj,
-			}
+			})
 		case *slack.OutgoingErrorEvent:
-			errorChannel <- &events.BaseError{
+			adapter.sendError(&events.BaseError{
 				ErrorObj: e.ErrorObj,
-			}
+			})
 		case *slack.MessageTooLongEvent:
-			errorChannel <- &definedEvents.MessageTooLong{
+			adapter.sendError(&definedEvents.MessageTooLong{
 				MaxLength: e.MaxLength,
 				Text:      e.Message.Text,
 				ChannelID: e.Message.ChannelId,
-			}
+			})
 		}
 	}
 }
@@ -546,10 +612,10 @@ func (adapter *SlackAdapter) channelRenamed(channel slack.ChannelRenameInfo) {
 		ChannelName: channel.Name,
 	}
 	if oldChannel, exists := adapter.channelInfo[channel.Id]; exists {
-		adapter.robot.ChatEvents() <- &definedEvents.ChannelChangedEvent{
+		adapter.sendEvent(&definedEvents.ChannelChangedEvent{
 			OldName: oldChannel.Name,
 			Channel: chatChannel,
-		}
+		})
 		oldChannel.Name = channel.Name
 		adapter.channelInfo[channel.Id] = oldChannel
 	}
@@ -579,13 +645,13 @@ func (adapter *SlackAdapter) userChanged(user slack.User) {
 			changed = true
 		}
 		if changed {
-			adapter.robot.ChatEvents() <- event
+			adapter.sendEvent(event)
 		}
 	} else {
-		adapter.robot.ChatEvents() <- &definedEvents.UserEvent{
+		adapter.sendEvent(&definedEvents.UserEvent{
 			User:       chatUser,
 			WasRemoved: false,
-		}
+		})
 	}
 	adapter.userInfo[user.Id] = user
 }
@@ -612,13 +678,13 @@ func (adapter *SlackAdapter) joinedChannel(channel slack.Channel, isChannel bool
 		IsGeneral: channel.IsGeneral,
 	}
 	if isChannel {
-		adapter.robot.ChatEvents() <- &definedEvents.ChannelEvent{
+		adapter.sendEvent(&definedEvents.ChannelEvent{
 			Channel: &chat.BaseChannel{
 				ChannelName: channel.Name,
 				ChannelID:   channel.Id,
 			},
 			WasRemoved: false,
-		}
+		})
 	}
 }
 
@@ -645,13 +711,13 @@ func (adapter *SlackAdapter) leftChannel(channelID string, isChannel bool) {
 	channelName := adapter.channelInfo[channelID].Name
 	delete(adapter.channelInfo, channelID)
 	if isChannel {
-		adapter.robot.ChatEvents() <- &definedEvents.ChannelEvent{
+		adapter.sendEvent(&definedEvents.ChannelEvent{
 			Channel: &chat.BaseChannel{
 				ChannelName: channelName,
 				ChannelID:   channelID,
 			},
 			WasRemoved: true,
-		}
+		})
 	}
 }
 
@@ -661,6 +727,76 @@ func (adapter *SlackAdapter) Send(channelID, msg string) {
 	adapter.rtm.SendMessage(msgObj)
 }
 
+// SendInThread sends a message to the given slack thread, which is identified
+// by the timestamp of the message that started it. The real time API cannot
+// send to a thread so this uses Post.
+func (adapter *SlackAdapter) SendInThread(channelID, threadID, msg string) {
+	if _, err := adapter.Post(channelID, threadID, msg); err != nil {
+		log.Printf("Error sending message in thread \"%s\": %s", threadID, err.Error())
+	}
+}
+
+// Post sends a message to the given slack channel (or thread if the thread ID
+// is not empty) with the "chat.postMessage" Web API method, which unlike the
+// real time API responds with the message's timestamp so that it can be
+// edited or deleted later.
+func (adapter *SlackAdapter) Post(channelID, threadID, msg string) (chat.SentMessage, error) {
+	values := url.Values{
+		"channel": {channelID},
+		"text":    {msg},
+		"as_user": {"true"},
+	}
+	if len(threadID) > 0 {
+		values.Set("thread_ts", threadID)
+	}
+	result, err := adapter.callWebAPI("chat.postMessage", values)
+	if err != nil {
+		return nil, err
+	}
+	return &sentMessage{
+		adapter:   adapter,
+		channelID: result.Channel,
+		timestamp: result.TS,
+	}, nil
+}
+
+// sentMessage implements chat.SentMessage for messages sent with Post. Slack
+// identifies a message by its channel and timestamp.
+type sentMessage struct {
+	adapter *SlackAdapter
+	channelID,
+	timestamp string
+}
+
+// ID returns the message's full slack timestamp.
+func (m *sentMessage) ID() string {
+	return m.timestamp
+}
+
+// Timestamp returns the message's timestamp in seconds.
+func (m *sentMessage) Timestamp() string {
+	return strings.SplitN(m.timestamp, ".", 2)[0]
+}
+
+// Edit replaces the message's text using the "chat.update" Web API method.
+func (m *sentMessage) Edit(msg string) error {
+	_, err := m.adapter.callWebAPI("chat.update", url.Values{
+		"channel": {m.channelID},
+		"ts":      {m.timestamp},
+		"text":    {msg},
+	})
+	return err
+}
+
+// Delete removes the message using the "chat.delete" Web API method.
+func (m *sentMessage) Delete() error {
+	_, err := m.adapter.callWebAPI("chat.delete", url.Values{
+		"channel": {m.channelID},
+		"ts":      {m.timestamp},
+	})
+	return err
+}
+
 // SendDirectMessage sends the given message to the given user in a direct
 // (private) message.
 func (adapter *SlackAdapter) SendDirectMessage(userID, msg string) {
@@ -0,0 +1,86 @@
+package slackRealtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/FogCreek/slack"
+	"github.com/FogCreek/victor/pkg/chat"
+)
+
+// receivingRobot records the messages passed to Receive.
+type receivingRobot struct {
+	chat.Robot
+	received []chat.Message
+}
+
+func (r *receivingRobot) Name() string {
+	return "victor"
+}
+
+func (r *receivingRobot) Receive(msg chat.Message) {
+	r.received = append(r.received, msg)
+}
+
+// newTestAdapter returns an adapter which knows one user and channel and
+// calls the Web API methods of the given server.
+func newTestAdapter(t *testing.T, server *httptest.Server) (*SlackAdapter, *receivingRobot) {
+	oldURL := webAPIURL
+	webAPIURL = server.URL + "/"
+	t.Cleanup(func() { webAPIURL = oldURL })
+	robot := &receivingRobot{}
+	return &SlackAdapter{
+		robot:       robot,
+		token:       "token",
+		channelInfo: map[string]channelGroupInfo{"C1": {ID: "C1", Name: "general", IsChannel: true}},
+		userInfo:    map[string]slack.User{"U1": {Id: "U1", Name: "bob"}},
+		mutex:       &sync.RWMutex{},
+		domain:      "team",
+	}, robot
+}
+
+func TestHandleMessageThread(t *testing.T) {
+	// a reply in the thread started by "1.0001" and an unthreaded message
+	threads := map[string]string{"1.0002": "1.0001", "2.0001": ""}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/conversations.replies" || r.FormValue("channel") != "C1" {
+			t.Error("Unexpected Web API call: ", r.URL.Path, r.Form)
+		}
+		ts := r.FormValue("ts")
+		parent := webAPIMessage{TS: ts}
+		if threadTS := threads[ts]; threadTS != "" {
+			parent = webAPIMessage{TS: threadTS, ThreadTS: threadTS}
+		}
+		json.NewEncoder(w).Encode(&webAPIResponse{OK: true, Messages: []webAPIMessage{parent}})
+	}))
+	defer server.Close()
+	adapter, robot := newTestAdapter(t, server)
+
+	adapter.handleMessage(&slack.MessageEvent{ChannelId: "C1", UserId: "U1", Text: "reply", Timestamp: "1.0002"})
+	adapter.handleMessage(&slack.MessageEvent{ChannelId: "C1", UserId: "U1", Text: "root", Timestamp: "2.0001"})
+	if len(robot.received) != 2 {
+		t.Fatal("Expected both messages to be received, got: ", len(robot.received))
+	}
+	if id := robot.received[0].ThreadID(); id != "1.0001" {
+		t.Error("Expected a reply to be in its parent's thread, got: ", id)
+	}
+	if id := robot.received[1].ThreadID(); id != "2.0001" {
+		t.Error("Expected a root message to start a thread under its own timestamp, got: ", id)
+	}
+}
+
+func TestHandleMessageThreadError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&webAPIResponse{OK: false, Error: "ratelimited"})
+	}))
+	defer server.Close()
+	adapter, robot := newTestAdapter(t, server)
+
+	adapter.handleMessage(&slack.MessageEvent{ChannelId: "C1", UserId: "U1", Text: "hi", Timestamp: "1.0002"})
+	if len(robot.received) != 1 || robot.received[0].ThreadID() != "1.0002" {
+		t.Error("Expected a failed lookup to fall back to the message's timestamp")
+	}
+}
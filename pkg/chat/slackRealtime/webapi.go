@@ -0,0 +1,73 @@
+package slackRealtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webAPIURL is the base URL of Slack's Web API methods.
+var webAPIURL = "https://slack.com/api/"
+
+// webAPIClient is used for all Web API calls made by the adapter itself.
+var webAPIClient = &http.Client{Timeout: 30 * time.Second}
+
+// webAPIResponse holds the fields of a Web API response that the adapter
+// uses.
+type webAPIResponse struct {
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error"`
+	Channel  string          `json:"channel"`
+	TS       string          `json:"ts"`
+	Messages []webAPIMessage `json:"messages"`
+}
+
+// webAPIMessage holds the fields of a message listed in a Web API response
+// that the adapter uses.
+type webAPIMessage struct {
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// callWebAPI calls the given Web API method with the adapter's token. This is
+// used for the methods which take arguments or return fields that the slack
+// client does not support (ex: "thread_ts").
+func (adapter *SlackAdapter) callWebAPI(method string, values url.Values) (*webAPIResponse, error) {
+	values.Set("token", adapter.token)
+	resp, err := webAPIClient.PostForm(webAPIURL+method, values)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &webAPIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error reading %s response: %s", method, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("%s failed: %s", method, result.Error)
+	}
+	return result, nil
+}
+
+// getThreadID returns the timestamp of the thread that the message with the
+// given timestamp was sent in, or an empty string if it was not sent in a
+// thread. Given a reply's timestamp "conversations.replies" lists its thread
+// starting with the parent message, and every message in a thread has the
+// parent's timestamp as its "thread_ts".
+func (adapter *SlackAdapter) getThreadID(channelID, timestamp string) (string, error) {
+	result, err := adapter.callWebAPI("conversations.replies", url.Values{
+		"channel":   {channelID},
+		"ts":        {timestamp},
+		"limit":     {"1"},
+		"inclusive": {"true"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(result.Messages) == 0 {
+		return "", nil
+	}
+	return result.Messages[0].ThreadTS, nil
+}
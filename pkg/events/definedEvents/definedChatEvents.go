@@ -52,7 +52,7 @@ func (u *UserChangedEvent) String() string {
 		return fmt.Sprintf("User %s changed: name "+changeFmt,
 			u.User.ID(), u.OldEmailAddress, u.User.EmailAddress())
 	} else {
-		return fmt.Sprintf("User %d did not change", u.User.ID())
+		return fmt.Sprintf("User %s did not change", u.User.ID())
 	}
 }
 
@@ -56,3 +56,22 @@ func (m *MessageTooLong) ErrorObject() error {
 func (m *MessageTooLong) IsFatal() bool {
 	return false
 }
+
+// MessageDropped is sent when an incoming message is discarded because the
+// robot's message queue is full.
+type MessageDropped struct {
+	ChannelID string
+	Text      string
+}
+
+func (m *MessageDropped) Error() string {
+	return m.ErrorObject().Error()
+}
+
+func (m *MessageDropped) ErrorObject() error {
+	return fmt.Errorf("Message queue full - dropped message in channel %s", m.ChannelID)
+}
+
+func (m *MessageDropped) IsFatal() bool {
+	return false
+}
@@ -0,0 +1,216 @@
+// Package schedule parses cron-style schedule specifications and computes
+// their activation times.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes a recurring activation time.
+type Schedule interface {
+	// Next returns the first activation time strictly after the given time
+	// or the zero time if there is none.
+	Next(time.Time) time.Time
+}
+
+// bounds describes the accepted values of a single cron field.
+type bounds struct {
+	min, max uint
+}
+
+var (
+	minuteBounds = bounds{0, 59}
+	hourBounds   = bounds{0, 23}
+	domBounds    = bounds{1, 31}
+	monthBounds  = bounds{1, 12}
+	dowBounds    = bounds{0, 7}
+)
+
+// descriptors maps the supported "@" shorthands to their five field
+// equivalents.
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// maxSearchYears limits how far in the future Next will look for a matching
+// time so impossible specs (ex: "0 0 30 2 *") terminate.
+const maxSearchYears = 5
+
+// Parse parses a cron specification. Five space separated fields are
+// supported (minute, hour, day of month, month, and day of week) and each
+// field accepts "*", single values, ranges ("1-5"), lists ("1,3,5"), and steps
+// ("*/15" or "0-30/10"). Day of week accepts 0 or 7 for Sunday.
+//
+// The descriptors "@yearly", "@annually", "@monthly", "@weekly", "@daily",
+// "@midnight", and "@hourly" are supported as well as "@every <duration>"
+// where the duration is parsed by time.ParseDuration.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid @every duration: %s", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("@every duration must be positive: %s", d)
+		}
+		return Every(d), nil
+	}
+	if expanded, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron spec, found %d: %q", len(fields), spec)
+	}
+	s := &cronSchedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, err
+	}
+	// Sunday may be given as either 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	s.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return s, nil
+}
+
+// MustParse is like Parse but panics if the spec cannot be parsed.
+func MustParse(spec string) Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// parseField parses a single cron field into a bit set of accepted values.
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid step in cron field %q", field)
+			}
+			step = uint(n)
+			part = part[:i]
+		}
+		start, end := b.min, b.max
+		if part != "*" {
+			rangeParts := strings.SplitN(part, "-", 2)
+			n, err := strconv.ParseUint(rangeParts[0], 10, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in cron field %q", field)
+			}
+			start = uint(n)
+			end = start
+			if len(rangeParts) == 2 {
+				n, err = strconv.ParseUint(rangeParts[1], 10, 8)
+				if err != nil {
+					return 0, fmt.Errorf("invalid range in cron field %q", field)
+				}
+				end = uint(n)
+			} else if step > 1 {
+				end = b.max
+			}
+		}
+		if start < b.min || end > b.max || start > end {
+			return 0, fmt.Errorf("cron field %q out of range [%d, %d]", field, b.min, b.max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// cronSchedule is a parsed five field cron specification where each field is
+// stored as a bit set of accepted values.
+type cronSchedule struct {
+	minute,
+	hour,
+	dom,
+	month,
+	dow uint64
+	domStar,
+	dowStar bool
+}
+
+// Next returns the next minute after t that matches the schedule in t's
+// location.
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows the usual cron rule: if both the day of month and day of
+// week are restricted then either may match, otherwise both must match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Every returns a schedule that activates at a fixed interval. Intervals are
+// rounded down to the second and must be at least one second long.
+func Every(d time.Duration) Schedule {
+	if d < time.Second {
+		d = time.Second
+	}
+	return every(d - d%time.Second)
+}
+
+type every time.Duration
+
+// Next returns t plus the interval truncated to the second.
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e)).Truncate(time.Second)
+}
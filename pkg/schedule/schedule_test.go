@@ -0,0 +1,67 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestNext(t *testing.T) {
+	cases := []struct {
+		spec, from, expected string
+	}{
+		{"* * * * *", "2015-06-01 10:00", "2015-06-01 10:01"},
+		{"*/15 * * * *", "2015-06-01 10:01", "2015-06-01 10:15"},
+		{"30 9 * * 1-5", "2015-06-05 10:00", "2015-06-08 09:30"},
+		{"0 0 1 1 *", "2015-06-01 10:00", "2016-01-01 00:00"},
+		{"@daily", "2015-06-01 10:00", "2015-06-02 00:00"},
+		{"@hourly", "2015-06-01 10:00", "2015-06-01 11:00"},
+		{"0 12 * * 7", "2015-06-01 10:00", "2015-06-07 12:00"},
+		{"0 0 13 * 5", "2015-06-01 10:00", "2015-06-05 00:00"},
+		{"0,30 8-9 * * *", "2015-06-01 08:30", "2015-06-01 09:00"},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", c.spec, err)
+			continue
+		}
+		actual := s.Next(mustTime(t, c.from))
+		if !actual.Equal(mustTime(t, c.expected)) {
+			t.Errorf("%q from %s: expected %s, got %s", c.spec, c.from, c.expected, actual)
+		}
+	}
+}
+
+func TestEvery(t *testing.T) {
+	s, err := Parse("@every 90s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := mustTime(t, "2015-06-01 10:00")
+	if actual := s.Next(from); !actual.Equal(from.Add(90 * time.Second)) {
+		t.Error("Expected @every to add its interval, got", actual)
+	}
+}
+
+func TestImpossible(t *testing.T) {
+	s := MustParse("0 0 30 2 *")
+	if actual := s.Next(mustTime(t, "2015-06-01 10:00")); !actual.IsZero() {
+		t.Error("Expected no activation for February 30th, got", actual)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "@every nope"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected error parsing %q", spec)
+		}
+	}
+}
@@ -1,6 +1,34 @@
 package store
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidTTL is returned by SetWithTTL when the TTL is not positive.
+	ErrInvalidTTL = errors.New("ttl must be positive")
+
+	// ErrNotInteger is returned by Incr when the key's existing value is not
+	// a base 10 integer.
+	ErrNotInteger = errors.New("value is not an integer")
+
+	// ErrInvalidNamespace is returned by every method of the adapter that
+	// Namespace returns for an empty name and by DeleteNamespace for an
+	// empty name.
+	ErrInvalidNamespace = errors.New("namespace name must not be empty")
+
+	// ErrUnsupported is returned by adapters wrapped with WithContext for
+	// features that the wrapped Adapter does not implement.
+	ErrUnsupported = errors.New("not supported by this adapter")
+)
 
 var adapters = map[string]InitFunc{}
 
@@ -8,26 +36,536 @@ func Register(name string, init InitFunc) {
 	adapters[name] = init
 }
 
+// Load returns the InitFunc registered under the given name or an
+// *UnknownAdapterError if there is none.
 func Load(name string) (InitFunc, error) {
 	a, ok := adapters[name]
 
 	if !ok {
-		return nil, fmt.Errorf("unkown adapter: %s", name)
+		return nil, &UnknownAdapterError{Name: name}
 	}
 
 	return a, nil
 }
 
-type InitFunc func(Robot) Adapter
+// InitFunc creates a new adapter for the given robot. It should return a
+// *ConfigError if the robot's configuration is missing or invalid for the
+// adapter rather than exiting the process.
+type InitFunc func(Robot) (ContextAdapter, error)
+
+// UnknownAdapterError is returned by Load when no adapter has been registered
+// under the requested name.
+type UnknownAdapterError struct {
+	Name string
+}
+
+func (e *UnknownAdapterError) Error() string {
+	return fmt.Sprintf("unknown store adapter: %s", e.Name)
+}
+
+// ConfigError is returned by an adapter's InitFunc when the configuration it
+// was given is missing or invalid.
+type ConfigError struct {
+	Adapter,
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration for store adapter %s: %s", e.Adapter, e.Reason)
+}
 
 type Robot interface {
 	Name() string
 	StoreConfig() (interface{}, bool)
 }
 
+// Adapter is the original store interface which has no way of reporting
+// errors. It is kept so existing adapters and handlers continue to compile.
+// An Adapter can be registered by wrapping it with WithContext and a
+// ContextAdapter can be used as one by wrapping it with Legacy. New code
+// should use ContextAdapter.
 type Adapter interface {
 	Get(string) (string, bool)
 	Set(string, string)
 	Delete(string)
 	All() map[string]string
 }
+
+// ExtendedAdapter is an Adapter which also supports the features that were
+// added to ContextAdapter after the original interface. Adapters returned by
+// Legacy implement it and WithContext uses these methods when the wrapped
+// Adapter implements it. New code should use ContextAdapter, for example
+// robot.ContextStore().Namespace(name), to get errors as well.
+type ExtendedAdapter interface {
+	Adapter
+	SetWithTTL(string, string, time.Duration)
+	Incr(string, int64) int64
+	CompareAndSwap(string, string, string) bool
+	Update(func(Tx) error) error
+	Keys(string) []string
+	Scan(string, func(string, string) bool)
+	Namespace(string) ExtendedAdapter
+	Namespaces() []string
+	DeleteNamespace(string)
+}
+
+// ContextAdapter is the interface implemented by store adapters. Every method
+// takes a context which an adapter may use to abandon slow operations and
+// returns any error from the underlying storage.
+type ContextAdapter interface {
+	// Get returns the value stored under the given key. The second return
+	// value is false if there is no such key.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores the given value under the given key, replacing any
+	// existing value.
+	Set(ctx context.Context, key, value string) error
+	// SetWithTTL is like Set but the key expires once the given TTL has
+	// elapsed. Expired keys are never returned by the adapter even if they
+	// have not been removed yet. Setting the key again with Set removes its
+	// TTL. This returns ErrInvalidTTL if the TTL is not positive.
+	SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error
+	// Delete removes the given key. Deleting a key that does not exist is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+	// Incr atomically adds delta to the integer stored under the given key
+	// and returns the result. A missing key is treated as zero and an
+	// existing key keeps its TTL. This returns ErrNotInteger if the key's
+	// value is not an integer.
+	Incr(ctx context.Context, key string, delta int64) (int64, error)
+	// CompareAndSwap atomically sets the given key to new if its current
+	// value is old. This returns false without changing anything if the key
+	// does not exist or has a different value. Like Set, a successful swap
+	// removes the key's TTL.
+	CompareAndSwap(ctx context.Context, key, old, new string) (bool, error)
+	// Update calls fn with a transaction which can read and write this
+	// adapter's keys. If fn returns nil all of its writes are applied
+	// atomically, otherwise none of them are and Update returns fn's error.
+	// fn must only access the store through the given Tx.
+	Update(ctx context.Context, fn func(Tx) error) error
+	// All returns a copy of every key and value in the store. Keys in
+	// namespaces are not included.
+	All(ctx context.Context) (map[string]string, error)
+	// Keys returns the sorted keys that start with the given prefix. An
+	// empty prefix returns every key.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Scan calls fn with each key that starts with the given prefix and its
+	// value in key order until fn returns false. Adapters do not hold any
+	// locks while calling fn so it may write to the store but writes made
+	// during a scan may or may not be seen by it.
+	Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error
+	// Namespace returns an adapter whose keys are kept separate from this
+	// adapter's keys and those of any other namespace. Namespaces may be
+	// nested and are created on their first write. The name must not be
+	// empty, every method of the adapter returned for an empty name returns
+	// ErrInvalidNamespace (see ErrorAdapter).
+	Namespace(name string) ContextAdapter
+	// Namespaces returns the sorted names of this adapter's namespaces which
+	// hold at least one key, either directly or in a nested namespace. A
+	// namespace whose keys have all been deleted or have expired is not
+	// listed.
+	Namespaces(ctx context.Context) ([]string, error)
+	// DeleteNamespace removes the given namespace and everything in it.
+	// Deleting a namespace that does not exist is not an error.
+	DeleteNamespace(ctx context.Context, name string) error
+}
+
+// Tx provides access to an adapter's keys within a transaction started by
+// ContextAdapter.Update. Reads see the transaction's own writes.
+type Tx interface {
+	Get(key string) (string, bool, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+// Sweeper is implemented by adapters which need expired keys to be removed
+// periodically. The robot calls Sweep on its store at a regular interval
+// while it is running.
+type Sweeper interface {
+	// Sweep removes every expired key from the adapter and its namespaces.
+	Sweep(ctx context.Context) error
+}
+
+// Expirer is implemented by adapters that can report when a key set with a
+// TTL expires. Export uses it to keep TTLs.
+type Expirer interface {
+	// Expires returns the time at which the given key expires or the zero
+	// time if the key does not exist or has no TTL.
+	Expires(ctx context.Context, key string) (time.Time, error)
+}
+
+// Sealer is implemented by adapters that encrypt the values they are given
+// before passing them to another adapter. Export writes the entries of the
+// adapter returned by Sealed so exports never hold decrypted values.
+type Sealer interface {
+	// Sealed returns the adapter holding this adapter's encrypted entries.
+	Sealed() ContextAdapter
+}
+
+// Legacy wraps a ContextAdapter so it can be used as an Adapter. Each call
+// uses a background context and errors are logged since Adapter has no way
+// to return them.
+func Legacy(a ContextAdapter) ExtendedAdapter {
+	return &legacyAdapter{adapter: a}
+}
+
+type legacyAdapter struct {
+	adapter ContextAdapter
+}
+
+func (l *legacyAdapter) Get(key string) (string, bool) {
+	val, exists, err := l.adapter.Get(context.Background(), key)
+	if err != nil {
+		log.Println("[store Get] error getting", key, "-", err)
+	}
+	return val, exists
+}
+
+func (l *legacyAdapter) Set(key, val string) {
+	if err := l.adapter.Set(context.Background(), key, val); err != nil {
+		log.Println("[store Set] error setting", key, "-", err)
+	}
+}
+
+func (l *legacyAdapter) SetWithTTL(key, val string, ttl time.Duration) {
+	if err := l.adapter.SetWithTTL(context.Background(), key, val, ttl); err != nil {
+		log.Println("[store SetWithTTL] error setting", key, "-", err)
+	}
+}
+
+func (l *legacyAdapter) Delete(key string) {
+	if err := l.adapter.Delete(context.Background(), key); err != nil {
+		log.Println("[store Delete] error deleting", key, "-", err)
+	}
+}
+
+func (l *legacyAdapter) Incr(key string, delta int64) int64 {
+	val, err := l.adapter.Incr(context.Background(), key, delta)
+	if err != nil {
+		log.Println("[store Incr] error incrementing", key, "-", err)
+	}
+	return val
+}
+
+func (l *legacyAdapter) CompareAndSwap(key, old, new string) bool {
+	swapped, err := l.adapter.CompareAndSwap(context.Background(), key, old, new)
+	if err != nil {
+		log.Println("[store CompareAndSwap] error swapping", key, "-", err)
+	}
+	return swapped
+}
+
+func (l *legacyAdapter) Update(fn func(Tx) error) error {
+	return l.adapter.Update(context.Background(), fn)
+}
+
+func (l *legacyAdapter) All() map[string]string {
+	all, err := l.adapter.All(context.Background())
+	if err != nil {
+		log.Println("[store All] error listing keys -", err)
+		return make(map[string]string)
+	}
+	return all
+}
+
+func (l *legacyAdapter) Keys(prefix string) []string {
+	keys, err := l.adapter.Keys(context.Background(), prefix)
+	if err != nil {
+		log.Println("[store Keys] error listing keys with prefix", prefix, "-", err)
+		return []string{}
+	}
+	return keys
+}
+
+func (l *legacyAdapter) Scan(prefix string, fn func(key, value string) bool) {
+	if err := l.adapter.Scan(context.Background(), prefix, fn); err != nil {
+		log.Println("[store Scan] error scanning keys with prefix", prefix, "-", err)
+	}
+}
+
+func (l *legacyAdapter) Namespace(name string) ExtendedAdapter {
+	return Legacy(l.adapter.Namespace(name))
+}
+
+func (l *legacyAdapter) Namespaces() []string {
+	names, err := l.adapter.Namespaces(context.Background())
+	if err != nil {
+		log.Println("[store Namespaces] error listing namespaces -", err)
+		return []string{}
+	}
+	return names
+}
+
+func (l *legacyAdapter) DeleteNamespace(name string) {
+	if err := l.adapter.DeleteNamespace(context.Background(), name); err != nil {
+		log.Println("[store DeleteNamespace] error deleting", name, "-", err)
+	}
+}
+
+// ErrorAdapter returns an adapter whose every method returns the given error.
+// Adapters return ErrorAdapter(ErrInvalidNamespace) from Namespace for an
+// empty name.
+func ErrorAdapter(err error) ContextAdapter {
+	return &contextAdapter{err: err}
+}
+
+// WithContext wraps an Adapter so it can be used as a ContextAdapter. This
+// allows adapters written against the original interface to be registered.
+// The wrapped adapter never returns errors of its own and only checks that
+// the context is not done before each call.
+//
+// If the Adapter does not implement ExtendedAdapter then the features it
+// lacks are emulated: Incr, CompareAndSwap, and Update are made atomic with a
+// mutex (so they are only atomic with respect to other calls through the
+// returned adapter), Keys and Scan are built on All, and there are never any
+// namespaces. SetWithTTL and the adapters returned by Namespace return
+// ErrUnsupported.
+func WithContext(a Adapter) ContextAdapter {
+	if l, ok := a.(*legacyAdapter); ok {
+		return l.adapter
+	}
+	ext, _ := a.(ExtendedAdapter)
+	return &contextAdapter{adapter: a, ext: ext, mutex: &sync.Mutex{}}
+}
+
+type contextAdapter struct {
+	adapter Adapter
+	// ext is nil if adapter does not implement ExtendedAdapter.
+	ext   ExtendedAdapter
+	mutex *sync.Mutex
+	// err is returned by every call if it is set. It is used for namespaces
+	// of adapters which do not support them.
+	err error
+}
+
+// check returns the error that a call should fail with, if any.
+func (c *contextAdapter) check(ctx context.Context) error {
+	if c.err != nil {
+		return c.err
+	}
+	return ctx.Err()
+}
+
+func (c *contextAdapter) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := c.check(ctx); err != nil {
+		return "", false, err
+	}
+	val, exists := c.adapter.Get(key)
+	return val, exists, nil
+}
+
+func (c *contextAdapter) Set(ctx context.Context, key, val string) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	c.adapter.Set(key, val)
+	return nil
+}
+
+func (c *contextAdapter) SetWithTTL(ctx context.Context, key, val string, ttl time.Duration) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	if c.ext == nil {
+		return ErrUnsupported
+	}
+	c.ext.SetWithTTL(key, val, ttl)
+	return nil
+}
+
+func (c *contextAdapter) Delete(ctx context.Context, key string) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	c.adapter.Delete(key)
+	return nil
+}
+
+func (c *contextAdapter) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := c.check(ctx); err != nil {
+		return 0, err
+	}
+	if c.ext != nil {
+		return c.ext.Incr(key, delta), nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var current int64
+	if val, exists := c.adapter.Get(key); exists {
+		var err error
+		if current, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	current += delta
+	c.adapter.Set(key, strconv.FormatInt(current, 10))
+	return current, nil
+}
+
+func (c *contextAdapter) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	if err := c.check(ctx); err != nil {
+		return false, err
+	}
+	if c.ext != nil {
+		return c.ext.CompareAndSwap(key, old, new), nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if val, exists := c.adapter.Get(key); !exists || val != old {
+		return false, nil
+	}
+	c.adapter.Set(key, new)
+	return true, nil
+}
+
+func (c *contextAdapter) Update(ctx context.Context, fn func(Tx) error) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	if c.ext != nil {
+		return c.ext.Update(fn)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	tx := &fallbackTx{adapter: c.adapter, writes: make(map[string]*string)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, key := range tx.order {
+		if val := tx.writes[key]; val == nil {
+			c.adapter.Delete(key)
+		} else {
+			c.adapter.Set(key, *val)
+		}
+	}
+	return nil
+}
+
+// fallbackTx buffers the writes of a transaction on an Adapter which does
+// not implement ExtendedAdapter until the transaction succeeds. A nil value
+// in writes is a delete.
+type fallbackTx struct {
+	adapter Adapter
+	writes  map[string]*string
+	order   []string
+}
+
+func (tx *fallbackTx) Get(key string) (string, bool, error) {
+	if val, written := tx.writes[key]; written {
+		if val == nil {
+			return "", false, nil
+		}
+		return *val, true, nil
+	}
+	val, exists := tx.adapter.Get(key)
+	return val, exists, nil
+}
+
+func (tx *fallbackTx) Set(key, val string) error {
+	tx.write(key, &val)
+	return nil
+}
+
+func (tx *fallbackTx) Delete(key string) error {
+	tx.write(key, nil)
+	return nil
+}
+
+func (tx *fallbackTx) write(key string, val *string) {
+	if _, written := tx.writes[key]; !written {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = val
+}
+
+func (c *contextAdapter) All(ctx context.Context) (map[string]string, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	all := make(map[string]string)
+	for key, val := range c.adapter.All() {
+		all[key] = val
+	}
+	return all, nil
+}
+
+func (c *contextAdapter) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	if c.ext != nil {
+		return c.ext.Keys(prefix), nil
+	}
+	keys := []string{}
+	for key := range c.adapter.All() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (c *contextAdapter) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	if c.ext != nil {
+		c.ext.Scan(prefix, func(key, value string) bool {
+			return ctx.Err() == nil && fn(key, value)
+		})
+		return ctx.Err()
+	}
+	all := c.adapter.All()
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if ctx.Err() != nil || !fn(key, all[key]) {
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *contextAdapter) Namespace(name string) ContextAdapter {
+	if c.err != nil {
+		return c
+	}
+	if name == "" {
+		return ErrorAdapter(ErrInvalidNamespace)
+	}
+	if c.ext == nil {
+		return &contextAdapter{err: ErrUnsupported}
+	}
+	return WithContext(c.ext.Namespace(name))
+}
+
+func (c *contextAdapter) Namespaces(ctx context.Context) ([]string, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	if c.ext == nil {
+		return []string{}, nil
+	}
+	return c.ext.Namespaces(), nil
+}
+
+func (c *contextAdapter) DeleteNamespace(ctx context.Context, name string) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	if name == "" {
+		return ErrInvalidNamespace
+	}
+	if c.ext != nil {
+		c.ext.DeleteNamespace(name)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/memory"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryStore(t *testing.T) store.ContextAdapter {
+	initFunc, err := store.Load("memory")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s, err := initFunc(nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return s
+}
+
+func TestLoadUnknown(t *testing.T) {
+	_, err := store.Load("nonexistent")
+	assert.IsType(t, &store.UnknownAdapterError{}, err)
+}
+
+func TestLegacy(t *testing.T) {
+	s := newMemoryStore(t)
+	legacy := store.Legacy(s)
+	legacy.Set("a", "b")
+	val, exists, err := s.Get(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "b", val)
+	assert.Equal(t, map[string]string{"a": "b"}, legacy.All())
+	legacy.Delete("a")
+	_, exists = legacy.Get("a")
+	assert.False(t, exists, "Deleted keys should not exist.")
+	assert.Equal(t, s, store.WithContext(legacy), "Unwrapping a legacy adapter should return the original.")
+}
+
+func TestWithContext(t *testing.T) {
+	legacy := store.Legacy(newMemoryStore(t))
+	s := store.WithContext(&wrapped{legacy})
+	assert.NoError(t, s.Set(context.Background(), "a", "b"))
+	val, exists, err := s.Get(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "b", val)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.Set(ctx, "a", "c"), "Done contexts should fail.")
+	_, _, err = s.Get(ctx, "a")
+	assert.Equal(t, context.Canceled, err)
+	val, _ = legacy.Get("a")
+	assert.Equal(t, "b", val, "Failed calls should not reach the wrapped adapter.")
+}
+
+// wrapped hides the type of a legacy adapter so WithContext cannot unwrap it
+// and only exposes the original Adapter methods.
+type wrapped struct {
+	store.Adapter
+}
+
+// extWrapped is like wrapped but exposes every ExtendedAdapter method.
+type extWrapped struct {
+	store.ExtendedAdapter
+}
+
+func TestWithContextFallback(t *testing.T) {
+	ctx := context.Background()
+	legacy := store.Legacy(newMemoryStore(t))
+	s := store.WithContext(&wrapped{legacy})
+	s.Set(ctx, "karma.b", "2")
+	s.Set(ctx, "karma.a", "1")
+	s.Set(ctx, "other", "x")
+
+	n, err := s.Incr(ctx, "karma.a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n, "Incr should work on adapters without it.")
+	_, err = s.Incr(ctx, "other", 1)
+	assert.Equal(t, store.ErrNotInteger, err)
+	swapped, _ := s.CompareAndSwap(ctx, "other", "x", "y")
+	assert.True(t, swapped)
+	swapped, _ = s.CompareAndSwap(ctx, "other", "x", "z")
+	assert.False(t, swapped)
+
+	err = s.Update(ctx, func(tx store.Tx) error {
+		tx.Set("new", "1")
+		return assert.AnError
+	})
+	assert.Equal(t, assert.AnError, err)
+	_, exists := legacy.Get("new")
+	assert.False(t, exists, "Failed transactions should not be applied.")
+	assert.NoError(t, s.Update(ctx, func(tx store.Tx) error {
+		tx.Set("new", "1")
+		tx.Delete("other")
+		val, exists, _ := tx.Get("new")
+		assert.True(t, exists, "Transactions should see their own writes.")
+		assert.Equal(t, "1", val)
+		return nil
+	}))
+	_, exists = legacy.Get("other")
+	assert.False(t, exists, "Successful transactions should be applied.")
+
+	keys, err := s.Keys(ctx, "karma.")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karma.a", "karma.b"}, keys)
+	var scanned []string
+	assert.NoError(t, s.Scan(ctx, "", func(key, value string) bool {
+		scanned = append(scanned, key)
+		return len(scanned) < 2
+	}))
+	assert.Equal(t, []string{"karma.a", "karma.b"}, scanned, "Scan should be in key order.")
+
+	assert.Equal(t, store.ErrUnsupported, s.SetWithTTL(ctx, "a", "b", time.Minute))
+	assert.Equal(t, store.ErrUnsupported, s.Namespace("ns").Set(ctx, "a", "b"))
+	names, err := s.Namespaces(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	s = store.WithContext(&extWrapped{legacy})
+	assert.NoError(t, s.Namespace("ns").Set(ctx, "a", "b"), "Extended adapters should be used when available.")
+	assert.NoError(t, s.SetWithTTL(ctx, "ttl", "b", time.Minute))
+	names, _ = s.Namespaces(ctx)
+	assert.Equal(t, []string{"ns"}, names)
+}
+
+func TestMemoryConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+		return newMemoryStore(t), func() {}
+	})
+}
+
+func TestMemoryNamespace(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(t)
+	karma := s.Namespace("karma")
+	assert.NoError(t, s.Set(ctx, "a", "root"))
+	assert.NoError(t, karma.Set(ctx, "a", "karma"))
+	assert.NoError(t, karma.Namespace("nested").Set(ctx, "a", "nested"))
+
+	all, _ := s.All(ctx)
+	assert.Equal(t, map[string]string{"a": "root"}, all, "Namespaced keys should not be in the root.")
+	val, _, _ := s.Namespace("karma").Get(ctx, "a")
+	assert.Equal(t, "karma", val)
+	val, _, _ = karma.Namespace("nested").Get(ctx, "a")
+	assert.Equal(t, "nested", val)
+	_, exists, _ := s.Namespace("other").Get(ctx, "a")
+	assert.False(t, exists)
+
+	names, err := s.Namespaces(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karma"}, names, "Unwritten namespaces should not be listed.")
+
+	assert.NoError(t, s.DeleteNamespace(ctx, "karma"))
+	_, exists, _ = karma.Get(ctx, "a")
+	assert.False(t, exists, "Deleted namespaces should be empty.")
+	assert.NoError(t, karma.Set(ctx, "b", "c"))
+	names, _ = s.Namespaces(ctx)
+	assert.Equal(t, []string{"karma"}, names, "Writing to a deleted namespace should recreate it.")
+
+	s.Namespace("emptied").Set(ctx, "a", "b")
+	s.Namespace("emptied").Delete(ctx, "a")
+	s.Namespace("expired").SetWithTTL(ctx, "a", "b", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	names, _ = s.Namespaces(ctx)
+	assert.Equal(t, []string{"karma"}, names, "Namespaces without keys should not be listed.")
+	assert.Equal(t, store.ErrInvalidNamespace, s.Namespace("").Set(ctx, "a", "b"))
+	assert.Equal(t, store.ErrInvalidNamespace, s.Namespace("").Namespace("a").Set(ctx, "a", "b"))
+	assert.Equal(t, store.ErrInvalidNamespace, s.DeleteNamespace(ctx, ""))
+
+	legacy := store.Legacy(s)
+	legacy.Namespace("karma").Set("d", "e")
+	val, _, _ = karma.Get(ctx, "d")
+	assert.Equal(t, "e", val)
+	assert.Equal(t, int64(1), legacy.Namespace("karma").Incr("count", 1), "Legacy namespaces should keep the extended methods.")
+	legacy.DeleteNamespace("karma")
+	assert.Empty(t, legacy.Namespaces())
+}
+
+func TestMemoryKeysScan(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(t)
+	s.Set(ctx, "karma.b", "2")
+	s.Set(ctx, "karma.a", "1")
+	s.Set(ctx, "other", "3")
+	s.Namespace("karma.ns").Set(ctx, "c", "4")
+
+	keys, err := s.Keys(ctx, "karma.")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karma.a", "karma.b"}, keys)
+	keys, _ = s.Keys(ctx, "")
+	assert.Equal(t, []string{"karma.a", "karma.b", "other"}, keys, "Empty prefix should match every key.")
+
+	var scanned []string
+	err = s.Scan(ctx, "karma.", func(key, value string) bool {
+		// writing during a scan should not deadlock
+		s.Set(ctx, key, value+value)
+		scanned = append(scanned, key+"="+value)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karma.a=1", "karma.b=2"}, scanned)
+
+	scanned = nil
+	store.Legacy(s).Scan("", func(key, value string) bool {
+		scanned = append(scanned, key)
+		return false
+	})
+	assert.Equal(t, []string{"karma.a"}, scanned, "Scan should stop when fn returns false.")
+
+	all, _ := s.All(ctx)
+	all["karma.a"] = "changed"
+	val, _, _ := s.Get(ctx, "karma.a")
+	assert.Equal(t, "11", val, "All should return a copy.")
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	assert.NoError(t, s.Set(ctx, "a", "root"))
+	assert.NoError(t, s.SetWithTTL(ctx, "ttl", "x", time.Hour))
+	assert.NoError(t, s.SetWithTTL(ctx, "expired", "x", time.Millisecond))
+	assert.NoError(t, s.Namespace("karma").Namespace("nested").Set(ctx, "a", "nested"))
+	assert.NoError(t, s.Namespace("empty").Set(ctx, "a", "x"))
+	assert.NoError(t, s.Namespace("empty").Delete(ctx, "a"))
+	time.Sleep(5 * time.Millisecond)
+
+	snapshot := s.Snapshot()
+	assert.Equal(t, map[string]string{"a": "root", "ttl": "x"}, snapshot.Data, "Expired keys should be left out.")
+	assert.Contains(t, snapshot.Expires, "ttl")
+	assert.NotContains(t, snapshot.Namespaces, "empty", "Empty namespaces should be left out.")
+
+	restored := memory.Restore(snapshot)
+	val, _, _ := restored.Namespace("karma").Namespace("nested").Get(ctx, "a")
+	assert.Equal(t, "nested", val, "Nested namespaces should be restored.")
+	assert.NoError(t, restored.Set(ctx, "a", "changed"))
+	val, _, _ = s.Get(ctx, "a")
+	assert.Equal(t, "root", val, "Restored stores should not share data with the original.")
+	assert.Equal(t, "nested", s.Namespace("karma").(*memory.MemoryStore).Snapshot().Namespaces["nested"].Data["a"],
+		"Snapshots of namespaces should start at the namespace.")
+}
+
+func TestMemoryWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newMemoryStore(t)
+	ns := s.Namespace("ns")
+	events := s.(store.Watcher).Watch(ctx, "karma.")
+	nsEvents := ns.(store.Watcher).Watch(ctx, "")
+	next := func(events <-chan store.StoreEvent) store.StoreEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event.")
+		}
+		return store.StoreEvent{}
+	}
+
+	s.Set(ctx, "other", "x")
+	s.Set(ctx, "karma.bob", "1")
+	s.Incr(ctx, "karma.bob", 2)
+	s.CompareAndSwap(ctx, "karma.bob", "1", "5")
+	s.Update(ctx, func(tx store.Tx) error {
+		tx.Set("karma.alice", "2")
+		return assert.AnError
+	})
+	s.Update(ctx, func(tx store.Tx) error {
+		tx.Set("karma.carol", "1")
+		tx.Set("karma.alice", "2")
+		tx.Delete("karma.carol")
+		return nil
+	})
+	s.Delete(ctx, "karma.nobody")
+	s.Delete(ctx, "karma.bob")
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Key: "karma.bob", Value: "1"}, next(events))
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Key: "karma.bob", Value: "3"}, next(events),
+		"Incr should send the new value.")
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Key: "karma.carol", Value: "1"}, next(events),
+		"Update should send events in the order its writes were made.")
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Key: "karma.alice", Value: "2"}, next(events))
+	assert.Equal(t, store.StoreEvent{Type: store.EventDelete, Key: "karma.carol"}, next(events))
+	assert.Equal(t, store.StoreEvent{Type: store.EventDelete, Key: "karma.bob"}, next(events),
+		"Only writes that happened should send events.")
+
+	ns.SetWithTTL(ctx, "a", "1", 10*time.Millisecond)
+	ns.SetWithTTL(ctx, "d", "4", 10*time.Millisecond)
+	ns.Namespace("nested").Set(ctx, "b", "2")
+	time.Sleep(20 * time.Millisecond)
+	ns.Delete(ctx, "d")
+	s.(store.Sweeper).Sweep(ctx)
+	ns.Set(ctx, "c", "3")
+	s.DeleteNamespace(ctx, "ns")
+	path := []string{"ns"}
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Namespace: path, Key: "a", Value: "1"}, next(nsEvents))
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Namespace: path, Key: "d", Value: "4"}, next(nsEvents))
+	assert.Equal(t, store.StoreEvent{Type: store.EventExpire, Namespace: path, Key: "d"}, next(nsEvents),
+		"Deleting an expired key before Sweep should send an expire event.")
+	assert.Equal(t, store.StoreEvent{Type: store.EventExpire, Namespace: path, Key: "a"}, next(nsEvents),
+		"Sweep should send expire events.")
+	assert.Equal(t, store.StoreEvent{Type: store.EventSet, Namespace: path, Key: "c", Value: "3"}, next(nsEvents))
+	assert.Equal(t, store.StoreEvent{Type: store.EventDelete, Namespace: path, Key: "c"}, next(nsEvents),
+		"DeleteNamespace should send delete events.")
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok, "Channels should be closed with their context.")
+}
+
+func TestHubWatchQueueLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := store.NewHub()
+	events := hub.Watch(ctx, nil, "")
+	for i := 0; i <= store.WatchQueueLimit+1; i++ {
+		hub.Publish(store.StoreEvent{Type: store.EventSet, Key: "key"})
+	}
+	closed := make(chan struct{})
+	go func() {
+		for range events {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Watchers that fall too far behind should be closed.")
+	}
+}
@@ -1,117 +1,439 @@
 package boltstore
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/FogCreek/victor/pkg/store"
 	"github.com/boltdb/bolt"
 )
 
-var _ = fmt.Println
-
 const (
 	defaultBucket = "victor"
+
+	// expiresBucket holds the expiry time of every key set with a TTL. See
+	// expiryKey for the format of its keys.
+	expiresBucket = "victor.expires"
+
+	// defaultMode is the file mode used to create the database file if no
+	// mode is configured.
+	defaultMode os.FileMode = 0600
+
+	// defaultTimeout is how long to wait for another process to release its
+	// lock on the database file if no timeout is configured.
+	defaultTimeout = time.Second
+
+	// scanBatchSize is the number of keys read per transaction by Scan.
+	scanBatchSize = 100
+
+	// pathEnvVar is the environment variable that the database's path is read
+	// from if the robot has no store config.
+	pathEnvVar = "VICTOR_STORAGE_PATH"
 )
 
 func init() {
-	// type InitFunc func() Adapter
-	store.Register("bolt", func(r store.Robot) store.Adapter {
-		return newBoltStore()
+	store.Register("bolt", func(r store.Robot) (store.ContextAdapter, error) {
+		var config Config
+		storeConfig, configSet := r.StoreConfig()
+		if configSet {
+			var ok bool
+			config, ok = storeConfig.(Config)
+			if !ok {
+				return nil, &store.ConfigError{
+					Adapter: "bolt",
+					Reason:  fmt.Sprintf("the bot's store config must implement the Config interface, got %T", storeConfig),
+				}
+			}
+		} else {
+			config = NewConfig(os.Getenv(pathEnvVar), 0, 0)
+		}
+		if config.Path() == "" {
+			return nil, &store.ConfigError{
+				Adapter: "bolt",
+				Reason:  "a database path must be set in the store config or " + pathEnvVar,
+			}
+		}
+		return newBoltStore(config)
 	})
 }
 
-func newBoltStore() *BoltStore {
-	return &BoltStore{
-		defaultBucket: []byte(defaultBucket),
-	}
+// Config provides the bolt adapter with the location of its database and
+// the options used to open it.
+type Config interface {
+	// Path returns the path of the database file. The file is created if it
+	// does not exist.
+	Path() string
+	// Mode returns the file mode used when creating the database file.
+	Mode() os.FileMode
+	// Timeout returns how long to wait to obtain the database file's lock.
+	Timeout() time.Duration
 }
 
-type BoltStore struct {
-	defaultBucket []byte
-	DB            *bolt.DB
+// configImpl implements the Config interface.
+type configImpl struct {
+	path    string
+	mode    os.FileMode
+	timeout time.Duration
 }
 
-func (s *BoltStore) withDB(callback func(db *bolt.DB) error) error {
-	dbPath := os.Getenv("VICTOR_STORAGE_PATH")
+// NewConfig returns a new bolt configuration instance. A zero mode creates
+// the file with 0600 permissions and a zero timeout waits up to one second
+// for the file's lock.
+func NewConfig(path string, mode os.FileMode, timeout time.Duration) configImpl {
+	return configImpl{path: path, mode: mode, timeout: timeout}
+}
 
-	db, err := bolt.Open(dbPath, 0600, nil)
+func (c configImpl) Path() string {
+	return c.path
+}
+
+func (c configImpl) Mode() os.FileMode {
+	return c.mode
+}
+
+func (c configImpl) Timeout() time.Duration {
+	return c.timeout
+}
+
+// newBoltStore opens the database described by the given config and creates
+// the default bucket. The database stays open until Close is called.
+func newBoltStore(config Config) (*BoltStore, error) {
+	mode := config.Mode()
+	if mode == 0 {
+		mode = defaultMode
+	}
+	timeout := config.Timeout()
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	db, err := bolt.Open(config.Path(), mode, &bolt.Options{Timeout: timeout})
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("boltstore: error opening %q: %s", config.Path(), err)
 	}
-	defer db.Close()
 
-	db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists([]byte(s.defaultBucket))
-		return nil
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(defaultBucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte(expiresBucket))
+		return err
 	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("boltstore: error creating bucket: %s", err)
+	}
 
-	return callback(db)
+	return &BoltStore{
+		defaultBucket: []byte(defaultBucket),
+		DB:            db,
+		hub:           store.NewHub(),
+		writes:        &sync.Mutex{},
+	}, nil
 }
 
+// BoltStore keeps data in the default bucket of a bolt database. Each
+// namespace is a bucket nested inside its parent's bucket so a namespace's
+// name may not also be used as a key in its parent.
+//
+// Every write to the database goes through the store so it implements
+// store.Watcher.
+type BoltStore struct {
+	defaultBucket []byte
+	namespace     [][]byte
+	DB            *bolt.DB
+	hub           *store.Hub
+	writes        *sync.Mutex
+}
+
+// Close closes the database. The robot calls this when it is stopped. Every
+// namespace shares the database so this closes them as well.
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+// update calls the callback with the store's bucket in a read-write
+// transaction, creating the bucket for the store's namespace if needed.
 func (s *BoltStore) update(callback func(b *bolt.Bucket) error) error {
-	return s.withDB(func(db *bolt.DB) error {
-		return db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket(s.defaultBucket)
-			return callback(b)
-		})
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.defaultBucket)
+		for _, name := range s.namespace {
+			var err error
+			b, err = b.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return callback(b)
 	})
 }
 
+// view calls the callback with the store's bucket in a read-only
+// transaction. The callback is not called if the store's namespace has not
+// been created yet.
 func (s *BoltStore) view(callback func(b *bolt.Bucket) error) error {
-	return s.withDB(func(db *bolt.DB) error {
-		return db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(s.defaultBucket)
-			return callback(b)
-		})
+	return s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.defaultBucket)
+		for _, name := range s.namespace {
+			b = b.Bucket(name)
+			if b == nil {
+				return nil
+			}
+		}
+		return callback(b)
 	})
 }
 
-func (s *BoltStore) Get(key string) (string, bool) {
+func (s *BoltStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
 	var val string
+	var exists bool
 
 	err := s.view(func(b *bolt.Bucket) error {
-		bval := b.Get([]byte(key))
+		bkey := []byte(key)
+		bval := b.Get(bkey)
 
-		if bval != nil {
+		if bval != nil && !s.expired(b.Tx(), bkey, time.Now()) {
 			val = string(bval)
+			exists = true
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		log.Println("[boltdb Get] error getting", key, "-", err)
+		return "", false, fmt.Errorf("boltstore: error getting %q: %s", key, err)
 	}
 
-	return val, (val == "")
+	return val, exists, nil
 }
 
-func (s *BoltStore) Set(key string, val string) {
+func (s *BoltStore) Set(ctx context.Context, key string, val string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	bkey := []byte(key)
 
 	err := s.update(func(b *bolt.Bucket) error {
+		if err := s.clearExpiry(b.Tx(), bkey); err != nil {
+			return err
+		}
+		s.emit(b.Tx(), store.EventSet, key, val)
 		return b.Put(bkey, []byte(val))
 	})
 
 	if err != nil {
-		log.Println("[boltdb Set] error setting", key, "-", err)
+		return fmt.Errorf("boltstore: error setting %q: %s", key, err)
 	}
+
+	return nil
 }
 
-func (s *BoltStore) Delete(key string) {
-	err := s.update(func(b *bolt.Bucket) error {
-		err := b.Delete([]byte(key))
+func (s *BoltStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
 		return err
+	}
+
+	err := s.update(func(b *bolt.Bucket) error {
+		bkey := []byte(key)
+		if b.Get(bkey) != nil {
+			s.emit(b.Tx(), s.removeEvent(b.Tx(), bkey), key, "")
+		}
+		if err := s.clearExpiry(b.Tx(), bkey); err != nil {
+			return err
+		}
+		return b.Delete(bkey)
 	})
 
 	if err != nil {
-		log.Println("[boltdb Delete] error deleting", key, "-", err)
+		return fmt.Errorf("boltstore: error deleting %q: %s", key, err)
 	}
+
+	return nil
 }
 
-func (s *BoltStore) All() map[string]string {
-	// nope
-	return make(map[string]string)
+func (s *BoltStore) All(ctx context.Context) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]string)
+
+	err := s.view(func(b *bolt.Bucket) error {
+		now := time.Now()
+		return b.ForEach(func(k, v []byte) error {
+			// nested buckets (namespaces) have nil values
+			if v != nil && !s.expired(b.Tx(), k, now) {
+				all[string(k)] = string(v)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("boltstore: error listing keys: %s", err)
+	}
+
+	return all, nil
+}
+
+func (s *BoltStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.Scan(ctx, prefix, func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Scan reads the matching keys in batches of scanBatchSize, each in its own
+// read-only transaction, so fn is free to write to the store and large
+// buckets are never loaded all at once.
+func (s *BoltStore) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	bprefix := []byte(prefix)
+	start := bprefix
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var keys, values []string
+		more := false
+
+		err := s.view(func(b *bolt.Bucket) error {
+			now := time.Now()
+			c := b.Cursor()
+			for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, bprefix); k, v = c.Next() {
+				if len(keys) == scanBatchSize {
+					more = true
+					// the next batch starts with this key
+					start = append([]byte(nil), k...)
+					break
+				}
+				if v != nil && !s.expired(b.Tx(), k, now) {
+					keys = append(keys, string(k))
+					values = append(values, string(v))
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("boltstore: error scanning keys with prefix %q: %s", prefix, err)
+		}
+
+		for i, key := range keys {
+			if !fn(key, values[i]) {
+				return nil
+			}
+		}
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+// Namespace returns an adapter for the bucket with the given name nested in
+// this store's bucket. The bucket is not created until something is written
+// to it.
+func (s *BoltStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	namespace := make([][]byte, len(s.namespace), len(s.namespace)+1)
+	copy(namespace, s.namespace)
+	return &BoltStore{
+		defaultBucket: s.defaultBucket,
+		namespace:     append(namespace, []byte(name)),
+		DB:            s.DB,
+		hub:           s.hub,
+		writes:        s.writes,
+	}
+}
+
+func (s *BoltStore) Namespaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	now := time.Now()
+	err := s.view(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			// nested buckets have nil values
+			if v == nil && s.Namespace(string(k)).(*BoltStore).hasKeys(b.Bucket(k), now) {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("boltstore: error listing namespaces: %s", err)
+	}
+
+	return names, nil
+}
+
+// hasKeys returns true if the given bucket, which holds this store's keys,
+// or one of the buckets nested in it holds a key that has not expired.
+// Buckets are left behind when all of their keys are deleted or swept so
+// they are not listed by Namespaces unless this is true.
+func (s *BoltStore) hasKeys(b *bolt.Bucket, now time.Time) bool {
+	errFound := errors.New("found")
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil && !s.expired(b.Tx(), k, now) {
+			return errFound
+		}
+		if v == nil && s.Namespace(string(k)).(*BoltStore).hasKeys(b.Bucket(k), now) {
+			return errFound
+		}
+		return nil
+	})
+	return err == errFound
+}
+
+func (s *BoltStore) DeleteNamespace(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if name == "" {
+		return store.ErrInvalidNamespace
+	}
+
+	err := s.update(func(b *bolt.Bucket) error {
+		ns := s.Namespace(name).(*BoltStore)
+		if child := b.Bucket([]byte(name)); child != nil {
+			s.emitIn(b.Tx(), deleteEvents(child, ns.path())...)
+		}
+		err := b.DeleteBucket([]byte(name))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return ns.clearAllExpiries(b.Tx())
+	})
+
+	if err != nil {
+		return fmt.Errorf("boltstore: error deleting namespace %q: %s", name, err)
+	}
+
+	return nil
 }
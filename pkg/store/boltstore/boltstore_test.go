@@ -1,8 +1,14 @@
 package boltstore
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+	"github.com/boltdb/bolt"
 )
 
 const (
@@ -16,48 +22,166 @@ func init() {
 }
 
 func setup() {
-	os.Create(DB_PATH)
-	if db == nil {
-		db = newBoltStore()
+	var err error
+	db, err = newBoltStore(NewConfig(DB_PATH, 0, 0))
+	if err != nil {
+		panic(err)
 	}
 }
 
 func teardown() {
+	db.Close()
+	os.Remove(DB_PATH)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+		setup()
+		return db, teardown
+	})
+}
+
+func TestStoreConfig(t *testing.T) {
+	initFunc := storetest.Load(t, "bolt")
+
+	s, err := initFunc(storetest.Robot{Config: NewConfig(DB_PATH, 0640, 0)})
+	if err != nil {
+		t.Fatal("Unexpected error opening configured store: ", err)
+	}
+	info, err := os.Stat(DB_PATH)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Error("Expected database to be created with the configured mode, got: ", info.Mode(), err)
+	}
+	s.(*BoltStore).Close()
+	os.Remove(DB_PATH)
+
+	// falls back to the environment variable without a config
+	s, err = initFunc(storetest.Robot{})
+	if err != nil {
+		t.Fatal("Unexpected error opening store from environment: ", err)
+	}
+	s.(*BoltStore).Close()
 	os.Remove(DB_PATH)
+
+	storetest.CheckConfigType(t, initFunc)
 }
 
-func TestEmptyGet(t *testing.T) {
+func TestOpenTimeout(t *testing.T) {
 	setup()
 
-	val, _ := db.Get("nothing")
-	if val != "" {
-		t.Error("Expected to get nothing before store has data, got: ", val)
+	_, err := newBoltStore(NewConfig(DB_PATH, 0, 10*time.Millisecond))
+	if err == nil {
+		t.Error("Expected opening a locked database to time out")
 	}
 
 	teardown()
 }
 
-func TestSet(t *testing.T) {
+func TestClose(t *testing.T) {
 	setup()
 
-	db.Set("a", "b")
-	val, _ := db.Get("a")
+	teardown()
+	if err := db.Set(context.Background(), "a", "b"); err == nil {
+		t.Error("Expected writing to a closed store to fail")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	setup()
 
-	if val != "b" {
-		t.Error("Stored 'a': 'b', expected to get it back", val)
+	ctx := context.Background()
+	db.SetWithTTL(ctx, "a", "b", time.Millisecond)
+	db.Namespace("ns").SetWithTTL(ctx, "c", "d", time.Millisecond)
+	// keys and names containing NUL must not be mistaken for one another
+	db.SetWithTTL(ctx, "x\x00y", "z", time.Millisecond)
+	db.Namespace("x").Set(ctx, "y", "kept")
+	time.Sleep(5 * time.Millisecond)
+	if err := db.Sweep(ctx); err != nil {
+		t.Error("Unexpected error sweeping: ", err)
 	}
+	if val, _, _ := db.Namespace("x").Get(ctx, "y"); val != "kept" {
+		t.Error("Expected Sweep not to remove a key without a TTL, got: ", val)
+	}
+	db.view(func(b *bolt.Bucket) error {
+		if b.Get([]byte("a")) != nil || b.Bucket([]byte("ns")).Get([]byte("c")) != nil || b.Get([]byte("x\x00y")) != nil {
+			t.Error("Expected Sweep to remove expired keys")
+		}
+		if b.Tx().Bucket([]byte(expiresBucket)).Stats().KeyN != 0 {
+			t.Error("Expected Sweep to remove expiry times")
+		}
+		return nil
+	})
 
 	teardown()
 }
 
-func TestDelete(t *testing.T) {
+func TestWatch(t *testing.T) {
 	setup()
 
-	db.Set("a", "b")
-	db.Delete("a")
-	val, _ := db.Get("a")
-	if val != "" {
-		t.Error("Expected to get nothing after deleting key, got: ", val)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := db.Watch(ctx, "karma.")
+	nsEvents := db.Namespace("ns").(store.Watcher).Watch(ctx, "")
+	next := func(events <-chan store.StoreEvent) store.StoreEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for an event")
+		}
+		return store.StoreEvent{}
+	}
+
+	db.Set(ctx, "other", "x")
+	db.Set(ctx, "karma.bob", "1")
+	db.Incr(ctx, "karma.bob", 2)
+	db.CompareAndSwap(ctx, "karma.bob", "1", "5")
+	db.Update(ctx, func(tx store.Tx) error {
+		tx.Set("karma.alice", "2")
+		return os.ErrInvalid
+	})
+	db.Delete(ctx, "karma.nobody")
+	db.Delete(ctx, "karma.bob")
+	if e := next(events); e.Type != store.EventSet || e.Key != "karma.bob" || e.Value != "1" {
+		t.Error("Expected a set event, got: ", e)
+	}
+	if e := next(events); e.Type != store.EventSet || e.Value != "3" {
+		t.Error("Expected Incr to send the new value, got: ", e)
+	}
+	if e := next(events); e.Type != store.EventDelete || e.Key != "karma.bob" {
+		t.Error("Expected only writes that happened to send events, got: ", e)
+	}
+
+	ns := db.Namespace("ns")
+	ns.SetWithTTL(ctx, "a", "1", 10*time.Millisecond)
+	ns.SetWithTTL(ctx, "d", "4", 10*time.Millisecond)
+	ns.Namespace("nested").Set(ctx, "b", "2")
+	time.Sleep(20 * time.Millisecond)
+	ns.Delete(ctx, "d")
+	db.Sweep(ctx)
+	ns.Set(ctx, "c", "3")
+	db.DeleteNamespace(ctx, "ns")
+	if e := next(nsEvents); e.Type != store.EventSet || e.Key != "a" || len(e.Namespace) != 1 || e.Namespace[0] != "ns" {
+		t.Error("Expected a set event in the namespace, got: ", e)
+	}
+	if e := next(nsEvents); e.Type != store.EventSet || e.Key != "d" {
+		t.Error("Expected a set event in the namespace, got: ", e)
+	}
+	if e := next(nsEvents); e.Type != store.EventExpire || e.Key != "d" {
+		t.Error("Expected deleting an expired key to send an expire event, got: ", e)
+	}
+	if e := next(nsEvents); e.Type != store.EventExpire || e.Key != "a" {
+		t.Error("Expected Sweep to send an expire event, got: ", e)
+	}
+	if e := next(nsEvents); e.Type != store.EventSet || e.Key != "c" {
+		t.Error("Expected events in the order they happened, got: ", e)
+	}
+	if e := next(nsEvents); e.Type != store.EventDelete || e.Key != "c" {
+		t.Error("Expected DeleteNamespace to send delete events, got: ", e)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Expected the channel to be closed with its context")
 	}
 
 	teardown()
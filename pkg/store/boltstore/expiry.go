@@ -0,0 +1,218 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/boltdb/bolt"
+)
+
+// SetWithTTL sets a key and records its expiry time in the expires bucket.
+// The key is treated as missing once it has expired and is removed by the
+// next Sweep after that.
+func (s *BoltStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return store.ErrInvalidTTL
+	}
+
+	bkey := []byte(key)
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(ttl).UnixNano()))
+
+	err := s.update(func(b *bolt.Bucket) error {
+		err := b.Tx().Bucket([]byte(expiresBucket)).Put(s.expiryKey(bkey), expires)
+		if err != nil {
+			return err
+		}
+		s.emit(b.Tx(), store.EventSet, key, val)
+		return b.Put(bkey, []byte(val))
+	})
+
+	if err != nil {
+		return fmt.Errorf("boltstore: error setting %q: %s", key, err)
+	}
+
+	return nil
+}
+
+// Expires returns the expiry time recorded for a key or the zero time if the
+// key does not exist or has no TTL.
+func (s *BoltStore) Expires(ctx context.Context, key string) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	var expires time.Time
+	err := s.view(func(b *bolt.Bucket) error {
+		bkey := []byte(key)
+		if b.Get(bkey) == nil || s.expired(b.Tx(), bkey, time.Now()) {
+			return nil
+		}
+		encoded := b.Tx().Bucket([]byte(expiresBucket)).Get(s.expiryKey(bkey))
+		if len(encoded) == 8 {
+			expires = time.Unix(0, int64(binary.BigEndian.Uint64(encoded)))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("boltstore: error getting expiry of %q: %s", key, err)
+	}
+
+	return expires, nil
+}
+
+// Sweep removes every expired key in this store's namespace and the
+// namespaces nested in it.
+func (s *BoltStore) Sweep(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		expires := tx.Bucket([]byte(expiresBucket))
+		prefix := s.expiryPrefix()
+		now := time.Now()
+
+		// keys can't be deleted while the cursor is in use
+		var expired [][]byte
+		c := expires.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if isExpired(v, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+		}
+
+		for _, k := range expired {
+			path, key, ok := parseExpiryKey(k)
+			b := tx.Bucket([]byte(defaultBucket))
+			for _, name := range path {
+				if b = b.Bucket([]byte(name)); b == nil {
+					break
+				}
+			}
+			if ok && b != nil && b.Get(key) != nil {
+				s.emitIn(tx, store.StoreEvent{Type: store.EventExpire, Namespace: path, Key: string(key)})
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+			if err := expires.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("boltstore: error removing expired keys: %s", err)
+	}
+
+	return nil
+}
+
+// Markers which start each part of a key in the expires bucket.
+const (
+	expiryNamespaceMarker = 'n'
+	expiryKeyMarker       = 'k'
+)
+
+// expiryKey returns the key in the expires bucket for the given key in this
+// store's namespace. It is made up of each namespace name on the path to the
+// store followed by the key itself. Each namespace name is written as a marker
+// byte, its length, and the name so names and keys may contain any byte
+// without being mistaken for one another.
+func (s *BoltStore) expiryKey(key []byte) []byte {
+	return append(append(s.expiryPrefix(), expiryKeyMarker), key...)
+}
+
+// expiryPrefix returns the prefix shared by the expires bucket's keys for
+// this store's namespace.
+func (s *BoltStore) expiryPrefix() []byte {
+	var prefix []byte
+	for _, name := range s.namespace {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(name)))
+		prefix = append(prefix, expiryNamespaceMarker)
+		prefix = append(prefix, length...)
+		prefix = append(prefix, name...)
+	}
+	return prefix
+}
+
+// parseExpiryKey returns the namespace path and key that a key in the
+// expires bucket was built from (see expiryKey). The last return value is
+// false if the key is not in that format.
+func parseExpiryKey(k []byte) ([]string, []byte, bool) {
+	path := []string{}
+	for len(k) > 0 && k[0] == expiryNamespaceMarker {
+		if len(k) < 5 {
+			return nil, nil, false
+		}
+		length := int(binary.BigEndian.Uint32(k[1:5]))
+		if len(k) < 5+length {
+			return nil, nil, false
+		}
+		path = append(path, string(k[5:5+length]))
+		k = k[5+length:]
+	}
+	if len(k) == 0 || k[0] != expiryKeyMarker {
+		return nil, nil, false
+	}
+	return path, k[1:], true
+}
+
+// expired returns true if the given key was set with a TTL that has elapsed.
+func (s *BoltStore) expired(tx *bolt.Tx, key []byte, now time.Time) bool {
+	return isExpired(tx.Bucket([]byte(expiresBucket)).Get(s.expiryKey(key)), now)
+}
+
+// removeEvent returns the type of event sent when the given key is removed.
+// Keys whose TTL has elapsed send an expire event as they would from Sweep.
+func (s *BoltStore) removeEvent(tx *bolt.Tx, key []byte) store.EventType {
+	if s.expired(tx, key, time.Now()) {
+		return store.EventExpire
+	}
+	return store.EventDelete
+}
+
+// clearExpiry removes any expiry time recorded for the given key.
+func (s *BoltStore) clearExpiry(tx *bolt.Tx, key []byte) error {
+	return tx.Bucket([]byte(expiresBucket)).Delete(s.expiryKey(key))
+}
+
+// clearAllExpiries removes the expiry times of every key in this store's
+// namespace and the namespaces nested in it.
+func (s *BoltStore) clearAllExpiries(tx *bolt.Tx) error {
+	expires := tx.Bucket([]byte(expiresBucket))
+	prefix := s.expiryPrefix()
+	var keys [][]byte
+	c := expires.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := expires.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExpired returns true if the given encoded expiry time is not nil and is
+// not after now.
+func isExpired(expires []byte, now time.Time) bool {
+	if len(expires) != 8 {
+		return false
+	}
+	return !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(expires))))
+}
@@ -0,0 +1,122 @@
+package boltstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/boltdb/bolt"
+)
+
+func (s *BoltStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var current int64
+	bkey := []byte(key)
+
+	err := s.update(func(b *bolt.Bucket) error {
+		val := b.Get(bkey)
+		if val == nil || s.expired(b.Tx(), bkey, time.Now()) {
+			// an expired key starts over without its TTL
+			if err := s.clearExpiry(b.Tx(), bkey); err != nil {
+				return err
+			}
+			val = []byte("0")
+		}
+		var err error
+		current, err = strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return store.ErrNotInteger
+		}
+		current += delta
+		s.emit(b.Tx(), store.EventSet, key, strconv.FormatInt(current, 10))
+		return b.Put(bkey, []byte(strconv.FormatInt(current, 10)))
+	})
+
+	if err == store.ErrNotInteger {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("boltstore: error incrementing %q: %s", key, err)
+	}
+
+	return current, nil
+}
+
+func (s *BoltStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	swapped := false
+	bkey := []byte(key)
+
+	err := s.update(func(b *bolt.Bucket) error {
+		val := b.Get(bkey)
+		if val == nil || string(val) != old || s.expired(b.Tx(), bkey, time.Now()) {
+			return nil
+		}
+		if err := s.clearExpiry(b.Tx(), bkey); err != nil {
+			return err
+		}
+		swapped = true
+		s.emit(b.Tx(), store.EventSet, key, new)
+		return b.Put(bkey, []byte(new))
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("boltstore: error swapping %q: %s", key, err)
+	}
+
+	return swapped, nil
+}
+
+// Update runs fn in a bolt read-write transaction which is rolled back if fn
+// returns an error.
+func (s *BoltStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.update(func(b *bolt.Bucket) error {
+		return fn(&boltTx{store: s, bucket: b, now: time.Now()})
+	})
+}
+
+// boltTx implements store.Tx on top of a bolt transaction.
+type boltTx struct {
+	store  *BoltStore
+	bucket *bolt.Bucket
+	now    time.Time
+}
+
+func (tx *boltTx) Get(key string) (string, bool, error) {
+	bkey := []byte(key)
+	val := tx.bucket.Get(bkey)
+	if val == nil || tx.store.expired(tx.bucket.Tx(), bkey, tx.now) {
+		return "", false, nil
+	}
+	return string(val), true, nil
+}
+
+func (tx *boltTx) Set(key, val string) error {
+	bkey := []byte(key)
+	if err := tx.store.clearExpiry(tx.bucket.Tx(), bkey); err != nil {
+		return err
+	}
+	tx.store.emit(tx.bucket.Tx(), store.EventSet, key, val)
+	return tx.bucket.Put(bkey, []byte(val))
+}
+
+func (tx *boltTx) Delete(key string) error {
+	bkey := []byte(key)
+	if tx.bucket.Get(bkey) != nil {
+		tx.store.emit(tx.bucket.Tx(), tx.store.removeEvent(tx.bucket.Tx(), bkey), key, "")
+	}
+	if err := tx.store.clearExpiry(tx.bucket.Tx(), bkey); err != nil {
+		return err
+	}
+	return tx.bucket.Delete(bkey)
+}
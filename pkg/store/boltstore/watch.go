@@ -0,0 +1,57 @@
+package boltstore
+
+import (
+	"context"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/boltdb/bolt"
+)
+
+// Watch returns a channel of changes to keys with the given prefix in this
+// store's namespace. See store.Watcher.
+func (s *BoltStore) Watch(ctx context.Context, prefix string) <-chan store.StoreEvent {
+	return s.hub.Watch(ctx, s.path(), prefix)
+}
+
+// emit publishes an event for a key in this store's namespace once the given
+// transaction commits. Nothing is published if it is rolled back.
+func (s *BoltStore) emit(tx *bolt.Tx, t store.EventType, key, val string) {
+	s.emitIn(tx, store.StoreEvent{Type: t, Namespace: s.path(), Key: key, Value: val})
+}
+
+// emitIn publishes the given events once the transaction commits. Commit
+// handlers run before DB.Update returns and writers hold s.writes until then
+// so events are published in the order that their transactions committed.
+func (s *BoltStore) emitIn(tx *bolt.Tx, events ...store.StoreEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tx.OnCommit(func() {
+		s.hub.Publish(events...)
+	})
+}
+
+// path returns the names of the namespaces on the path to this store.
+func (s *BoltStore) path() []string {
+	path := make([]string, len(s.namespace))
+	for i, name := range s.namespace {
+		path[i] = string(name)
+	}
+	return path
+}
+
+// deleteEvents returns a delete event for every key in the given bucket, whose
+// namespace path is given, and in the buckets nested inside it.
+func deleteEvents(b *bolt.Bucket, path []string) []store.StoreEvent {
+	var events []store.StoreEvent
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			events = append(events, store.StoreEvent{Type: store.EventDelete, Namespace: path, Key: string(k)})
+		} else if child := b.Bucket(k); child != nil {
+			childPath := append(append([]string{}, path...), string(k))
+			events = append(events, deleteEvents(child, childPath)...)
+		}
+		return nil
+	})
+	return events
+}
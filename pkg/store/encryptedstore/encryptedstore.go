@@ -0,0 +1,554 @@
+package encryptedstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+// AdapterName is the encrypted store's registered adapter name for the
+// victor framework.
+const AdapterName = "encrypted"
+
+var (
+	// ErrDecrypt is returned when a stored value or key was not encrypted
+	// with any of the configured keys or has been tampered with.
+	ErrDecrypt = errors.New("encryptedstore: cannot decrypt with the configured keys")
+
+	// ErrInvalidKey is returned when a key is not 16, 24, or 32 bytes long.
+	ErrInvalidKey = errors.New("encryptedstore: keys must be 16, 24, or 32 bytes long")
+)
+
+func init() {
+	store.Register(AdapterName, func(r store.Robot) (store.ContextAdapter, error) {
+		storeConfig, configSet := r.StoreConfig()
+		if !configSet {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "the bot's store config must provide the wrapped adapter and encryption key",
+			}
+		}
+		config, ok := storeConfig.(Config)
+		if !ok {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  fmt.Sprintf("the bot's store config must implement the Config interface, got %T", storeConfig),
+			}
+		}
+		if config.Adapter() == "" || config.Adapter() == AdapterName {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "the store config must name another adapter to wrap",
+			}
+		}
+		initFunc, err := store.Load(config.Adapter())
+		if err != nil {
+			return nil, err
+		}
+		keys, err := newKeyring(config.Key(), config.OldKeys())
+		if err != nil {
+			return nil, &store.ConfigError{Adapter: AdapterName, Reason: err.Error()}
+		}
+		inner, err := initFunc(wrappedRobot{Robot: r, config: config.AdapterConfig()})
+		if err != nil {
+			return nil, err
+		}
+		s := &EncryptedStore{inner: inner, keys: keys, encryptKeys: config.EncryptKeys()}
+		// the wrapped adapter may already hold entries which were written
+		// before it was encrypted and could not be read until they are
+		if err := s.Rotate(context.Background()); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// Config provides the encrypted adapter with the adapter it wraps and the
+// keys used to encrypt it.
+type Config interface {
+	// Adapter returns the registered name of the wrapped adapter.
+	Adapter() string
+	// AdapterConfig returns the store config given to the wrapped adapter.
+	AdapterConfig() interface{}
+	// Key returns the AES key used to encrypt new entries. It must be 16,
+	// 24, or 32 bytes long.
+	Key() []byte
+	// OldKeys returns keys that were previously used. Entries encrypted with
+	// them (or not encrypted at all) are re-encrypted with Key when the store
+	// is created.
+	OldKeys() [][]byte
+	// EncryptKeys returns true if keys and namespace names should be
+	// encrypted as well as values.
+	EncryptKeys() bool
+}
+
+// configImpl implements the Config interface.
+type configImpl struct {
+	adapter       string
+	adapterConfig interface{}
+	key           []byte
+	oldKeys       [][]byte
+	encryptKeys   bool
+}
+
+// NewConfig returns a new encrypted store configuration instance which wraps
+// the named adapter. Any old keys are only used to read and re-encrypt
+// existing entries.
+func NewConfig(adapter string, adapterConfig interface{}, key []byte, encryptKeys bool, oldKeys ...[]byte) configImpl {
+	return configImpl{
+		adapter:       adapter,
+		adapterConfig: adapterConfig,
+		key:           key,
+		oldKeys:       oldKeys,
+		encryptKeys:   encryptKeys,
+	}
+}
+
+func (c configImpl) Adapter() string {
+	return c.adapter
+}
+
+func (c configImpl) AdapterConfig() interface{} {
+	return c.adapterConfig
+}
+
+func (c configImpl) Key() []byte {
+	return c.key
+}
+
+func (c configImpl) OldKeys() [][]byte {
+	return c.oldKeys
+}
+
+func (c configImpl) EncryptKeys() bool {
+	return c.encryptKeys
+}
+
+// wrappedRobot gives the wrapped adapter its own store config.
+type wrappedRobot struct {
+	store.Robot
+	config interface{}
+}
+
+func (r wrappedRobot) StoreConfig() (interface{}, bool) {
+	return r.config, r.config != nil
+}
+
+// New returns a store which encrypts the values (and keys if encryptKeys is
+// true) written to the given adapter. Legacy adapters can be wrapped with
+// store.WithContext first. Values encrypted with an old key can still be
+// read but are not re-encrypted until Rotate is called, and when keys are
+// encrypted entries cannot be found until Rotate has moved them. Entries that
+// were written before the adapter was wrapped cannot be read until Rotate has
+// encrypted them.
+func New(inner store.ContextAdapter, key []byte, encryptKeys bool, oldKeys ...[]byte) (*EncryptedStore, error) {
+	keys, err := newKeyring(key, oldKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{inner: inner, keys: keys, encryptKeys: encryptKeys}, nil
+}
+
+// EncryptedStore seals values with AES-GCM before passing them to the
+// wrapped adapter. Each value is bound to its key and namespace so values
+// cannot be swapped between keys without detection. Keys set with a TTL have
+// their expiry time sealed with the value so it survives re-encryption.
+//
+// When keys are encrypted they are sealed deterministically so they can be
+// looked up, and namespace names are sealed the same way. The wrapped adapter
+// can then no longer match prefixes so Keys and Scan read every key in the
+// namespace.
+type EncryptedStore struct {
+	inner       store.ContextAdapter
+	keys        *keyring
+	encryptKeys bool
+	path        []string
+}
+
+// Close closes the wrapped adapter if it implements io.Closer.
+func (s *EncryptedStore) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Sweep sweeps the wrapped adapter if it implements store.Sweeper and then
+// deletes every entry in this store's namespace and the namespaces nested in
+// it whose sealed expiry time has passed. Incr keeps a key's expiry time in
+// the sealed value without giving the wrapped adapter a TTL, so those keys
+// are only removed here.
+func (s *EncryptedStore) Sweep(ctx context.Context) error {
+	if sweeper, ok := s.inner.(store.Sweeper); ok {
+		if err := sweeper.Sweep(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.sweep(ctx); err != nil {
+		return fmt.Errorf("encryptedstore: error sweeping: %s", err)
+	}
+	return nil
+}
+
+// sweep deletes the expired entries of this store's namespace and the
+// namespaces nested in it.
+func (s *EncryptedStore) sweep(ctx context.Context) error {
+	all, err := s.inner.All(ctx)
+	if err != nil {
+		return err
+	}
+	for name, sealed := range all {
+		key, err := s.openName(name)
+		if err != nil {
+			return err
+		}
+		if _, expires, _, err := s.open(key, sealed); err != nil || !expired(expires) {
+			continue
+		}
+		// the key may have been written again since it was read
+		err = s.inner.Update(ctx, func(tx store.Tx) error {
+			sealed, exists, err := tx.Get(name)
+			if err != nil || !exists {
+				return err
+			}
+			if _, expires, _, err := s.open(key, sealed); err != nil || !expired(expires) {
+				return nil
+			}
+			return tx.Delete(name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	names, err := s.Namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.Namespace(name).(*EncryptedStore).sweep(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sealed returns the wrapped adapter so store.Export writes the encrypted
+// entries. An export of it can only be read by importing it into an encrypted
+// store with the same keys.
+func (s *EncryptedStore) Sealed() store.ContextAdapter {
+	return s.inner
+}
+
+// Expires returns the expiry time sealed with a key's value or the zero time
+// if the key does not exist or has no TTL.
+func (s *EncryptedStore) Expires(ctx context.Context, key string) (time.Time, error) {
+	sealed, exists, err := s.inner.Get(ctx, s.name(key))
+	if err != nil || !exists {
+		return time.Time{}, err
+	}
+	_, expires, _, err := s.open(key, sealed)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("encryptedstore: error getting expiry of %q: %s", key, err)
+	}
+	if expired(expires) {
+		return time.Time{}, nil
+	}
+	return expires, nil
+}
+
+// aad returns the additional data that binds a sealed value to its key and
+// namespace.
+func (s *EncryptedStore) aad(key string) []byte {
+	return []byte(strings.Join(append(append([]string{}, s.path...), key), "\x00"))
+}
+
+// name returns the key under which the given key is stored.
+func (s *EncryptedStore) name(key string) string {
+	if !s.encryptKeys {
+		return key
+	}
+	return s.keys.sealName(s.aad(""), key)
+}
+
+// openName returns the key that is stored under the given name.
+func (s *EncryptedStore) openName(name string) (string, error) {
+	if !s.encryptKeys {
+		return name, nil
+	}
+	key, _, err := s.keys.open(s.aad(""), name)
+	return key, err
+}
+
+// seal encrypts a value along with its expiry time (zero for no TTL).
+func (s *EncryptedStore) seal(key, val string, expires time.Time) string {
+	var nanos int64
+	if !expires.IsZero() {
+		nanos = expires.UnixNano()
+	}
+	return s.keys.seal(s.aad(key), strconv.FormatInt(nanos, 10)+":"+val)
+}
+
+// open decrypts a value and its expiry time. The third return value is true
+// if the value was sealed with the current key.
+func (s *EncryptedStore) open(key, sealed string) (string, time.Time, bool, error) {
+	plain, current, err := s.keys.open(s.aad(key), sealed)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	parts := strings.SplitN(plain, ":", 2)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return "", time.Time{}, false, ErrDecrypt
+	}
+	var expires time.Time
+	if nanos != 0 {
+		expires = time.Unix(0, nanos)
+	}
+	return parts[1], expires, current, nil
+}
+
+// expired returns true if the given expiry time has passed.
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
+
+func (s *EncryptedStore) Get(ctx context.Context, key string) (string, bool, error) {
+	sealed, exists, err := s.inner.Get(ctx, s.name(key))
+	if err != nil || !exists {
+		return "", false, err
+	}
+	val, expires, _, err := s.open(key, sealed)
+	if err != nil {
+		return "", false, fmt.Errorf("encryptedstore: error getting %q: %s", key, err)
+	}
+	if expired(expires) {
+		return "", false, nil
+	}
+	return val, true, nil
+}
+
+func (s *EncryptedStore) Set(ctx context.Context, key string, val string) error {
+	return s.inner.Set(ctx, s.name(key), s.seal(key, val, time.Time{}))
+}
+
+func (s *EncryptedStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return store.ErrInvalidTTL
+	}
+	return s.inner.SetWithTTL(ctx, s.name(key), s.seal(key, val, time.Now().Add(ttl)), ttl)
+}
+
+func (s *EncryptedStore) Delete(ctx context.Context, key string) error {
+	return s.inner.Delete(ctx, s.name(key))
+}
+
+// Incr decrypts, increments, and re-encrypts the value in a transaction. The
+// key's expiry time is kept in the sealed value but the wrapped adapter
+// treats the key as having no TTL, so once it expires it is hidden until
+// Sweep deletes it.
+func (s *EncryptedStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	var current int64
+	err := s.inner.Update(ctx, func(tx store.Tx) error {
+		sealed, exists, err := tx.Get(s.name(key))
+		if err != nil {
+			return err
+		}
+		val, expires := "0", time.Time{}
+		if exists {
+			if val, expires, _, err = s.open(key, sealed); err != nil {
+				return err
+			}
+			if expired(expires) {
+				val, expires = "0", time.Time{}
+			}
+		}
+		current, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return store.ErrNotInteger
+		}
+		current += delta
+		return tx.Set(s.name(key), s.seal(key, strconv.FormatInt(current, 10), expires))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return current, nil
+}
+
+func (s *EncryptedStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	swapped := false
+	err := s.Update(ctx, func(tx store.Tx) error {
+		val, exists, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		swapped = exists && val == old
+		if !swapped {
+			return nil
+		}
+		return tx.Set(key, new)
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+func (s *EncryptedStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	return s.inner.Update(ctx, func(tx store.Tx) error {
+		return fn(&encryptedTx{store: s, tx: tx})
+	})
+}
+
+// encryptedTx implements store.Tx by encrypting the wrapped transaction's
+// keys and values.
+type encryptedTx struct {
+	store *EncryptedStore
+	tx    store.Tx
+}
+
+func (t *encryptedTx) Get(key string) (string, bool, error) {
+	sealed, exists, err := t.tx.Get(t.store.name(key))
+	if err != nil || !exists {
+		return "", false, err
+	}
+	val, expires, _, err := t.store.open(key, sealed)
+	if err != nil {
+		return "", false, err
+	}
+	if expired(expires) {
+		return "", false, nil
+	}
+	return val, true, nil
+}
+
+func (t *encryptedTx) Set(key, val string) error {
+	return t.tx.Set(t.store.name(key), t.store.seal(key, val, time.Time{}))
+}
+
+func (t *encryptedTx) Delete(key string) error {
+	return t.tx.Delete(t.store.name(key))
+}
+
+func (s *EncryptedStore) All(ctx context.Context) (map[string]string, error) {
+	all := make(map[string]string)
+	err := s.Scan(ctx, "", func(key, value string) bool {
+		all[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (s *EncryptedStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.Scan(ctx, prefix, func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Scan decrypts each matching value before calling fn. When keys are
+// encrypted every key in the namespace is read and decrypted first so the
+// matching keys can be passed to fn in order.
+func (s *EncryptedStore) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	if !s.encryptKeys {
+		var openErr error
+		err := s.inner.Scan(ctx, prefix, func(key, sealed string) bool {
+			val, expires, _, err := s.open(key, sealed)
+			if err != nil {
+				openErr = fmt.Errorf("encryptedstore: error scanning %q: %s", key, err)
+				return false
+			}
+			return expired(expires) || fn(key, val)
+		})
+		if err != nil {
+			return err
+		}
+		return openErr
+	}
+
+	all, err := s.inner.All(ctx)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	values := make(map[string]string)
+	for name, sealed := range all {
+		key, err := s.openName(name)
+		if err != nil {
+			return fmt.Errorf("encryptedstore: error scanning: %s", err)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		val, expires, _, err := s.open(key, sealed)
+		if err != nil {
+			return fmt.Errorf("encryptedstore: error scanning %q: %s", key, err)
+		}
+		if !expired(expires) {
+			keys = append(keys, key)
+			values[key] = val
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(key, values[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Namespace returns an encrypted adapter for the given namespace nested in
+// this store's namespace.
+func (s *EncryptedStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	return &EncryptedStore{
+		inner:       s.inner.Namespace(s.name(name)),
+		keys:        s.keys,
+		encryptKeys: s.encryptKeys,
+		path:        append(append([]string{}, s.path...), name),
+	}
+}
+
+func (s *EncryptedStore) Namespaces(ctx context.Context) ([]string, error) {
+	names, err := s.inner.Namespaces(ctx)
+	if err != nil || !s.encryptKeys {
+		return names, err
+	}
+	for i, name := range names {
+		if names[i], err = s.openName(name); err != nil {
+			return nil, fmt.Errorf("encryptedstore: error listing namespaces: %s", err)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *EncryptedStore) DeleteNamespace(ctx context.Context, name string) error {
+	if name == "" {
+		return store.ErrInvalidNamespace
+	}
+	return s.inner.DeleteNamespace(ctx, s.name(name))
+}
@@ -0,0 +1,288 @@
+package encryptedstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/memory"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+)
+
+var (
+	key1 = []byte("0123456789abcdef0123456789abcdef")
+	key2 = []byte("fedcba9876543210")
+)
+
+func newStore(t *testing.T, inner store.ContextAdapter, encryptKeys bool, key []byte, oldKeys ...[]byte) *EncryptedStore {
+	s, err := New(inner, key, encryptKeys, oldKeys...)
+	if err != nil {
+		t.Fatal("Unexpected error creating store: ", err)
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	for _, encryptKeys := range []bool{false, true} {
+		encryptKeys := encryptKeys
+		t.Run(fmt.Sprint("EncryptKeys=", encryptKeys), func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+				return newStore(t, memory.New(), encryptKeys, key1), func() {}
+			})
+		})
+	}
+}
+
+func TestEncryptsValues(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New()
+	s := newStore(t, inner, false, key1)
+
+	if err := s.Set(ctx, "token", "secret"); err != nil {
+		t.Error("Unexpected error setting 'token': ", err)
+	}
+	raw, _, _ := inner.Get(ctx, "token")
+	if !strings.HasPrefix(raw, sealedPrefix) || strings.Contains(raw, "secret") {
+		t.Error("Expected the wrapped store to hold an encrypted value, got: ", raw)
+	}
+	if val, exists, _ := s.Get(ctx, "token"); !exists || val != "secret" {
+		t.Error("Expected to get the decrypted value back, got: ", val)
+	}
+	s.Set(ctx, "token", "secret")
+	if again, _, _ := inner.Get(ctx, "token"); again == raw {
+		t.Error("Expected each value to be sealed with a new nonce")
+	}
+
+	// a sealed value moved to another key must not decrypt
+	inner.Set(ctx, "other", raw)
+	if _, _, err := s.Get(ctx, "other"); err == nil {
+		t.Error("Expected a value moved between keys to fail to decrypt")
+	}
+	inner.Set(ctx, "plain", "text")
+	if _, _, err := s.Get(ctx, "plain"); err == nil {
+		t.Error("Expected an unencrypted value to fail")
+	}
+	if _, _, err := newStore(t, inner, false, key2).Get(ctx, "token"); err == nil {
+		t.Error("Expected a different key to fail to decrypt")
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New()
+	s := newStore(t, inner, true, key1)
+
+	s.Set(ctx, "karma.bob", "2")
+	s.Set(ctx, "karma.alice", "5")
+	s.Set(ctx, "other", "x")
+	s.Namespace("roles").Set(ctx, "admin", "bob")
+
+	keys, _ := inner.Keys(ctx, "")
+	for _, key := range keys {
+		if !strings.HasPrefix(key, sealedPrefix) {
+			t.Error("Expected the wrapped store's keys to be encrypted, got: ", key)
+		}
+	}
+	names, _ := inner.Namespaces(ctx)
+	if len(names) != 1 || names[0] == "roles" {
+		t.Error("Expected the wrapped store's namespace names to be encrypted, got: ", names)
+	}
+
+	if val, _, _ := s.Get(ctx, "karma.bob"); val != "2" {
+		t.Error("Expected to look up encrypted keys, got: ", val)
+	}
+	keys, err := s.Keys(ctx, "karma.")
+	if err != nil || len(keys) != 2 || keys[0] != "karma.alice" || keys[1] != "karma.bob" {
+		t.Error("Expected Keys to match prefixes of encrypted keys in order, got: ", keys, err)
+	}
+	if names, _ := s.Namespaces(ctx); len(names) != 1 || names[0] != "roles" {
+		t.Error("Expected to list the decrypted namespace names, got: ", names)
+	}
+	if val, _, _ := s.Namespace("roles").Get(ctx, "admin"); val != "bob" {
+		t.Error("Expected to get keys in encrypted namespaces, got: ", val)
+	}
+	s.DeleteNamespace(ctx, "roles")
+	if names, _ := inner.Namespaces(ctx); len(names) != 0 {
+		t.Error("Expected to delete encrypted namespaces, got: ", names)
+	}
+	s.Delete(ctx, "other")
+	if all, _ := s.All(ctx); len(all) != 2 {
+		t.Error("Expected to delete encrypted keys, got: ", all)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t, memory.New(), false, key1)
+
+	if err := s.SetWithTTL(ctx, "a", "b", 0); err != store.ErrInvalidTTL {
+		t.Error("Expected an invalid TTL error, got: ", err)
+	}
+	s.SetWithTTL(ctx, "count", "1", 10*time.Millisecond)
+	if n, err := s.Incr(ctx, "count", 1); err != nil || n != 2 {
+		t.Error("Expected to increment a key with a TTL, got: ", n, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, exists, _ := s.Get(ctx, "count"); exists {
+		t.Error("Expected Incr to keep the key's expiry time")
+	}
+	if n, _ := s.Incr(ctx, "count", 1); n != 1 {
+		t.Error("Expected an expired key to start over, got: ", n)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New()
+	s := newStore(t, inner, true, key1)
+
+	s.SetWithTTL(ctx, "count", "1", 10*time.Millisecond)
+	s.Incr(ctx, "count", 1)
+	s.Namespace("karma").SetWithTTL(ctx, "bob", "1", 10*time.Millisecond)
+	s.Namespace("karma").Incr(ctx, "bob", 1)
+	s.Set(ctx, "kept", "x")
+	time.Sleep(20 * time.Millisecond)
+	if err := s.Sweep(ctx); err != nil {
+		t.Error("Unexpected error sweeping: ", err)
+	}
+	if keys, _ := inner.Keys(ctx, ""); len(keys) != 1 {
+		t.Error("Expected Sweep to delete incremented keys once they expire, got: ", keys)
+	}
+	if names, _ := inner.Namespaces(ctx); len(names) != 0 {
+		t.Error("Expected Sweep to delete expired keys in namespaces, got: ", names)
+	}
+	if val, _, _ := s.Get(ctx, "kept"); val != "x" {
+		t.Error("Expected Sweep to keep keys without a TTL, got: ", val)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New()
+	old := newStore(t, inner, true, key1)
+	old.Set(ctx, "token", "secret")
+	old.SetWithTTL(ctx, "session", "x", time.Hour)
+	old.SetWithTTL(ctx, "expired", "x", time.Millisecond)
+	old.Namespace("ns").Namespace("nested").Set(ctx, "a", "nested")
+	// written before the store was encrypted
+	inner.Set(ctx, "plain", "text")
+	inner.Namespace("legacy").Set(ctx, "a", "b")
+	time.Sleep(5 * time.Millisecond)
+
+	s := newStore(t, inner, true, key2, key1)
+	if err := s.Rotate(ctx); err != nil {
+		t.Fatal("Unexpected error rotating keys: ", err)
+	}
+
+	// only the new key is needed after rotating
+	s = newStore(t, inner, true, key2)
+	all, err := s.All(ctx)
+	if err != nil || len(all) != 3 || all["token"] != "secret" || all["plain"] != "text" {
+		t.Error("Expected every entry to be re-encrypted with the new key, got: ", all, err)
+	}
+	if _, exists, _ := s.Get(ctx, "session"); !exists {
+		t.Error("Expected entries with a TTL to be kept")
+	}
+	if val, _, _ := s.Namespace("ns").Namespace("nested").Get(ctx, "a"); val != "nested" {
+		t.Error("Expected nested namespaces to be re-encrypted, got: ", val)
+	}
+	if val, _, _ := s.Namespace("legacy").Get(ctx, "a"); val != "b" {
+		t.Error("Expected unencrypted namespaces to be encrypted, got: ", val)
+	}
+	if names, _ := inner.Namespaces(ctx); len(names) != 2 {
+		t.Error("Expected old namespaces to be removed, got: ", names)
+	}
+	if keys, _ := inner.Keys(ctx, ""); len(keys) != 3 {
+		t.Error("Expected old and expired keys to be removed, got: ", keys)
+	}
+}
+
+func TestStoreConfig(t *testing.T) {
+	initFunc := storetest.Load(t, AdapterName)
+
+	s, err := initFunc(storetest.Robot{Config: NewConfig("memory", nil, key1, true, key2)})
+	if err != nil {
+		t.Fatal("Unexpected error creating configured store: ", err)
+	}
+	s.Set(context.Background(), "a", "b")
+	if val, _, _ := s.Get(context.Background(), "a"); val != "b" {
+		t.Error("Expected the configured store to work, got: ", val)
+	}
+
+	_, err = initFunc(storetest.Robot{})
+	if _, ok := err.(*store.ConfigError); !ok {
+		t.Error("Expected a config error without a config, got: ", err)
+	}
+	_, err = initFunc(storetest.Robot{Config: NewConfig("memory", nil, []byte("short"), false)})
+	if _, ok := err.(*store.ConfigError); !ok {
+		t.Error("Expected a config error for an invalid key, got: ", err)
+	}
+	_, err = initFunc(storetest.Robot{Config: NewConfig(AdapterName, nil, key1, false)})
+	if _, ok := err.(*store.ConfigError); !ok {
+		t.Error("Expected a config error for wrapping itself, got: ", err)
+	}
+	_, err = initFunc(storetest.Robot{Config: NewConfig("nonexistent", nil, key1, false)})
+	if _, ok := err.(*store.UnknownAdapterError); !ok {
+		t.Error("Expected an unknown adapter error, got: ", err)
+	}
+}
+
+func TestStoreConfigEncryptsExisting(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New()
+	inner.Set(ctx, "plain", "text")
+	inner.Namespace("legacy").Set(ctx, "a", "b")
+	store.Register("plaintextMemory", func(r store.Robot) (store.ContextAdapter, error) {
+		return inner, nil
+	})
+	initFunc, _ := store.Load(AdapterName)
+	s, err := initFunc(storetest.Robot{Config: NewConfig("plaintextMemory", nil, key1, false)})
+	if err != nil {
+		t.Fatal("Unexpected error wrapping a store holding plaintext: ", err)
+	}
+	if val, _, err := s.Get(ctx, "plain"); err != nil || val != "text" {
+		t.Error("Expected existing plaintext values to be readable, got: ", val, err)
+	}
+	if all, err := s.All(ctx); err != nil || len(all) != 1 {
+		t.Error("Expected existing plaintext values to be listed, got: ", all, err)
+	}
+	if val, _, err := s.Namespace("legacy").Get(ctx, "a"); err != nil || val != "b" {
+		t.Error("Expected existing plaintext namespaces to be readable, got: ", val, err)
+	}
+	if val, _, _ := inner.Get(ctx, "plain"); val == "text" {
+		t.Error("Expected existing plaintext values to be encrypted")
+	}
+}
+
+func TestExportSealed(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t, memory.New(), true, key1)
+	s.Set(ctx, "token", "secret")
+	s.Namespace("ns").SetWithTTL(ctx, "session", "x", time.Hour)
+
+	var buf bytes.Buffer
+	if err := store.Export(s, &buf); err != nil {
+		t.Fatal("Unexpected error exporting: ", err)
+	}
+	if strings.Contains(buf.String(), "secret") || strings.Contains(buf.String(), "token") {
+		t.Error("Expected the export to only hold encrypted entries, got: ", buf.String())
+	}
+
+	imported := newStore(t, memory.New(), true, key1)
+	if err := store.Import(bytes.NewReader(buf.Bytes()), imported); err != nil {
+		t.Fatal("Unexpected error importing: ", err)
+	}
+	if val, _, _ := imported.Get(ctx, "token"); val != "secret" {
+		t.Error("Expected the sealed export to be readable with the same key, got: ", val)
+	}
+	if expires, _ := imported.Namespace("ns").(store.Expirer).Expires(ctx, "session"); expires.IsZero() {
+		t.Error("Expected TTLs to be kept")
+	}
+	if err := store.Import(bytes.NewReader(buf.Bytes()), memory.New()); err == nil {
+		t.Error("Expected a sealed export to be refused by an unencrypted store")
+	}
+}
@@ -0,0 +1,122 @@
+package encryptedstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	// sealedPrefix marks strings sealed by this package and the version of
+	// their format.
+	sealedPrefix = "enc1:"
+
+	// keyIDSize is the number of bytes that identify the key a string was
+	// sealed with.
+	keyIDSize = 4
+)
+
+// errNotSealed is returned when opening a string that was not sealed by this
+// package (ex: a value written before encryption was enabled).
+var errNotSealed = errors.New("encryptedstore: value is not encrypted")
+
+// sealingKey is a single configured key.
+type sealingKey struct {
+	id   string
+	aead cipher.AEAD
+	// nameKey derives the nonces of deterministically sealed names
+	nameKey []byte
+}
+
+// keyring holds the current key and any old keys that can still be used to
+// open strings. Sealed strings are the prefix followed by the base64 encoded
+// key ID, nonce, and ciphertext.
+type keyring struct {
+	current *sealingKey
+	byID    map[string]*sealingKey
+}
+
+func newKeyring(current []byte, old [][]byte) (*keyring, error) {
+	k := &keyring{byID: make(map[string]*sealingKey)}
+	for i, key := range append([][]byte{current}, old...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("victor encryptedstore names"))
+		sk := &sealingKey{
+			id:      string(sum[:keyIDSize]),
+			aead:    aead,
+			nameKey: mac.Sum(nil),
+		}
+		if i == 0 {
+			k.current = sk
+		}
+		if _, exists := k.byID[sk.id]; !exists {
+			k.byID[sk.id] = sk
+		}
+	}
+	return k, nil
+}
+
+// seal encrypts plain with a random nonce using the current key.
+func (k *keyring) seal(aad []byte, plain string) string {
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return k.encode(nonce, aad, plain)
+}
+
+// sealName encrypts plain with a nonce derived from it so the same name is
+// always sealed to the same string by the same key.
+func (k *keyring) sealName(aad []byte, plain string) string {
+	mac := hmac.New(sha256.New, k.current.nameKey)
+	mac.Write(aad)
+	mac.Write([]byte{0})
+	mac.Write([]byte(plain))
+	return k.encode(mac.Sum(nil)[:k.current.aead.NonceSize()], aad, plain)
+}
+
+func (k *keyring) encode(nonce, aad []byte, plain string) string {
+	blob := append([]byte(k.current.id), nonce...)
+	blob = k.current.aead.Seal(blob, nonce, []byte(plain), aad)
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(blob)
+}
+
+// open decrypts a sealed string with whichever key sealed it. The second
+// return value is true if that was the current key.
+func (k *keyring) open(aad []byte, sealed string) (string, bool, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", false, errNotSealed
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(sealed[len(sealedPrefix):])
+	if err != nil || len(blob) < keyIDSize {
+		return "", false, ErrDecrypt
+	}
+	key, ok := k.byID[string(blob[:keyIDSize])]
+	if !ok {
+		return "", false, ErrDecrypt
+	}
+	blob = blob[keyIDSize:]
+	nonceSize := key.aead.NonceSize()
+	if len(blob) < nonceSize {
+		return "", false, ErrDecrypt
+	}
+	plain, err := key.aead.Open(nil, blob[:nonceSize], blob[nonceSize:], aad)
+	if err != nil {
+		return "", false, ErrDecrypt
+	}
+	return string(plain), key == k.current, nil
+}
@@ -0,0 +1,95 @@
+package encryptedstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+// Rotate re-encrypts every entry in this store's namespace and the
+// namespaces nested in it that was sealed with an old key. Entries that are
+// not encrypted at all (ex: written before the store was wrapped) are
+// encrypted, and when keys are encrypted entries are moved to their sealed
+// names. Expired entries are deleted.
+//
+// The registered adapter runs Rotate when it is created. Rotate should not be
+// run while other clients are writing to the store.
+func (s *EncryptedStore) Rotate(ctx context.Context) error {
+	if err := s.rotate(ctx, s.inner, s, false); err != nil {
+		return fmt.Errorf("encryptedstore: error rotating keys: %s", err)
+	}
+	return nil
+}
+
+// rotate re-encrypts the entries of src into dst. Both refer to the same
+// logical namespace but src is a different namespace of the wrapped adapter
+// than dst's if moved is true (ex: its name was sealed with an old key).
+func (s *EncryptedStore) rotate(ctx context.Context, src store.ContextAdapter, dst *EncryptedStore, moved bool) error {
+	all, err := src.All(ctx)
+	if err != nil {
+		return err
+	}
+	for name, sealed := range all {
+		key, err := dst.openName(name)
+		if err == errNotSealed {
+			key = name
+		} else if err != nil {
+			return err
+		}
+		val, expires, current, err := dst.open(key, sealed)
+		if err == errNotSealed {
+			val, expires, current = sealed, time.Time{}, false
+		} else if err != nil {
+			return fmt.Errorf("%q: %s", key, err)
+		}
+		renamed := moved || dst.name(key) != name
+		if expired(expires) {
+			if err := src.Delete(ctx, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if current && !renamed {
+			continue
+		}
+		if expires.IsZero() {
+			err = dst.Set(ctx, key, val)
+		} else {
+			err = dst.SetWithTTL(ctx, key, val, expires.Sub(time.Now()))
+		}
+		if err != nil {
+			return err
+		}
+		if renamed {
+			if err := src.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	names, err := src.Namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		plain, err := dst.openName(name)
+		if err == errNotSealed {
+			plain = name
+		} else if err != nil {
+			return err
+		}
+		child := dst.Namespace(plain).(*EncryptedStore)
+		renamed := moved || dst.name(plain) != name
+		if err := s.rotate(ctx, src.Namespace(name), child, renamed); err != nil {
+			return err
+		}
+		if renamed {
+			if err := src.DeleteNamespace(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
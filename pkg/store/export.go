@@ -0,0 +1,155 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExportFormat identifies the files written by Export and ExportVersion is
+// the version of their layout. Import refuses files with a newer version.
+//
+// Version 2 added the expiry times of keys and sealed exports of encrypted
+// adapters.
+const (
+	ExportFormat  = "victor-store"
+	ExportVersion = 2
+)
+
+// exportHeader is the first line of an export. Sealed is true if the entries
+// are the encrypted entries of a Sealer.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Sealed  bool   `json:"sealed,omitempty"`
+}
+
+// exportEntry is a single key of an export. Namespace is the path of names
+// from the exported adapter to the key's namespace and Expires is set for
+// keys with a TTL.
+type exportEntry struct {
+	Namespace []string   `json:"namespace,omitempty"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// Export writes every key in the adapter and the namespaces nested in it as
+// JSON lines. The first line is a header holding ExportFormat and
+// ExportVersion and each following line holds one key, its value, its
+// namespace, and its expiry time if the key has a TTL. Expiry times are only
+// written if the adapter implements Expirer.
+//
+// If the adapter implements Sealer then the encrypted entries of its sealed
+// adapter are written instead so the export never holds decrypted values.
+func Export(adapter ContextAdapter, w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	header := &exportHeader{Format: ExportFormat, Version: ExportVersion}
+	if sealer, ok := adapter.(Sealer); ok {
+		adapter, header.Sealed = sealer.Sealed(), true
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	if err := exportNamespace(context.Background(), adapter, nil, enc); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// exportNamespace writes the keys of the given adapter and then its nested
+// namespaces in order.
+func exportNamespace(ctx context.Context, adapter ContextAdapter, path []string, enc *json.Encoder) error {
+	// expiry times are read once the scan is done since some adapters hold a
+	// lock or connection while scanning
+	var entries []*exportEntry
+	err := adapter.Scan(ctx, "", func(key, value string) bool {
+		entries = append(entries, &exportEntry{Namespace: path, Key: key, Value: value})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	expirer, hasTTLs := adapter.(Expirer)
+	for _, entry := range entries {
+		if hasTTLs {
+			expires, err := expirer.Expires(ctx, entry.Key)
+			if err != nil {
+				return err
+			}
+			if !expires.IsZero() {
+				entry.Expires = &expires
+			}
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	names, err := adapter.Namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		childPath := append(append([]string{}, path...), name)
+		if err := exportNamespace(ctx, adapter.Namespace(name), childPath, enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads an export written by Export and sets each of its keys in the
+// adapter. Existing keys that are not in the export are left alone. Keys are
+// set with the TTL left until their expiry time and keys that have expired
+// since the export are skipped.
+//
+// A sealed export can only be imported into a Sealer, whose sealed adapter
+// receives the encrypted entries, and is only readable if that adapter uses
+// the same keys as the one that was exported.
+func Import(r io.Reader, adapter ContextAdapter) error {
+	ctx := context.Background()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	header := &exportHeader{}
+	if err := dec.Decode(header); err != nil {
+		return fmt.Errorf("store: error reading export header: %s", err)
+	}
+	if header.Format != ExportFormat {
+		return fmt.Errorf("store: not a store export (format %q)", header.Format)
+	}
+	if header.Version < 1 || header.Version > ExportVersion {
+		return fmt.Errorf("store: unsupported export version %d", header.Version)
+	}
+	if header.Sealed {
+		sealer, ok := adapter.(Sealer)
+		if !ok {
+			return errors.New("store: a sealed export can only be imported into an encrypted adapter")
+		}
+		adapter = sealer.Sealed()
+	}
+	for line := 2; ; line++ {
+		entry := &exportEntry{}
+		err := dec.Decode(entry)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("store: error reading export line %d: %s", line, err)
+		}
+		target := adapter
+		for _, name := range entry.Namespace {
+			target = target.Namespace(name)
+		}
+		if entry.Expires == nil {
+			err = target.Set(ctx, entry.Key, entry.Value)
+		} else if ttl := entry.Expires.Sub(time.Now()); ttl > 0 {
+			err = target.SetWithTTL(ctx, entry.Key, entry.Value, ttl)
+		}
+		if err != nil {
+			return fmt.Errorf("store: error importing %q: %s", entry.Key, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(t)
+	assert.NoError(t, s.Set(ctx, "a", "root"))
+	assert.NoError(t, s.Set(ctx, "b", "line\nbreak"))
+	assert.NoError(t, s.Namespace("karma").Set(ctx, "bob", "2"))
+	assert.NoError(t, s.Namespace("karma").Namespace("nested").Set(ctx, "a", "nested"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, store.Export(s, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 5, "Export should write a header and one line per key.")
+	assert.Equal(t, `{"format":"victor-store","version":2}`, lines[0])
+	assert.Equal(t, `{"namespace":["karma"],"key":"bob","value":"2"}`, lines[3])
+
+	imported := newMemoryStore(t)
+	assert.NoError(t, imported.Set(ctx, "a", "overwritten"))
+	assert.NoError(t, imported.Set(ctx, "kept", "x"))
+	assert.NoError(t, store.Import(&buf, imported))
+	all, _ := imported.All(ctx)
+	assert.Equal(t, map[string]string{"a": "root", "b": "line\nbreak", "kept": "x"}, all)
+	val, _, _ := imported.Namespace("karma").Namespace("nested").Get(ctx, "a")
+	assert.Equal(t, "nested", val, "Nested namespaces should be imported.")
+}
+
+func TestImportInvalid(t *testing.T) {
+	s := newMemoryStore(t)
+	assert.Error(t, store.Import(strings.NewReader(""), s), "An empty export should fail.")
+	assert.Error(t, store.Import(strings.NewReader(`{"format":"other","version":1}`), s),
+		"Other formats should fail.")
+	assert.Error(t, store.Import(strings.NewReader(`{"format":"victor-store","version":3}`), s),
+		"Newer versions should fail.")
+	assert.Error(t, store.Import(strings.NewReader(`{"format":"victor-store","version":2,"sealed":true}`), s),
+		"Sealed exports should only be imported into encrypted adapters.")
+	assert.Error(t, store.Import(strings.NewReader(`{"format":"victor-store","version":1}`+"\n{bad"), s),
+		"Invalid entries should fail.")
+}
+
+func TestExportImportTTL(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(t)
+	assert.NoError(t, s.SetWithTTL(ctx, "session", "x", time.Hour))
+	assert.NoError(t, s.Set(ctx, "kept", "y"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, store.Export(s, &buf))
+	assert.Contains(t, buf.String(), `"expires":`, "Keys with a TTL should be exported with their expiry time.")
+
+	imported := newMemoryStore(t)
+	assert.NoError(t, store.Import(&buf, imported))
+	expires, err := imported.(store.Expirer).Expires(ctx, "session")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute, "TTLs should be imported.")
+	expires, _ = imported.(store.Expirer).Expires(ctx, "kept")
+	assert.True(t, expires.IsZero(), "Keys without a TTL should be imported without one.")
+
+	old := `{"format":"victor-store","version":2}
+{"key":"expired","value":"x","expires":"2000-01-01T00:00:00Z"}
+`
+	assert.NoError(t, store.Import(strings.NewReader(old), imported))
+	_, exists, _ := imported.Get(ctx, "expired")
+	assert.False(t, exists, "Keys that have expired since the export should be skipped.")
+}
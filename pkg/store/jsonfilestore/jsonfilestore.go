@@ -0,0 +1,353 @@
+package jsonfilestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/memory"
+)
+
+const (
+	// AdapterName is the JSON file store's registered adapter name for the
+	// victor framework.
+	AdapterName = "jsonfile"
+
+	// defaultDebounce is how long changes are collected before the file is
+	// written if no debounce is configured.
+	defaultDebounce = time.Second
+
+	// fileVersion is the version of the file format written by this adapter.
+	fileVersion = 1
+
+	// pathEnvVar is the environment variable that the file's path is read
+	// from if the robot has no store config.
+	pathEnvVar = "VICTOR_STORAGE_PATH"
+)
+
+// ErrClosed is returned when writing to a store after it has been closed.
+var ErrClosed = errors.New("jsonfilestore: store is closed")
+
+func init() {
+	store.Register(AdapterName, func(r store.Robot) (store.ContextAdapter, error) {
+		var config Config
+		storeConfig, configSet := r.StoreConfig()
+		if configSet {
+			var ok bool
+			config, ok = storeConfig.(Config)
+			if !ok {
+				return nil, &store.ConfigError{
+					Adapter: AdapterName,
+					Reason:  fmt.Sprintf("the bot's store config must implement the Config interface, got %T", storeConfig),
+				}
+			}
+		} else {
+			config = NewConfig(os.Getenv(pathEnvVar), 0)
+		}
+		if config.Path() == "" {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "a file path must be set in the store config or " + pathEnvVar,
+			}
+		}
+		return newJSONFileStore(config)
+	})
+}
+
+// Config provides the JSON file adapter with the location of its file and
+// how often it is written.
+type Config interface {
+	// Path returns the path of the JSON file. The file is created on the
+	// first write if it does not exist.
+	Path() string
+	// Debounce returns how long changes are collected before the file is
+	// written.
+	Debounce() time.Duration
+}
+
+// configImpl implements the Config interface.
+type configImpl struct {
+	path     string
+	debounce time.Duration
+}
+
+// NewConfig returns a new JSON file configuration instance. A zero debounce
+// writes the file at most once a second.
+func NewConfig(path string, debounce time.Duration) configImpl {
+	return configImpl{path: path, debounce: debounce}
+}
+
+func (c configImpl) Path() string {
+	return c.path
+}
+
+func (c configImpl) Debounce() time.Duration {
+	return c.debounce
+}
+
+// fileContents is the layout of the JSON file.
+type fileContents struct {
+	Version int              `json:"version"`
+	Root    *memory.Snapshot `json:"root"`
+}
+
+// newJSONFileStore loads the file described by the given config (if it
+// exists) and returns a store holding its data.
+func newJSONFileStore(config Config) (*JSONFileStore, error) {
+	debounce := config.Debounce()
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+
+	contents := &fileContents{}
+	data, err := os.ReadFile(config.Path())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("jsonfilestore: error reading %q: %s", config.Path(), err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, contents); err != nil {
+			return nil, fmt.Errorf("jsonfilestore: error reading %q: %s", config.Path(), err)
+		}
+		if contents.Version > fileVersion {
+			return nil, fmt.Errorf("jsonfilestore: error reading %q: unsupported version %d", config.Path(), contents.Version)
+		}
+	}
+
+	root := memory.Restore(contents.Root)
+	return &JSONFileStore{
+		MemoryStore: root,
+		file: &file{
+			path:     config.Path(),
+			debounce: debounce,
+			root:     root,
+			mutex:    &sync.Mutex{},
+			writing:  &sync.Mutex{},
+			closing:  &sync.RWMutex{},
+		},
+	}, nil
+}
+
+// JSONFileStore keeps all data in memory like memory.MemoryStore and writes
+// it to a JSON file after it changes. Writes are debounced so a burst of
+// changes results in a single write, and each write goes to a temporary file
+// which is synced and then renamed over the old file so the file is never
+// left partially written.
+//
+// Reads are served by the embedded MemoryStore. Changes made in the last
+// debounce interval are lost if the process exits without calling Close.
+type JSONFileStore struct {
+	*memory.MemoryStore
+	file *file
+}
+
+// Close writes any pending changes to the file. The robot calls this when it
+// is stopped. Every namespace shares the file so this closes them as well.
+func (s *JSONFileStore) Close() error {
+	return s.file.close()
+}
+
+// Flush writes any pending changes to the file immediately.
+func (s *JSONFileStore) Flush() error {
+	return s.file.flush()
+}
+
+// write runs a change against the memory store and schedules a write of the
+// file if it succeeds.
+func (s *JSONFileStore) write(change func() error) error {
+	// holding closing until the change is recorded means close cannot flush
+	// between the change and the write being scheduled
+	s.file.closing.RLock()
+	defer s.file.closing.RUnlock()
+	if s.file.isClosed() {
+		return ErrClosed
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	s.file.changed()
+	return nil
+}
+
+func (s *JSONFileStore) Set(ctx context.Context, key string, val string) error {
+	return s.write(func() error {
+		return s.MemoryStore.Set(ctx, key, val)
+	})
+}
+
+func (s *JSONFileStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	return s.write(func() error {
+		return s.MemoryStore.SetWithTTL(ctx, key, val, ttl)
+	})
+}
+
+func (s *JSONFileStore) Delete(ctx context.Context, key string) error {
+	return s.write(func() error {
+		return s.MemoryStore.Delete(ctx, key)
+	})
+}
+
+func (s *JSONFileStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	var current int64
+	err := s.write(func() (err error) {
+		current, err = s.MemoryStore.Incr(ctx, key, delta)
+		return err
+	})
+	return current, err
+}
+
+func (s *JSONFileStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	var swapped bool
+	err := s.write(func() (err error) {
+		swapped, err = s.MemoryStore.CompareAndSwap(ctx, key, old, new)
+		return err
+	})
+	return swapped, err
+}
+
+func (s *JSONFileStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	return s.write(func() error {
+		return s.MemoryStore.Update(ctx, fn)
+	})
+}
+
+func (s *JSONFileStore) DeleteNamespace(ctx context.Context, name string) error {
+	return s.write(func() error {
+		return s.MemoryStore.DeleteNamespace(ctx, name)
+	})
+}
+
+// Namespace returns an adapter for the given namespace which writes to the
+// same file.
+func (s *JSONFileStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	return &JSONFileStore{
+		MemoryStore: s.MemoryStore.Namespace(name).(*memory.MemoryStore),
+		file:        s.file,
+	}
+}
+
+// file writes snapshots of the root memory store to disk.
+type file struct {
+	path     string
+	debounce time.Duration
+	root     *memory.MemoryStore
+	// mutex guards the fields below and writing serializes writes so an
+	// older snapshot never replaces a newer one. closing is held for reading
+	// while a change is made and for writing while the file is closed.
+	mutex   *sync.Mutex
+	writing *sync.Mutex
+	closing *sync.RWMutex
+	timer   *time.Timer
+	dirty   bool
+	closed  bool
+}
+
+func (f *file) isClosed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closed
+}
+
+// changed marks the store as changed and starts the debounce timer if it is
+// not already running.
+func (f *file) changed() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dirty = true
+	f.schedule()
+}
+
+// schedule starts the debounce timer if it is not already running and the
+// file is open. The mutex should be held before calling this method.
+func (f *file) schedule() {
+	if f.timer == nil && !f.closed {
+		f.timer = time.AfterFunc(f.debounce, func() {
+			if err := f.flush(); err != nil {
+				log.Println(err.Error())
+			}
+		})
+	}
+}
+
+// flush writes the file if there are changes that have not been written.
+func (f *file) flush() error {
+	f.writing.Lock()
+	defer f.writing.Unlock()
+	f.mutex.Lock()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	dirty := f.dirty
+	f.dirty = false
+	f.mutex.Unlock()
+	if !dirty {
+		return nil
+	}
+	if err := f.save(f.root.Snapshot()); err != nil {
+		// try again once the debounce interval has passed
+		f.mutex.Lock()
+		f.dirty = true
+		f.schedule()
+		f.mutex.Unlock()
+		return fmt.Errorf("jsonfilestore: error writing %q: %s", f.path, err)
+	}
+	return nil
+}
+
+// close waits for changes in progress, stops further writes and writes any
+// pending changes.
+func (f *file) close() error {
+	f.closing.Lock()
+	f.mutex.Lock()
+	f.closed = true
+	f.mutex.Unlock()
+	f.closing.Unlock()
+	return f.flush()
+}
+
+// save writes the snapshot to a temporary file in the same directory, syncs
+// it, and renames it over the file.
+func (f *file) save(snapshot *memory.Snapshot) error {
+	data, err := json.MarshalIndent(&fileContents{Version: fileVersion, Root: snapshot}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	// sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
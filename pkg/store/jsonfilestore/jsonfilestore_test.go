@@ -0,0 +1,253 @@
+package jsonfilestore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+)
+
+const (
+	FILE_PATH = "test.json"
+)
+
+var db *JSONFileStore
+
+func init() {
+	os.Setenv("VICTOR_STORAGE_PATH", FILE_PATH)
+}
+
+func setup() {
+	var err error
+	db, err = newJSONFileStore(NewConfig(FILE_PATH, 10*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func teardown() {
+	db.Close()
+	os.Remove(FILE_PATH)
+}
+
+// reopen closes the store and loads it again from the file.
+func reopen(t *testing.T) {
+	if err := db.Close(); err != nil {
+		t.Fatal("Unexpected error closing store: ", err)
+	}
+	var err error
+	db, err = newJSONFileStore(NewConfig(FILE_PATH, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal("Unexpected error reloading store: ", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+		setup()
+		return db, teardown
+	})
+}
+
+func TestSetGet(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	if err := db.Set(ctx, "a", "b"); err != nil {
+		t.Error("Unexpected error setting 'a': ", err)
+	}
+	val, exists, _ := db.Get(ctx, "a")
+	if val != "b" || !exists {
+		t.Error("Stored 'a': 'b', expected to get it back", val)
+	}
+
+	teardown()
+}
+
+func TestReload(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Set(ctx, "a", "root")
+	db.Set(ctx, "gone", "x")
+	db.Delete(ctx, "gone")
+	db.Incr(ctx, "count", 3)
+	db.Namespace("karma").Namespace("nested").Set(ctx, "bob", "2")
+	db.SetWithTTL(ctx, "ttl", "x", time.Hour)
+	db.SetWithTTL(ctx, "expired", "x", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	reopen(t)
+
+	if val, _, _ := db.Get(ctx, "a"); val != "root" {
+		t.Error("Expected the root's keys to be reloaded, got: ", val)
+	}
+	if val, _, _ := db.Get(ctx, "count"); val != "3" {
+		t.Error("Expected incremented keys to be reloaded, got: ", val)
+	}
+	if _, exists, _ := db.Get(ctx, "gone"); exists {
+		t.Error("Expected deleted keys not to be reloaded")
+	}
+	if val, _, _ := db.Namespace("karma").Namespace("nested").Get(ctx, "bob"); val != "2" {
+		t.Error("Expected nested namespaces to be reloaded, got: ", val)
+	}
+	if _, exists, _ := db.Get(ctx, "ttl"); !exists {
+		t.Error("Expected keys with a TTL to be reloaded")
+	}
+	if _, exists, _ := db.Get(ctx, "expired"); exists {
+		t.Error("Expected expired keys not to be reloaded")
+	}
+
+	contents := &fileContents{}
+	data, _ := os.ReadFile(FILE_PATH)
+	if err := json.Unmarshal(data, contents); err != nil || contents.Version != fileVersion {
+		t.Error("Expected the file to be versioned JSON, got: ", string(data), err)
+	}
+	if _, ok := contents.Root.Expires["ttl"]; !ok {
+		t.Error("Expected the TTL to be saved in the file")
+	}
+
+	teardown()
+}
+
+func TestDebounce(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Set(ctx, "a", "1")
+	if _, err := os.Stat(FILE_PATH); !os.IsNotExist(err) {
+		t.Error("Expected the file not to be written before the debounce interval")
+	}
+	for i := 0; i < 10; i++ {
+		db.Incr(ctx, "count", 1)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	data, err := os.ReadFile(FILE_PATH)
+	if err != nil {
+		t.Fatal("Expected the file to be written after the debounce interval, got: ", err)
+	}
+	contents := &fileContents{}
+	json.Unmarshal(data, contents)
+	if contents.Root.Data["count"] != "10" {
+		t.Error("Expected a burst of changes to be written together, got: ", contents.Root.Data)
+	}
+	matches, _ := filepath.Glob(FILE_PATH + ".*.tmp")
+	if len(matches) != 0 {
+		t.Error("Expected no temporary files to be left behind, got: ", matches)
+	}
+
+	teardown()
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	db, _ = newJSONFileStore(NewConfig(FILE_PATH, time.Hour))
+	db.Set(ctx, "a", "b")
+	if err := db.Flush(); err != nil {
+		t.Error("Unexpected error flushing: ", err)
+	}
+	if _, err := os.Stat(FILE_PATH); err != nil {
+		t.Error("Expected Flush to write the file, got: ", err)
+	}
+
+	teardown()
+}
+
+func TestFlushRetry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "jsonfilestore")
+	if err != nil {
+		t.Fatal("Unexpected error creating directory: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing", FILE_PATH)
+	s, _ := newJSONFileStore(NewConfig(path, 10*time.Millisecond))
+	defer s.Close()
+
+	s.Set(context.Background(), "a", "b")
+	time.Sleep(30 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected writing to a missing directory to fail, got: ", err)
+	}
+	os.Mkdir(filepath.Dir(path), 0700)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); err != nil {
+		t.Error("Expected a failed write to be retried, got: ", err)
+	}
+}
+
+func TestCorruptFile(t *testing.T) {
+	os.WriteFile(FILE_PATH, []byte("{not json"), 0600)
+	if _, err := newJSONFileStore(NewConfig(FILE_PATH, 0)); err == nil {
+		t.Error("Expected loading an invalid file to fail")
+	}
+	os.WriteFile(FILE_PATH, []byte(`{"version": 99}`), 0600)
+	if _, err := newJSONFileStore(NewConfig(FILE_PATH, 0)); err == nil {
+		t.Error("Expected loading a newer file version to fail")
+	}
+	os.Remove(FILE_PATH)
+}
+
+func TestAtomic(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	if _, err := db.Incr(ctx, "a", 1); err != nil {
+		t.Error("Unexpected error incrementing: ", err)
+	}
+	if swapped, _ := db.CompareAndSwap(ctx, "a", "1", "x"); !swapped {
+		t.Error("Expected swap to succeed on the same value")
+	}
+	err := db.Update(ctx, func(tx store.Tx) error {
+		return tx.Set("b", "y")
+	})
+	if err != nil {
+		t.Error("Unexpected error updating: ", err)
+	}
+	reopen(t)
+	if val, _, _ := db.Get(ctx, "a"); val != "x" {
+		t.Error("Expected swapped value to be saved, got: ", val)
+	}
+	if val, _, _ := db.Get(ctx, "b"); val != "y" {
+		t.Error("Expected transaction to be saved, got: ", val)
+	}
+
+	teardown()
+}
+
+func TestStoreConfig(t *testing.T) {
+	initFunc := storetest.Load(t, AdapterName)
+
+	s, err := initFunc(storetest.Robot{Config: NewConfig(FILE_PATH, 0)})
+	if err != nil {
+		t.Fatal("Unexpected error opening configured store: ", err)
+	}
+	s.(*JSONFileStore).Close()
+
+	// falls back to the environment variable without a config
+	s, err = initFunc(storetest.Robot{})
+	if err != nil {
+		t.Fatal("Unexpected error opening store from environment: ", err)
+	}
+	s.(*JSONFileStore).Close()
+
+	storetest.CheckConfigType(t, initFunc)
+	os.Remove(FILE_PATH)
+}
+
+func TestClose(t *testing.T) {
+	setup()
+
+	db.Set(context.Background(), "a", "b")
+	teardown()
+	if err := db.Set(context.Background(), "a", "b"); err != ErrClosed {
+		t.Error("Expected writing to a closed store to fail, got: ", err)
+	}
+	if _, err := os.Stat(FILE_PATH); !os.IsNotExist(err) {
+		t.Error("Expected a closed store not to write the file again")
+	}
+}
@@ -1,45 +1,583 @@
 package memory
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/FogCreek/victor/pkg/store"
 )
 
 func init() {
-	store.Register("memory", func(r store.Robot) store.Adapter {
-		return &MemoryStore{
-			data: make(map[string]string),
-		}
+	store.Register("memory", func(r store.Robot) (store.ContextAdapter, error) {
+		return New(), nil
 	})
 }
 
+// New returns an empty memory store.
+func New() *MemoryStore {
+	return Restore(nil)
+}
+
+// Restore returns a memory store holding the data in the given snapshot. A
+// nil snapshot returns an empty store.
+func Restore(snapshot *Snapshot) *MemoryStore {
+	return &MemoryStore{
+		mutex: &sync.RWMutex{},
+		root:  restore(snapshot),
+		hub:   store.NewHub(),
+	}
+}
+
+// MemoryStore keeps all data in memory. Each namespace has its own map and
+// a MemoryStore refers to a namespace by its path from the root so adapters
+// returned by Namespace remain valid after their namespace is deleted.
 type MemoryStore struct {
-	sync.RWMutex
-	data map[string]string
+	mutex *sync.RWMutex
+	root  *namespace
+	path  []string
+	hub   *store.Hub
+}
+
+// namespace holds the data for a single namespace and its children as well
+// as the expiry times of any keys set with a TTL.
+type namespace struct {
+	data     map[string]string
+	expires  map[string]time.Time
+	children map[string]*namespace
+}
+
+// Snapshot is a copy of a namespace's data which can be encoded as JSON.
+// Expires holds the expiry times of keys that were set with a TTL.
+type Snapshot struct {
+	Data       map[string]string    `json:"data,omitempty"`
+	Expires    map[string]time.Time `json:"expires,omitempty"`
+	Namespaces map[string]*Snapshot `json:"namespaces,omitempty"`
 }
 
-func (s *MemoryStore) Get(key string) (string, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	val, ok := s.data[key]
+func newNamespace() *namespace {
+	return &namespace{
+		data:     make(map[string]string),
+		expires:  make(map[string]time.Time),
+		children: make(map[string]*namespace),
+	}
+}
+
+// get returns the value of a key unless it has expired. Expired keys are
+// left for Sweep to remove so this only needs a read lock.
+func (n *namespace) get(key string, now time.Time) (string, bool) {
+	if expires, ok := n.expires[key]; ok && !now.Before(expires) {
+		return "", false
+	}
+	val, ok := n.data[key]
 	return val, ok
 }
 
-func (s *MemoryStore) Set(key string, val string) {
-	s.Lock()
-	defer s.Unlock()
-	s.data[key] = val
+// remove deletes a key and its expiry time.
+func (n *namespace) remove(key string) {
+	delete(n.data, key)
+	delete(n.expires, key)
+}
+
+// removeEvent returns the type of event sent when a key is removed. Keys whose
+// TTL has elapsed send an expire event as they would from Sweep.
+func (n *namespace) removeEvent(key string, now time.Time) store.EventType {
+	if expires, ok := n.expires[key]; ok && !now.Before(expires) {
+		return store.EventExpire
+	}
+	return store.EventDelete
+}
+
+// sweep removes expired keys from the namespace (whose path is given) and
+// its children and returns an expire event for each of them.
+func (n *namespace) sweep(path []string, now time.Time) []store.StoreEvent {
+	var events []store.StoreEvent
+	for key, expires := range n.expires {
+		if !now.Before(expires) {
+			n.remove(key)
+			events = append(events, store.StoreEvent{Type: store.EventExpire, Namespace: path, Key: key})
+		}
+	}
+	for name, child := range n.children {
+		events = append(events, child.sweep(childPath(path, name), now)...)
+	}
+	return events
+}
+
+// deleteEvents returns a delete event for every key in the namespace (whose
+// path is given) and its children.
+func (n *namespace) deleteEvents(path []string) []store.StoreEvent {
+	var events []store.StoreEvent
+	for key := range n.data {
+		events = append(events, store.StoreEvent{Type: store.EventDelete, Namespace: path, Key: key})
+	}
+	for name, child := range n.children {
+		events = append(events, child.deleteEvents(childPath(path, name))...)
+	}
+	return events
+}
+
+// childPath returns a copy of path with name appended.
+func childPath(path []string, name string) []string {
+	child := make([]string, len(path), len(path)+1)
+	copy(child, path)
+	return append(child, name)
+}
+
+// isEmpty returns true if the namespace and all of its children have no
+// keys that have not expired.
+func (n *namespace) isEmpty(now time.Time) bool {
+	for key := range n.data {
+		if _, ok := n.get(key, now); ok {
+			return false
+		}
+	}
+	for _, child := range n.children {
+		if !child.isEmpty(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot copies the namespace and its non-empty children leaving out any
+// expired keys.
+func (n *namespace) snapshot(now time.Time) *Snapshot {
+	snapshot := &Snapshot{}
+	for key := range n.data {
+		val, ok := n.get(key, now)
+		if !ok {
+			continue
+		}
+		if snapshot.Data == nil {
+			snapshot.Data = make(map[string]string)
+		}
+		snapshot.Data[key] = val
+		if expires, ok := n.expires[key]; ok {
+			if snapshot.Expires == nil {
+				snapshot.Expires = make(map[string]time.Time)
+			}
+			snapshot.Expires[key] = expires
+		}
+	}
+	for name, child := range n.children {
+		if child.isEmpty(now) {
+			continue
+		}
+		if snapshot.Namespaces == nil {
+			snapshot.Namespaces = make(map[string]*Snapshot)
+		}
+		snapshot.Namespaces[name] = child.snapshot(now)
+	}
+	return snapshot
+}
+
+// restore returns a namespace holding a copy of the snapshot's data.
+func restore(snapshot *Snapshot) *namespace {
+	n := newNamespace()
+	if snapshot == nil {
+		return n
+	}
+	for key, val := range snapshot.Data {
+		n.data[key] = val
+	}
+	for key, expires := range snapshot.Expires {
+		if _, ok := n.data[key]; ok {
+			n.expires[key] = expires
+		}
+	}
+	for name, child := range snapshot.Namespaces {
+		n.children[name] = restore(child)
+	}
+	return n
+}
+
+// lookup returns the store's namespace or nil if it does not exist and create
+// is false. The mutex should be held (for writing if create is true) before
+// calling this method.
+func (s *MemoryStore) lookup(create bool) *namespace {
+	n := s.root
+	for _, name := range s.path {
+		child, exists := n.children[name]
+		if !exists {
+			if !create {
+				return nil
+			}
+			child = newNamespace()
+			n.children[name] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := s.lookup(false)
+	if n == nil {
+		return "", false, nil
+	}
+	val, ok := n.get(key, time.Now())
+	return val, ok, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, val string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.lookup(true)
+	n.data[key] = val
+	delete(n.expires, key)
+	s.publish(store.EventSet, key, val)
+	return nil
+}
+
+// SetWithTTL sets a key which is treated as missing once the TTL has elapsed
+// and is removed by the next Sweep after that.
+func (s *MemoryStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return store.ErrInvalidTTL
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.lookup(true)
+	n.data[key] = val
+	n.expires[key] = time.Now().Add(ttl)
+	s.publish(store.EventSet, key, val)
+	return nil
+}
+
+// Expires returns the time at which a key set with a TTL expires or the zero
+// time if the key does not exist or has no TTL.
+func (s *MemoryStore) Expires(ctx context.Context, key string) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := s.lookup(false)
+	if n == nil {
+		return time.Time{}, nil
+	}
+	if _, exists := n.get(key, time.Now()); !exists {
+		return time.Time{}, nil
+	}
+	return n.expires[key], nil
+}
+
+// Sweep removes all expired keys from this store and its namespaces and
+// sends an expire event for each of them.
+func (s *MemoryStore) Sweep(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := s.lookup(false); n != nil {
+		s.hub.Publish(n.sweep(s.path, time.Now())...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := s.lookup(false); n != nil {
+		if _, exists := n.data[key]; exists {
+			event := n.removeEvent(key, time.Now())
+			n.remove(key)
+			s.publish(event, key, "")
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.lookup(true)
+	val, exists := n.get(key, time.Now())
+	if !exists {
+		// an expired key starts over without its TTL
+		n.remove(key)
+		val = "0"
+	}
+	current, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, store.ErrNotInteger
+	}
+	current += delta
+	n.data[key] = strconv.FormatInt(current, 10)
+	s.publish(store.EventSet, key, n.data[key])
+	return current, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.lookup(false)
+	if n == nil {
+		return false, nil
+	}
+	val, exists := n.get(key, time.Now())
+	if !exists || val != old {
+		return false, nil
+	}
+	n.data[key] = new
+	delete(n.expires, key)
+	s.publish(store.EventSet, key, new)
+	return true, nil
+}
+
+// Update holds the store's lock while fn runs and buffers fn's writes until
+// it returns successfully.
+func (s *MemoryStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := &memoryTx{
+		store:  s,
+		now:    time.Now(),
+		writes: make(map[string]*string),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.order) == 0 {
+		return nil
+	}
+	n := s.lookup(true)
+	// writes are applied in the order they were made so watchers see the
+	// same events as they would from the other adapters
+	for _, w := range tx.order {
+		key, val := w.key, w.val
+		if val == nil {
+			if _, exists := n.data[key]; exists {
+				event := n.removeEvent(key, tx.now)
+				n.remove(key)
+				s.publish(event, key, "")
+			}
+		} else {
+			n.data[key] = *val
+			delete(n.expires, key)
+			s.publish(store.EventSet, key, *val)
+		}
+	}
+	return nil
+}
+
+// memoryTx implements store.Tx for MemoryStore.Update. The latest write to
+// each key is kept in a map where deleted keys have nil values and every write
+// is also kept in order so they can be applied as they were made.
+type memoryTx struct {
+	store  *MemoryStore
+	now    time.Time
+	writes map[string]*string
+	order  []memoryWrite
+}
+
+// memoryWrite is a single Set (or Delete if val is nil) made in a memoryTx.
+type memoryWrite struct {
+	key string
+	val *string
+}
+
+func (tx *memoryTx) Get(key string) (string, bool, error) {
+	if val, written := tx.writes[key]; written {
+		if val == nil {
+			return "", false, nil
+		}
+		return *val, true, nil
+	}
+	n := tx.store.lookup(false)
+	if n == nil {
+		return "", false, nil
+	}
+	val, exists := n.get(key, tx.now)
+	return val, exists, nil
+}
+
+func (tx *memoryTx) Set(key, val string) error {
+	tx.writes[key] = &val
+	tx.order = append(tx.order, memoryWrite{key: key, val: &val})
+	return nil
+}
+
+func (tx *memoryTx) Delete(key string) error {
+	tx.writes[key] = nil
+	tx.order = append(tx.order, memoryWrite{key: key})
+	return nil
+}
+
+// All returns a copy of the stored data so it may be used without holding
+// the store's lock.
+func (s *MemoryStore) All(ctx context.Context) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	all := make(map[string]string)
+	if n := s.lookup(false); n != nil {
+		now := time.Now()
+		for key := range n.data {
+			if val, ok := n.get(key, now); ok {
+				all[key] = val
+			}
+		}
+	}
+	return all, nil
+}
+
+func (s *MemoryStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys(prefix), nil
+}
+
+// Scan copies the matching keys and values before calling fn so the lock is
+// not held while fn runs.
+func (s *MemoryStore) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.RLock()
+	keys := s.keys(prefix)
+	values := make([]string, len(keys))
+	if n := s.lookup(false); n != nil {
+		for i, key := range keys {
+			values[i] = n.data[key]
+		}
+	}
+	s.mutex.RUnlock()
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(key, values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// keys returns the sorted keys with the given prefix. The mutex should be
+// held before calling this method.
+func (s *MemoryStore) keys(prefix string) []string {
+	keys := []string{}
+	n := s.lookup(false)
+	if n == nil {
+		return keys
+	}
+	now := time.Now()
+	for key := range n.data {
+		if _, ok := n.get(key, now); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns a copy of the data in this store's namespace and the
+// namespaces nested in it. Keys that have expired are left out.
+func (s *MemoryStore) Snapshot() *Snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := s.lookup(false)
+	if n == nil {
+		return &Snapshot{}
+	}
+	return n.snapshot(time.Now())
+}
+
+// Namespace returns an adapter for the given namespace. The namespace is not
+// created until something is written to it.
+func (s *MemoryStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	return &MemoryStore{
+		mutex: s.mutex,
+		root:  s.root,
+		path:  childPath(s.path, name),
+		hub:   s.hub,
+	}
+}
+
+// Namespaces returns the sorted names of all namespaces that contain keys
+// which have not expired.
+func (s *MemoryStore) Namespaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := []string{}
+	now := time.Now()
+	if n := s.lookup(false); n != nil {
+		for name, child := range n.children {
+			if !child.isEmpty(now) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStore) DeleteNamespace(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if name == "" {
+		return store.ErrInvalidNamespace
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := s.lookup(false); n != nil {
+		if child, exists := n.children[name]; exists {
+			delete(n.children, name)
+			s.hub.Publish(child.deleteEvents(childPath(s.path, name))...)
+		}
+	}
+	return nil
 }
 
-func (s *MemoryStore) Delete(key string) {
-	s.Lock()
-	defer s.Unlock()
-	delete(s.data, key)
+// Watch returns a channel of changes to keys with the given prefix in this
+// store's namespace. See store.Watcher.
+func (s *MemoryStore) Watch(ctx context.Context, prefix string) <-chan store.StoreEvent {
+	return s.hub.Watch(ctx, s.path, prefix)
 }
 
-func (s *MemoryStore) All() map[string]string {
-	s.RLock()
-	defer s.RUnlock()
-	return s.data
+// publish sends an event for a key in this store's namespace. The mutex
+// should be held before calling this method.
+func (s *MemoryStore) publish(t store.EventType, key, val string) {
+	s.hub.Publish(store.StoreEvent{Type: t, Namespace: s.path, Key: key, Value: val})
 }
@@ -0,0 +1,620 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+const (
+	// AdapterName is the redis store's registered adapter name for the
+	// victor framework.
+	AdapterName = "redis"
+
+	// dialTimeout limits how long connecting to the server may take.
+	dialTimeout = 5 * time.Second
+
+	// defaultTimeout limits how long sending a command and reading its reply
+	// may take if no timeout is configured.
+	defaultTimeout = 5 * time.Second
+
+	// maxIdleConns is the number of connections kept open between commands.
+	maxIdleConns = 4
+
+	// scanBatchSize is the number of keys requested per SCAN and read per
+	// MGET by Scan.
+	scanBatchSize = 100
+
+	// maxTxAttempts is the number of times Update runs its function before
+	// giving up when other clients keep changing the keys it reads.
+	maxTxAttempts = 10
+
+	// addressEnvVar is the environment variable that the server's address is
+	// read from if the robot has no store config.
+	addressEnvVar = "VICTOR_REDIS_ADDRESS"
+
+	// namespaceSeparator separates the robot's name and the names in a
+	// namespace's path. keySeparator separates that path from a key. Both are
+	// escaped within names by nameEscaper.
+	namespaceSeparator = "/"
+	keySeparator       = ":"
+)
+
+var (
+	// nameEscaper escapes the robot's name and namespace names so they can
+	// be joined with the separators without becoming ambiguous.
+	nameEscaper = strings.NewReplacer("%", "%25", namespaceSeparator, "%2F", keySeparator, "%3A")
+
+	// nameUnescaper reverses nameEscaper.
+	nameUnescaper = strings.NewReplacer("%2F", namespaceSeparator, "%3A", keySeparator, "%25", "%")
+
+	// globEscaper escapes the characters that are special in the patterns
+	// given to SCAN's MATCH option.
+	globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+)
+
+func init() {
+	store.Register(AdapterName, func(r store.Robot) (store.ContextAdapter, error) {
+		var config Config
+		storeConfig, configSet := r.StoreConfig()
+		if configSet {
+			var ok bool
+			config, ok = storeConfig.(Config)
+			if !ok {
+				return nil, &store.ConfigError{
+					Adapter: AdapterName,
+					Reason:  fmt.Sprintf("the bot's store config must implement the Config interface, got %T", storeConfig),
+				}
+			}
+		} else {
+			config = NewConfig(os.Getenv(addressEnvVar), "", 0, 0)
+		}
+		if config.Address() == "" {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "a server address must be set in the store config or " + addressEnvVar,
+			}
+		}
+		return newRedisStore(config, r.Name())
+	})
+}
+
+// Config provides the redis adapter with the server to connect to.
+type Config interface {
+	// Address returns the server's "host:port".
+	Address() string
+	// Password returns the password sent with AUTH or an empty string if the
+	// server does not require one.
+	Password() string
+	// DB returns the database number sent with SELECT.
+	DB() int
+	// Timeout returns how long sending a command and reading its reply may
+	// take when the command's context has no earlier deadline.
+	Timeout() time.Duration
+}
+
+// configImpl implements the Config interface.
+type configImpl struct {
+	address,
+	password string
+	db      int
+	timeout time.Duration
+}
+
+// NewConfig returns a new redis configuration instance. An empty password
+// skips authentication and a zero timeout allows each command five seconds.
+func NewConfig(address, password string, db int, timeout time.Duration) configImpl {
+	return configImpl{address: address, password: password, db: db, timeout: timeout}
+}
+
+func (c configImpl) Address() string {
+	return c.address
+}
+
+func (c configImpl) Password() string {
+	return c.password
+}
+
+func (c configImpl) DB() int {
+	return c.db
+}
+
+func (c configImpl) Timeout() time.Duration {
+	return c.timeout
+}
+
+// newRedisStore connects to the server described by the given config and
+// returns a store whose keys are prefixed with the given robot name.
+func newRedisStore(config Config, robotName string) (*RedisStore, error) {
+	p := &pool{config: config, mutex: &sync.Mutex{}}
+	c, err := p.get(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("redisstore: error connecting to %q: %s", config.Address(), err)
+	}
+	_, err = c.do(context.Background(), "PING")
+	p.put(c, err)
+	if err != nil {
+		return nil, fmt.Errorf("redisstore: error connecting to %q: %s", config.Address(), err)
+	}
+	return &RedisStore{
+		path: nameEscaper.Replace(robotName),
+		pool: p,
+	}, nil
+}
+
+// RedisStore keeps every key in a redis server so that several robots can
+// share their state. Keys are stored as "<robot>:<key>" and keys in
+// namespaces as "<robot>/<namespace>/<nested namespace>:<key>" with any "%",
+// "/" or ":" in the robot's or namespaces' names escaped as in URLs. Robots
+// with different names can therefore share a server without their keys
+// colliding.
+//
+// TTLs are set with the server's native expiry so no sweeping is needed.
+type RedisStore struct {
+	path string
+	pool *pool
+}
+
+// Close closes the store's connections. The robot calls this when it is
+// stopped. Every namespace shares the connections so this closes them as
+// well.
+func (s *RedisStore) Close() error {
+	return s.pool.close()
+}
+
+// do runs a single command on one of the pool's connections.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := s.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, args...)
+	s.pool.put(c, err)
+	return reply, err
+}
+
+// key returns the name of the server key that holds the given key.
+func (s *RedisStore) key(key string) string {
+	return s.path + keySeparator + key
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	reply, err := s.do(ctx, "GET", s.key(key))
+	if err == errNil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("redisstore: error getting %q: %s", key, err)
+	}
+	return reply.(string), true, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, val string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.do(ctx, "SET", s.key(key), val); err != nil {
+		return fmt.Errorf("redisstore: error setting %q: %s", key, err)
+	}
+	return nil
+}
+
+// SetWithTTL sets the key with the server's PX option. TTLs are rounded up
+// to the millisecond.
+func (s *RedisStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return store.ErrInvalidTTL
+	}
+	ms := (ttl + time.Millisecond - 1) / time.Millisecond
+	if _, err := s.do(ctx, "SET", s.key(key), val, "PX", strconv.FormatInt(int64(ms), 10)); err != nil {
+		return fmt.Errorf("redisstore: error setting %q: %s", key, err)
+	}
+	return nil
+}
+
+// Expires returns the key's expiry time calculated from the server's PTTL of
+// the key or the zero time if the key does not exist or has no TTL.
+func (s *RedisStore) Expires(ctx context.Context, key string) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	reply, err := s.do(ctx, "PTTL", s.key(key))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("redisstore: error getting expiry of %q: %s", key, err)
+	}
+	// negative replies mean the key does not exist or has no TTL
+	ms, ok := reply.(int64)
+	if !ok || ms < 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond), nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.do(ctx, "DEL", s.key(key)); err != nil {
+		return fmt.Errorf("redisstore: error deleting %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	reply, err := s.do(ctx, "INCRBY", s.key(key), strconv.FormatInt(delta, 10))
+	if _, ok := err.(serverError); ok && strings.Contains(err.Error(), "not an integer") {
+		return 0, store.ErrNotInteger
+	} else if err != nil {
+		return 0, fmt.Errorf("redisstore: error incrementing %q: %s", key, err)
+	}
+	return reply.(int64), nil
+}
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	swapped := false
+	err := s.Update(ctx, func(tx store.Tx) error {
+		val, exists, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		swapped = exists && val == old
+		if !swapped {
+			return nil
+		}
+		return tx.Set(key, new)
+	})
+	if err != nil {
+		return false, fmt.Errorf("redisstore: error swapping %q: %s", key, err)
+	}
+	return swapped, nil
+}
+
+// Update runs fn with optimistic locking: every key that fn reads is WATCHed
+// and its writes are sent in a MULTI/EXEC block. If another client changes a
+// watched key before the block runs then fn is run again, so fn may be called
+// more than once and should not have side effects outside of the
+// transaction.
+func (s *RedisStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c, err := s.pool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("redisstore: error updating: %s", err)
+	}
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		tx := &redisTx{store: s, conn: c, ctx: ctx, writes: make(map[string]*string)}
+		committed, err := tx.run(fn)
+		if committed || err != nil || tx.broken != nil {
+			s.pool.put(c, tx.broken)
+			return err
+		}
+	}
+	s.pool.put(c, nil)
+	return fmt.Errorf("redisstore: transaction conflicted %d times", maxTxAttempts)
+}
+
+// redisTx implements store.Tx by watching the keys it reads and buffering
+// its writes until fn returns.
+type redisTx struct {
+	store  *RedisStore
+	conn   *conn
+	ctx    context.Context
+	writes map[string]*string
+	order  []string
+	broken error
+}
+
+// run calls fn and commits its writes. This returns false without an error
+// if the transaction must be retried.
+func (t *redisTx) run(fn func(store.Tx) error) (bool, error) {
+	if err := fn(t); err != nil {
+		t.do("UNWATCH")
+		return false, err
+	}
+	if len(t.order) == 0 {
+		_, err := t.do("UNWATCH")
+		return true, err
+	}
+	if _, err := t.do("MULTI"); err != nil {
+		return false, err
+	}
+	for _, key := range t.order {
+		args := []string{"DEL", t.store.key(key)}
+		if val := t.writes[key]; val != nil {
+			args = []string{"SET", t.store.key(key), *val}
+		}
+		if _, err := t.do(args...); err != nil {
+			t.do("DISCARD")
+			return false, err
+		}
+	}
+	_, err := t.do("EXEC")
+	if err == errNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// do runs a command on the transaction's connection and remembers whether
+// the connection is still usable.
+func (t *redisTx) do(args ...string) (interface{}, error) {
+	reply, err := t.conn.do(t.ctx, args...)
+	if !usable(err) && t.broken == nil {
+		t.broken = err
+	}
+	return reply, err
+}
+
+func (t *redisTx) Get(key string) (string, bool, error) {
+	if val, written := t.writes[key]; written {
+		if val == nil {
+			return "", false, nil
+		}
+		return *val, true, nil
+	}
+	if _, err := t.do("WATCH", t.store.key(key)); err != nil {
+		return "", false, err
+	}
+	reply, err := t.do("GET", t.store.key(key))
+	if err == errNil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return reply.(string), true, nil
+}
+
+func (t *redisTx) Set(key, val string) error {
+	t.write(key, &val)
+	return nil
+}
+
+func (t *redisTx) Delete(key string) error {
+	t.write(key, nil)
+	return nil
+}
+
+// write buffers a write (or a delete if val is nil) in the order in which
+// keys are first written.
+func (t *redisTx) write(key string, val *string) {
+	if _, written := t.writes[key]; !written {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = val
+}
+
+func (s *RedisStore) All(ctx context.Context) (map[string]string, error) {
+	all := make(map[string]string)
+	err := s.Scan(ctx, "", func(key, value string) bool {
+		all[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (s *RedisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	names, err := s.scanNames(ctx, globEscaper.Replace(s.key(prefix))+"*")
+	if err != nil {
+		return nil, fmt.Errorf("redisstore: error scanning keys with prefix %q: %s", prefix, err)
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = name[len(s.key("")):]
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Scan lists the matching keys and then reads their values with MGET in
+// batches of scanBatchSize so fn is free to write to the store. Keys that
+// are deleted or expire before their batch is read are skipped.
+func (s *RedisStore) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	keys, err := s.Keys(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += scanBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := keys[start:]
+		if len(batch) > scanBatchSize {
+			batch = batch[:scanBatchSize]
+		}
+		args := []string{"MGET"}
+		for _, key := range batch {
+			args = append(args, s.key(key))
+		}
+		reply, err := s.do(ctx, args...)
+		if err != nil {
+			return fmt.Errorf("redisstore: error scanning keys with prefix %q: %s", prefix, err)
+		}
+		for i, value := range reply.([]interface{}) {
+			if value, ok := value.(string); ok && !fn(batch[i], value) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// scanNames returns the name of every server key matching the given pattern.
+func (s *RedisStore) scanNames(ctx context.Context, pattern string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(scanBatchSize))
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, name := range batch {
+			// SCAN may return a key more than once
+			if name, ok := name.(string); ok && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return names, nil
+		}
+	}
+}
+
+// Namespace returns an adapter for the given namespace nested in this
+// store's namespace. Namespaces only exist while they have keys.
+func (s *RedisStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	return &RedisStore{
+		path: s.child(name),
+		pool: s.pool,
+	}
+}
+
+func (s *RedisStore) Namespaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prefix := s.child("")
+	names, err := s.scanNames(ctx, globEscaper.Replace(prefix)+"*")
+	if err != nil {
+		return nil, fmt.Errorf("redisstore: error listing namespaces: %s", err)
+	}
+	seen := make(map[string]bool)
+	namespaces := []string{}
+	for _, name := range names {
+		name = name[len(prefix):]
+		if end := strings.IndexAny(name, namespaceSeparator+keySeparator); end >= 0 {
+			name = name[:end]
+		}
+		if name = nameUnescaper.Replace(name); !seen[name] {
+			seen[name] = true
+			namespaces = append(namespaces, name)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func (s *RedisStore) DeleteNamespace(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if name == "" {
+		return store.ErrInvalidNamespace
+	}
+	path := globEscaper.Replace(s.child(name))
+	for _, pattern := range []string{path + keySeparator + "*", path + namespaceSeparator + "*"} {
+		names, err := s.scanNames(ctx, pattern)
+		if err != nil {
+			return fmt.Errorf("redisstore: error deleting namespace %q: %s", name, err)
+		}
+		for start := 0; start < len(names); start += scanBatchSize {
+			end := start + scanBatchSize
+			if end > len(names) {
+				end = len(names)
+			}
+			if _, err := s.do(ctx, append([]string{"DEL"}, names[start:end]...)...); err != nil {
+				return fmt.Errorf("redisstore: error deleting namespace %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// child returns the path of the given name nested in this store's
+// namespace.
+func (s *RedisStore) child(name string) string {
+	return s.path + namespaceSeparator + nameEscaper.Replace(name)
+}
+
+// pool keeps a few idle connections so commands from concurrent handlers do
+// not wait on each other. Connections are dialed as they are needed.
+type pool struct {
+	config Config
+	mutex  *sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// get returns an idle connection or dials a new one.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, errClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return c, nil
+	}
+	p.mutex.Unlock()
+	return dial(ctx, p.config)
+}
+
+// put returns a connection to the pool after a command returned the given
+// error. Connections are closed instead if the error means they are no
+// longer usable or there are already enough idle connections.
+func (p *pool) put(c *conn, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if usable(err) && !p.closed && len(p.idle) < maxIdleConns {
+		p.idle = append(p.idle, c)
+		return
+	}
+	c.close()
+}
+
+// close closes every idle connection. Connections that are in use are closed
+// when they are returned.
+func (p *pool) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	var err error
+	for _, c := range p.idle {
+		if closeErr := c.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	p.idle = nil
+	return err
+}
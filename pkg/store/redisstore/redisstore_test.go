@@ -0,0 +1,230 @@
+package redisstore
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+)
+
+var (
+	server *fakeServer
+	db     *RedisStore
+)
+
+func setup() {
+	server = newFakeServer("")
+	var err error
+	db, err = newRedisStore(NewConfig(server.Addr(), "", 0, 0), "victor")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func teardown() {
+	db.Close()
+	server.Close()
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+		setup()
+		return db, teardown
+	})
+}
+
+func TestRobotName(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	other, err := newRedisStore(NewConfig(server.Addr(), "", 0, 0), "other:bot")
+	if err != nil {
+		t.Fatal("Unexpected error connecting a second robot: ", err)
+	}
+	db.Set(ctx, "a", "victor")
+	other.Set(ctx, "a", "other")
+
+	if val, _, _ := db.Get(ctx, "a"); val != "victor" {
+		t.Error("Expected robots with different names not to share keys, got: ", val)
+	}
+	server.mutex.Lock()
+	_, rootKey := server.data["victor:a"]
+	_, escapedKey := server.data["other%3Abot:a"]
+	server.mutex.Unlock()
+	if !rootKey || !escapedKey {
+		t.Error("Expected keys to be prefixed with the robot's escaped name")
+	}
+	other.Close()
+
+	teardown()
+}
+
+func TestNamespaceEscaping(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Namespace("a/b").Set(ctx, "k", "escaped")
+	db.Namespace("a").Namespace("b").Set(ctx, "k", "nested")
+	db.Namespace("a*").Set(ctx, "k", "glob")
+	db.Set(ctx, "a:k", "root")
+
+	if val, _, _ := db.Namespace("a/b").Get(ctx, "k"); val != "escaped" {
+		t.Error("Expected names containing the separator not to collide, got: ", val)
+	}
+	names, _ := db.Namespaces(ctx)
+	if len(names) != 3 || names[0] != "a" || names[1] != "a*" || names[2] != "a/b" {
+		t.Error("Expected to list every namespace, got: ", names)
+	}
+	db.DeleteNamespace(ctx, "a")
+	if val, _, _ := db.Namespace("a/b").Get(ctx, "k"); val != "escaped" {
+		t.Error("Expected deleting a namespace not to affect similarly named ones, got: ", val)
+	}
+	if val, _, _ := db.Namespace("a*").Get(ctx, "k"); val != "glob" {
+		t.Error("Expected names with pattern characters to be matched literally, got: ", val)
+	}
+	if val, _, _ := db.Get(ctx, "a:k"); val != "root" {
+		t.Error("Expected root keys containing the key separator to be kept, got: ", val)
+	}
+
+	teardown()
+}
+
+func TestStoreConfig(t *testing.T) {
+	setup()
+
+	initFunc := storetest.Load(t, AdapterName)
+
+	s, err := initFunc(storetest.Robot{Config: NewConfig(server.Addr(), "", 0, 0)})
+	if err != nil {
+		t.Fatal("Unexpected error connecting configured store: ", err)
+	}
+	s.(*RedisStore).Close()
+
+	// falls back to the environment variable without a config
+	os.Setenv(addressEnvVar, server.Addr())
+	s, err = initFunc(storetest.Robot{})
+	os.Unsetenv(addressEnvVar)
+	if err != nil {
+		t.Fatal("Unexpected error connecting store from environment: ", err)
+	}
+	s.(*RedisStore).Close()
+
+	_, err = initFunc(storetest.Robot{})
+	if _, ok := err.(*store.ConfigError); !ok {
+		t.Error("Expected a config error without an address, got: ", err)
+	}
+	storetest.CheckConfigType(t, initFunc)
+
+	teardown()
+	if _, err := initFunc(storetest.Robot{Config: NewConfig(server.Addr(), "", 0, 0)}); err == nil {
+		t.Error("Expected connecting to a stopped server to fail")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server := newFakeServer("secret")
+	defer server.Close()
+
+	if _, err := newRedisStore(NewConfig(server.Addr(), "wrong", 0, 0), "victor"); err == nil {
+		t.Error("Expected a wrong password to fail")
+	}
+	s, err := newRedisStore(NewConfig(server.Addr(), "secret", 2, 0), "victor")
+	if err != nil {
+		t.Fatal("Unexpected error authenticating: ", err)
+	}
+	if err := s.Set(context.Background(), "a", "b"); err != nil {
+		t.Error("Unexpected error using an authenticated store: ", err)
+	}
+	commands := server.Commands()
+	if len(commands) < 3 || commands[1] != "AUTH" || commands[2] != "SELECT" {
+		t.Error("Expected to authenticate and select the database, got: ", commands)
+	}
+	s.Close()
+}
+
+func TestTimeout(t *testing.T) {
+	server := newFakeServer("")
+	defer server.Close()
+	s, err := newRedisStore(NewConfig(server.Addr(), "", 0, 20*time.Millisecond), "victor")
+	if err != nil {
+		t.Fatal("Unexpected error connecting: ", err)
+	}
+	defer s.Close()
+	slow, err := newRedisStore(NewConfig(server.Addr(), "", 0, time.Hour), "victor")
+	if err != nil {
+		t.Fatal("Unexpected error connecting: ", err)
+	}
+	defer slow.Close()
+	server.Stall()
+
+	start := time.Now()
+	if _, _, err := s.Get(context.Background(), "a"); err == nil {
+		t.Error("Expected a command to a stalled server to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the configured timeout to be used, took: ", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if _, _, err := slow.Get(ctx, "a"); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Error("Expected cancelling the context to stop the command, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected the command to stop once cancelled, took: ", elapsed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	setup()
+
+	teardown()
+	if err := db.Set(context.Background(), "a", "b"); err == nil {
+		t.Error("Expected writing to a closed store to fail")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.SetWithTTL(ctx, "a", "b", 20*time.Millisecond)
+	if ttl := server.TTL("victor:a"); ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Error("Expected the TTL to be set on the server, got: ", ttl)
+	}
+
+	teardown()
+}
+
+func TestUpdateConflict(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Set(ctx, "a", "1")
+	calls := 0
+	err := db.Update(ctx, func(tx store.Tx) error {
+		calls++
+		val, _, _ := tx.Get("a")
+		if calls == 1 {
+			// another replica changes the key after it was read
+			db.Set(ctx, "a", "5")
+		}
+		return tx.Set("b", val)
+	})
+	if err != nil {
+		t.Error("Unexpected error updating: ", err)
+	}
+	if calls != 2 {
+		t.Error("Expected fn to be run again after a conflict, got calls: ", calls)
+	}
+	if val, _, _ := db.Get(ctx, "b"); val != "5" {
+		t.Error("Expected the retried transaction to see the new value, got: ", val)
+	}
+
+	teardown()
+}
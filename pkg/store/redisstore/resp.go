@@ -0,0 +1,192 @@
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	// errNil is returned by conn.do when the server replies with a nil bulk
+	// string or array.
+	errNil = errors.New("nil reply")
+
+	// errClosed is returned when a command is run after the store is closed.
+	errClosed = errors.New("store is closed")
+)
+
+// serverError is an error reply sent by the server.
+type serverError string
+
+func (e serverError) Error() string {
+	return string(e)
+}
+
+// conn is a single connection to a server that speaks the redis
+// serialization protocol (RESP). It is not safe for concurrent use.
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+// dial connects to the given address and authenticates and selects a
+// database if needed.
+func dial(ctx context.Context, config Config) (*conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", config.Address())
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout()
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c := &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		timeout: timeout,
+	}
+	if config.Password() != "" {
+		if _, err := c.do(ctx, "AUTH", config.Password()); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if config.DB() != 0 {
+		if _, err := c.do(ctx, "SELECT", strconv.Itoa(config.DB())); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// close closes the underlying network connection.
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
+
+// do sends a command and returns its reply. Replies are returned as a
+// string (simple and bulk strings), int64 (integers), or []interface{}
+// (arrays). Error replies are returned as a serverError and nil replies as
+// errNil. Any other error means the connection is no longer usable.
+//
+// The command must finish within the connection's timeout or the context's
+// deadline, whichever is sooner. The connection is closed if the context is
+// done first so a stalled server cannot block the caller.
+func (c *conn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(c.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := c.netConn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if done := ctx.Done(); done != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-done:
+				c.netConn.Close()
+			case <-finished:
+			}
+		}()
+	}
+	reply, err := c.send(args)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+// send writes a command and reads its reply.
+func (c *conn) send(args []string) (interface{}, error) {
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// usable returns true if a connection can still be used after a command
+// returned the given error.
+func usable(err error) bool {
+	_, isServerError := err.(serverError)
+	return err == nil || err == errNil || isServerError
+}
+
+// readReply reads a single RESP value.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, serverError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readReply(r)
+			if err != nil && err != errNil {
+				if _, ok := err.(serverError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// readLine reads a line terminated by "\r\n" and returns it without the
+// terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,379 @@
+package redisstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeServer is an in-process stand-in for a redis server. It supports just
+// the commands the adapter uses so the tests do not need a real server.
+type fakeServer struct {
+	listener net.Listener
+	password string
+	mutex    sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+	commands []string
+	stalled  bool
+}
+
+// newFakeServer starts a server on a random local port which requires the
+// given password (if it is not empty).
+func newFakeServer(password string) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &fakeServer{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		expires:  make(map[string]time.Time),
+		versions: make(map[string]int),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) Close() {
+	s.listener.Close()
+}
+
+// Commands returns the name of every command the server has received.
+func (s *fakeServer) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Stall makes the server stop replying to commands.
+func (s *fakeServer) Stall() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stalled = true
+}
+
+// TTL returns the time left before the given server key expires.
+func (s *fakeServer) TTL(name string) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if at, ok := s.expires[name]; ok {
+		return at.Sub(time.Now())
+	}
+	return 0
+}
+
+func (s *fakeServer) serve() {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(netConn)
+	}
+}
+
+// fakeSession is the state of a single client connection.
+type fakeSession struct {
+	authed  bool
+	watched map[string]int
+	multi   bool
+	queued  [][]string
+}
+
+func (s *fakeServer) handle(netConn net.Conn) {
+	defer netConn.Close()
+	r := bufio.NewReader(netConn)
+	w := bufio.NewWriter(netConn)
+	session := &fakeSession{authed: s.password == "", watched: make(map[string]int)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, strings.ToUpper(args[0]))
+		stalled := s.stalled
+		s.mutex.Unlock()
+		if stalled {
+			continue
+		}
+		writeValue(w, s.session(session, args))
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// session handles the commands that change a connection's state and passes
+// the rest to exec.
+func (s *fakeServer) session(session *fakeSession, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	if name == "AUTH" {
+		if len(args) != 2 || args[1] != s.password {
+			return serverError("WRONGPASS invalid password")
+		}
+		session.authed = true
+		return "OK"
+	}
+	if !session.authed {
+		return serverError("NOAUTH Authentication required.")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch name {
+	case "WATCH":
+		for _, key := range args[1:] {
+			s.expire(key)
+			session.watched[key] = s.versions[key]
+		}
+		return "OK"
+	case "UNWATCH":
+		session.watched = make(map[string]int)
+		return "OK"
+	case "MULTI":
+		session.multi = true
+		return "OK"
+	case "DISCARD":
+		session.multi = false
+		session.queued = nil
+		session.watched = make(map[string]int)
+		return "OK"
+	case "EXEC":
+		queued, watched := session.queued, session.watched
+		session.multi = false
+		session.queued = nil
+		session.watched = make(map[string]int)
+		for key, version := range watched {
+			s.expire(key)
+			if s.versions[key] != version {
+				return nil
+			}
+		}
+		replies := []interface{}{}
+		for _, args := range queued {
+			replies = append(replies, s.exec(args))
+		}
+		return replies
+	}
+	if session.multi {
+		session.queued = append(session.queued, args)
+		return "QUEUED"
+	}
+	return s.exec(args)
+}
+
+// exec runs a data command. The mutex should be held before calling this
+// method.
+func (s *fakeServer) exec(args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "GET":
+		s.expire(args[1])
+		if val, ok := s.data[args[1]]; ok {
+			return &val
+		}
+		return nil
+	case "MGET":
+		values := []interface{}{}
+		for _, key := range args[1:] {
+			s.expire(key)
+			if val, ok := s.data[key]; ok {
+				values = append(values, &val)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "SET":
+		s.write(args[1], args[2])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, err := strconv.Atoi(args[4])
+			if err != nil || ms <= 0 {
+				return serverError("ERR invalid expire time in 'set' command")
+			}
+			s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "OK"
+	case "DEL":
+		var deleted int64
+		for _, key := range args[1:] {
+			s.expire(key)
+			if _, ok := s.data[key]; ok {
+				s.remove(key)
+				deleted++
+			}
+		}
+		return deleted
+	case "INCRBY":
+		s.expire(args[1])
+		current, err := strconv.ParseInt(s.valueOr(args[1], "0"), 10, 64)
+		if err != nil {
+			return serverError("ERR value is not an integer or out of range")
+		}
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		current += delta
+		expires, hasTTL := s.expires[args[1]]
+		s.write(args[1], strconv.FormatInt(current, 10))
+		if hasTTL {
+			s.expires[args[1]] = expires
+		}
+		return current
+	case "PTTL":
+		s.expire(args[1])
+		if _, ok := s.data[args[1]]; !ok {
+			return int64(-2)
+		}
+		if at, ok := s.expires[args[1]]; ok {
+			return int64((at.Sub(time.Now()) + time.Millisecond - 1) / time.Millisecond)
+		}
+		return int64(-1)
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		names := []interface{}{}
+		for key := range s.data {
+			s.expire(key)
+			if _, ok := s.data[key]; ok && globMatch(pattern, key) {
+				key := key
+				names = append(names, &key)
+			}
+		}
+		cursor := "0"
+		return []interface{}{&cursor, names}
+	}
+	return serverError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+func (s *fakeServer) valueOr(key, def string) string {
+	if val, ok := s.data[key]; ok {
+		return val
+	}
+	return def
+}
+
+// write sets a key without a TTL.
+func (s *fakeServer) write(key, val string) {
+	s.data[key] = val
+	delete(s.expires, key)
+	s.versions[key]++
+}
+
+func (s *fakeServer) remove(key string) {
+	delete(s.data, key)
+	delete(s.expires, key)
+	s.versions[key]++
+}
+
+// expire removes the key if its TTL has passed.
+func (s *fakeServer) expire(key string) {
+	if at, ok := s.expires[key]; ok && !time.Now().Before(at) {
+		s.remove(key)
+	}
+}
+
+// globMatch supports the "*", "?" and "\" escapes of redis' MATCH patterns.
+func globMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid array length %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk string length %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// writeValue writes a reply. Strings are sent as simple strings, *string as
+// bulk strings, and nil as a nil bulk string.
+func writeValue(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case *string:
+		if v == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(*v), *v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case serverError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeValue(w, item)
+		}
+	}
+}
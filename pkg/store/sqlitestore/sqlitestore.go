@@ -0,0 +1,562 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	// Blank import used to register the pure Go sqlite driver
+	_ "github.com/glebarez/go-sqlite"
+)
+
+const (
+	// AdapterName is the sqlite store's registered adapter name for the
+	// victor framework.
+	AdapterName = "sqlite"
+
+	// driverName is the database/sql driver used to open the database.
+	driverName = "sqlite"
+
+	// defaultTimeout is how long to wait for another connection to release
+	// its lock on the database if no timeout is configured.
+	defaultTimeout = 5 * time.Second
+
+	// scanBatchSize is the number of rows read per query by Scan.
+	scanBatchSize = 100
+
+	// pathEnvVar is the environment variable that the database's path is read
+	// from if the robot has no store config.
+	pathEnvVar = "VICTOR_STORAGE_PATH"
+
+	// namespaceSeparator separates the names in a namespace's path. It is
+	// escaped within names by namespaceEscaper.
+	namespaceSeparator = "/"
+)
+
+var (
+	// namespaceEscaper escapes namespace names so they can be joined with
+	// namespaceSeparator without becoming ambiguous.
+	namespaceEscaper = strings.NewReplacer("%", "%25", namespaceSeparator, "%2F")
+
+	// namespaceUnescaper reverses namespaceEscaper.
+	namespaceUnescaper = strings.NewReplacer("%2F", namespaceSeparator, "%25", "%")
+)
+
+// schema creates the single table that holds every key. The root store's keys
+// have an empty namespace and expires is a unix time in nanoseconds or NULL
+// for keys without a TTL.
+const schema = `
+CREATE TABLE IF NOT EXISTS victor (
+	namespace TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	expires INTEGER,
+	PRIMARY KEY (namespace, key)
+)`
+
+func init() {
+	store.Register(AdapterName, func(r store.Robot) (store.ContextAdapter, error) {
+		var config Config
+		storeConfig, configSet := r.StoreConfig()
+		if configSet {
+			var ok bool
+			config, ok = storeConfig.(Config)
+			if !ok {
+				return nil, &store.ConfigError{
+					Adapter: AdapterName,
+					Reason:  fmt.Sprintf("the bot's store config must implement the Config interface, got %T", storeConfig),
+				}
+			}
+		} else {
+			config = NewConfig(os.Getenv(pathEnvVar), 0)
+		}
+		if config.Path() == "" {
+			return nil, &store.ConfigError{
+				Adapter: AdapterName,
+				Reason:  "a database path must be set in the store config or " + pathEnvVar,
+			}
+		}
+		return newSQLiteStore(config)
+	})
+}
+
+// Config provides the sqlite adapter with the location of its database and
+// the options used to open it.
+type Config interface {
+	// Path returns the path of the database file. The file is created if it
+	// does not exist.
+	Path() string
+	// Timeout returns how long to wait for another process to release its
+	// lock on the database.
+	Timeout() time.Duration
+}
+
+// configImpl implements the Config interface.
+type configImpl struct {
+	path    string
+	timeout time.Duration
+}
+
+// NewConfig returns a new sqlite configuration instance. A zero timeout
+// waits up to five seconds for other processes' locks.
+func NewConfig(path string, timeout time.Duration) configImpl {
+	return configImpl{path: path, timeout: timeout}
+}
+
+func (c configImpl) Path() string {
+	return c.path
+}
+
+func (c configImpl) Timeout() time.Duration {
+	return c.timeout
+}
+
+// newSQLiteStore opens the database described by the given config and
+// creates its table. The database stays open until Close is called.
+//
+// The database is opened in WAL mode so other processes (ex: the sqlite3
+// shell) can read it while the robot is running. Only one connection is
+// used so that the store's operations are serialized within the process.
+func newSQLiteStore(config Config) (*SQLiteStore, error) {
+	timeout := config.Timeout()
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	db, err := sql.Open(driverName, dsn(config.Path(), timeout))
+	if err != nil {
+		return nil, fmt.Errorf("sqlitestore: error opening %q: %s", config.Path(), err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlitestore: error setting up %q: %s", config.Path(), err)
+	}
+
+	return &SQLiteStore{DB: db}, nil
+}
+
+// dsn returns the data source name for the database at the given path. The
+// pragmas are passed in the name rather than run once so that the driver
+// applies them to every connection it opens, including one that replaces a
+// connection database/sql has discarded.
+func dsn(path string, timeout time.Duration) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", path, sep, timeout/time.Millisecond)
+}
+
+// SQLiteStore keeps every key in a single table of a sqlite database. Each
+// key's row holds the path of its namespace with the names separated by "/"
+// (and any "/" or "%" in a name escaped as in URLs).
+type SQLiteStore struct {
+	namespace string
+	DB        *sql.DB
+}
+
+// Close closes the database. The robot calls this when it is stopped. Every
+// namespace shares the database so this closes them as well.
+func (s *SQLiteStore) Close() error {
+	return s.DB.Close()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// get returns the value of a key that has not expired.
+func (s *SQLiteStore) get(ctx context.Context, q queryer, key string) (string, bool, error) {
+	var val string
+	err := q.QueryRowContext(ctx,
+		"SELECT value FROM victor WHERE namespace = ? AND key = ? AND (expires IS NULL OR expires > ?)",
+		s.namespace, key, now()).Scan(&val)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+// set saves a key with the given expiry time (nil for no TTL).
+func (s *SQLiteStore) set(ctx context.Context, q queryer, key, val string, expires interface{}) error {
+	_, err := q.ExecContext(ctx,
+		"INSERT OR REPLACE INTO victor (namespace, key, value, expires) VALUES (?, ?, ?, ?)",
+		s.namespace, key, val, expires)
+	return err
+}
+
+// remove deletes a key.
+func (s *SQLiteStore) remove(ctx context.Context, q queryer, key string) error {
+	_, err := q.ExecContext(ctx, "DELETE FROM victor WHERE namespace = ? AND key = ?", s.namespace, key)
+	return err
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	val, exists, err := s.get(ctx, s.DB, key)
+	if err != nil {
+		return "", false, fmt.Errorf("sqlitestore: error getting %q: %s", key, err)
+	}
+	return val, exists, nil
+}
+
+func (s *SQLiteStore) Set(ctx context.Context, key string, val string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.set(ctx, s.DB, key, val, nil); err != nil {
+		return fmt.Errorf("sqlitestore: error setting %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetWithTTL(ctx context.Context, key string, val string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return store.ErrInvalidTTL
+	}
+	if err := s.set(ctx, s.DB, key, val, time.Now().Add(ttl).UnixNano()); err != nil {
+		return fmt.Errorf("sqlitestore: error setting %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.remove(ctx, s.DB, key); err != nil {
+		return fmt.Errorf("sqlitestore: error deleting %q: %s", key, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var current int64
+	err := s.Update(ctx, func(tx store.Tx) error {
+		t := tx.(*sqliteTx)
+		var val string
+		var expires sql.NullInt64
+		err := t.tx.QueryRowContext(ctx,
+			"SELECT value, expires FROM victor WHERE namespace = ? AND key = ? AND (expires IS NULL OR expires > ?)",
+			s.namespace, key, now()).Scan(&val, &expires)
+		if err == sql.ErrNoRows {
+			// an expired key starts over without its TTL
+			val = "0"
+		} else if err != nil {
+			return err
+		}
+		current, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return store.ErrNotInteger
+		}
+		current += delta
+		var keepExpires interface{}
+		if expires.Valid {
+			keepExpires = expires.Int64
+		}
+		return s.set(ctx, t.tx, key, strconv.FormatInt(current, 10), keepExpires)
+	})
+	if err == store.ErrNotInteger {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("sqlitestore: error incrementing %q: %s", key, err)
+	}
+	return current, nil
+}
+
+func (s *SQLiteStore) CompareAndSwap(ctx context.Context, key, old, new string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	res, err := s.DB.ExecContext(ctx,
+		"UPDATE victor SET value = ?, expires = NULL WHERE namespace = ? AND key = ? AND value = ? AND (expires IS NULL OR expires > ?)",
+		new, s.namespace, key, old, now())
+	if err != nil {
+		return false, fmt.Errorf("sqlitestore: error swapping %q: %s", key, err)
+	}
+	swapped, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("sqlitestore: error swapping %q: %s", key, err)
+	}
+	return swapped > 0, nil
+}
+
+// Update runs fn in a sql transaction which is rolled back if fn returns an
+// error.
+func (s *SQLiteStore) Update(ctx context.Context, fn func(store.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqliteTx{store: s, tx: tx, ctx: ctx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteTx implements store.Tx on top of a sql transaction.
+type sqliteTx struct {
+	store *SQLiteStore
+	tx    *sql.Tx
+	ctx   context.Context
+}
+
+func (t *sqliteTx) Get(key string) (string, bool, error) {
+	return t.store.get(t.ctx, t.tx, key)
+}
+
+func (t *sqliteTx) Set(key, val string) error {
+	return t.store.set(t.ctx, t.tx, key, val, nil)
+}
+
+func (t *sqliteTx) Delete(key string) error {
+	return t.store.remove(t.ctx, t.tx, key)
+}
+
+func (s *SQLiteStore) All(ctx context.Context) (map[string]string, error) {
+	all := make(map[string]string)
+	err := s.Scan(ctx, "", func(key, value string) bool {
+		all[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func (s *SQLiteStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.Scan(ctx, prefix, func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Scan reads the matching rows in batches of scanBatchSize so fn is free to
+// write to the store and large tables are never loaded all at once.
+func (s *SQLiteStore) Scan(ctx context.Context, prefix string, fn func(key, value string) bool) error {
+	after := ""
+	first := true
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		query := "SELECT key, value FROM victor WHERE namespace = ? AND (expires IS NULL OR expires > ?)"
+		args := []interface{}{s.namespace, now()}
+		if first {
+			query += " AND key >= ?"
+			args = append(args, prefix)
+		} else {
+			query += " AND key > ?"
+			args = append(args, after)
+		}
+		if end, ok := prefixEnd(prefix); ok {
+			query += " AND key < ?"
+			args = append(args, end)
+		}
+		query += " ORDER BY key LIMIT ?"
+		args = append(args, scanBatchSize)
+
+		keys, values, err := s.queryPairs(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("sqlitestore: error scanning keys with prefix %q: %s", prefix, err)
+		}
+
+		for i, key := range keys {
+			if !fn(key, values[i]) {
+				return nil
+			}
+		}
+
+		if len(keys) < scanBatchSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+		first = false
+	}
+}
+
+// queryPairs runs a query that selects two text columns and returns them.
+func (s *SQLiteStore) queryPairs(ctx context.Context, query string, args ...interface{}) ([]string, []string, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var firsts, seconds []string
+	for rows.Next() {
+		var first, second string
+		if err := rows.Scan(&first, &second); err != nil {
+			return nil, nil, err
+		}
+		firsts = append(firsts, first)
+		seconds = append(seconds, second)
+	}
+	return firsts, seconds, rows.Err()
+}
+
+// Namespace returns an adapter for the given namespace nested in this
+// store's namespace. Namespaces only exist while they have keys.
+func (s *SQLiteStore) Namespace(name string) store.ContextAdapter {
+	if name == "" {
+		return store.ErrorAdapter(store.ErrInvalidNamespace)
+	}
+	return &SQLiteStore{
+		namespace: s.child(name),
+		DB:        s.DB,
+	}
+}
+
+func (s *SQLiteStore) Namespaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT DISTINCT namespace FROM victor WHERE namespace != '' AND (expires IS NULL OR expires > ?)", now())
+	if err != nil {
+		return nil, fmt.Errorf("sqlitestore: error listing namespaces: %s", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	names := []string{}
+	prefix := s.child("")
+	for rows.Next() {
+		var namespace string
+		if err := rows.Scan(&namespace); err != nil {
+			return nil, fmt.Errorf("sqlitestore: error listing namespaces: %s", err)
+		}
+		if !strings.HasPrefix(namespace, prefix) {
+			continue
+		}
+		name := strings.SplitN(namespace[len(prefix):], namespaceSeparator, 2)[0]
+		if name = namespaceUnescaper.Replace(name); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlitestore: error listing namespaces: %s", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *SQLiteStore) DeleteNamespace(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if name == "" {
+		return store.ErrInvalidNamespace
+	}
+	ns := s.Namespace(name).(*SQLiteStore)
+	query, args := ns.subtree()
+	if _, err := s.DB.ExecContext(ctx, "DELETE FROM victor WHERE "+query, args...); err != nil {
+		return fmt.Errorf("sqlitestore: error deleting namespace %q: %s", name, err)
+	}
+	return nil
+}
+
+// Expires returns the expiry time saved with a key or the zero time if the
+// key does not exist or has no TTL.
+func (s *SQLiteStore) Expires(ctx context.Context, key string) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	var expires sql.NullInt64
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT expires FROM victor WHERE namespace = ? AND key = ? AND (expires IS NULL OR expires > ?)",
+		s.namespace, key, now()).Scan(&expires)
+	if err == sql.ErrNoRows || (err == nil && !expires.Valid) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("sqlitestore: error getting expiry of %q: %s", key, err)
+	}
+	return time.Unix(0, expires.Int64), nil
+}
+
+// Sweep removes every expired key in this store's namespace and the
+// namespaces nested in it.
+func (s *SQLiteStore) Sweep(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	query, args := s.subtree()
+	args = append(args, now())
+	_, err := s.DB.ExecContext(ctx,
+		"DELETE FROM victor WHERE ("+query+") AND expires IS NOT NULL AND expires <= ?", args...)
+	if err != nil {
+		return fmt.Errorf("sqlitestore: error removing expired keys: %s", err)
+	}
+	return nil
+}
+
+// child returns the namespace path of the given name nested in this store's
+// namespace.
+func (s *SQLiteStore) child(name string) string {
+	if s.namespace == "" {
+		return namespaceEscaper.Replace(name)
+	}
+	return s.namespace + namespaceSeparator + namespaceEscaper.Replace(name)
+}
+
+// subtree returns the condition (and its arguments) which matches rows in
+// this store's namespace and every namespace nested in it.
+func (s *SQLiteStore) subtree() (string, []interface{}) {
+	if s.namespace == "" {
+		return "1", nil
+	}
+	prefix := s.namespace + namespaceSeparator
+	end, _ := prefixEnd(prefix)
+	return "namespace = ? OR (namespace >= ? AND namespace < ?)",
+		[]interface{}{s.namespace, prefix, end}
+}
+
+// prefixEnd returns the smallest string greater than every string starting
+// with prefix. The second return value is false if there is no such string
+// (ex: the prefix is empty).
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// now returns the current time in the format of the expires column.
+func now() int64 {
+	return time.Now().UnixNano()
+}
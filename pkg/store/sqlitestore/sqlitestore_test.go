@@ -0,0 +1,150 @@
+package sqlitestore
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+	"github.com/FogCreek/victor/pkg/store/storetest"
+)
+
+const (
+	DB_PATH = "test.db"
+)
+
+var db *SQLiteStore
+
+func init() {
+	os.Setenv("VICTOR_STORAGE_PATH", DB_PATH)
+}
+
+func setup() {
+	var err error
+	db, err = newSQLiteStore(NewConfig(DB_PATH, 0))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func teardown() {
+	db.Close()
+	removeDB()
+}
+
+// removeDB removes the database file and the files sqlite keeps beside it in
+// WAL mode.
+func removeDB() {
+	os.Remove(DB_PATH)
+	os.Remove(DB_PATH + "-wal")
+	os.Remove(DB_PATH + "-shm")
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (store.ContextAdapter, func()) {
+		setup()
+		return db, teardown
+	})
+}
+
+func TestStoreConfig(t *testing.T) {
+	initFunc := storetest.Load(t, AdapterName)
+
+	s, err := initFunc(storetest.Robot{Config: NewConfig(DB_PATH, time.Second)})
+	if err != nil {
+		t.Fatal("Unexpected error opening configured store: ", err)
+	}
+	if _, err := os.Stat(DB_PATH); err != nil {
+		t.Error("Expected database to be created at the configured path, got: ", err)
+	}
+	s.(*SQLiteStore).Close()
+	removeDB()
+
+	// falls back to the environment variable without a config
+	s, err = initFunc(storetest.Robot{})
+	if err != nil {
+		t.Fatal("Unexpected error opening store from environment: ", err)
+	}
+	s.(*SQLiteStore).Close()
+	removeDB()
+
+	storetest.CheckConfigType(t, initFunc)
+}
+
+func TestDSN(t *testing.T) {
+	if name := dsn("test.db", time.Second); name != "test.db?_pragma=busy_timeout(1000)&_pragma=journal_mode(WAL)" {
+		t.Error("Expected the pragmas to be set for every connection, got: ", name)
+	}
+	if name := dsn("file:test.db?cache=shared", time.Second); name != "file:test.db?cache=shared&_pragma=busy_timeout(1000)&_pragma=journal_mode(WAL)" {
+		t.Error("Expected the pragmas to be added to existing parameters, got: ", name)
+	}
+}
+
+func TestConcurrentReader(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Set(ctx, "a", "b")
+	reader, err := newSQLiteStore(NewConfig(DB_PATH, 0))
+	if err != nil {
+		t.Fatal("Expected the database to be readable while open, got: ", err)
+	}
+	if val, _, _ := reader.Get(ctx, "a"); val != "b" {
+		t.Error("Expected reader to see the store's data, got: ", val)
+	}
+	reader.Close()
+
+	teardown()
+}
+
+func TestClose(t *testing.T) {
+	setup()
+
+	teardown()
+	if err := db.Set(context.Background(), "a", "b"); err == nil {
+		t.Error("Expected writing to a closed store to fail")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.SetWithTTL(ctx, "a", "b", time.Millisecond)
+	db.Namespace("ns").SetWithTTL(ctx, "c", "d", time.Millisecond)
+	db.Set(ctx, "e", "f")
+	time.Sleep(5 * time.Millisecond)
+	if err := db.Sweep(ctx); err != nil {
+		t.Error("Unexpected error sweeping: ", err)
+	}
+	var rows int
+	db.DB.QueryRow("SELECT COUNT(*) FROM victor").Scan(&rows)
+	if rows != 1 {
+		t.Error("Expected Sweep to remove expired keys, found rows: ", rows)
+	}
+
+	teardown()
+}
+
+func TestNamespaceEscaping(t *testing.T) {
+	setup()
+
+	ctx := context.Background()
+	db.Namespace("a/b").Set(ctx, "k", "escaped")
+	db.Namespace("a").Namespace("b").Set(ctx, "k", "nested")
+
+	if val, _, _ := db.Namespace("a/b").Get(ctx, "k"); val != "escaped" {
+		t.Error("Expected names containing the separator not to collide, got: ", val)
+	}
+	names, _ := db.Namespaces(ctx)
+	if len(names) != 2 || names[0] != "a" || names[1] != "a/b" {
+		t.Error("Expected to list both namespaces, got: ", names)
+	}
+	db.DeleteNamespace(ctx, "a")
+	if val, _, _ := db.Namespace("a/b").Get(ctx, "k"); val != "escaped" {
+		t.Error("Expected deleting a namespace not to affect similarly named ones, got: ", val)
+	}
+
+	teardown()
+}
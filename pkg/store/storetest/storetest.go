@@ -0,0 +1,333 @@
+// Package storetest provides the tests which every store adapter should
+// pass. Adapter packages run them from their own tests and only add tests for
+// behavior specific to that adapter.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/store"
+)
+
+// errAbort is returned from Update to check that failed transactions are
+// rolled back.
+var errAbort = errors.New("storetest: transaction aborted")
+
+// Open returns an empty adapter to test along with a function which closes it
+// and removes any data it left behind.
+type Open func(t *testing.T) (store.ContextAdapter, func())
+
+// Robot implements store.Robot for adapter tests. Name returns "victor"
+// unless RobotName is set and StoreConfig returns Config if it is not nil.
+type Robot struct {
+	RobotName string
+	Config    interface{}
+}
+
+func (r Robot) Name() string {
+	if r.RobotName == "" {
+		return "victor"
+	}
+	return r.RobotName
+}
+
+func (r Robot) StoreConfig() (interface{}, bool) {
+	return r.Config, r.Config != nil
+}
+
+// Load returns the init function registered for the named adapter and fails
+// the test if there is none.
+func Load(t *testing.T, name string) store.InitFunc {
+	initFunc, err := store.Load(name)
+	if err != nil {
+		t.Fatalf("Expected the %s adapter to be registered, got: %s", name, err)
+	}
+	return initFunc
+}
+
+// CheckConfigType checks that the given init function returns a
+// *store.ConfigError for a store config which is not the adapter's config
+// type.
+func CheckConfigType(t *testing.T, initFunc store.InitFunc) {
+	_, err := initFunc(Robot{Config: "invalid"})
+	if _, ok := err.(*store.ConfigError); !ok {
+		t.Error("Expected a config error for an invalid config type, got: ", err)
+	}
+}
+
+// Run runs each conformance test against a new adapter returned by open.
+func Run(t *testing.T, open Open) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, store.ContextAdapter)
+	}{
+		{"EmptyGet", testEmptyGet},
+		{"Set", testSet},
+		{"Delete", testDelete},
+		{"CancelledContext", testCancelledContext},
+		{"Namespace", testNamespace},
+		{"AllKeysScan", testAllKeysScan},
+		{"TTL", testTTL},
+		{"Atomic", testAtomic},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db, done := open(t)
+			defer done()
+			test.fn(t, db)
+		})
+	}
+}
+
+func testEmptyGet(t *testing.T, db store.ContextAdapter) {
+	val, exists, err := db.Get(context.Background(), "nothing")
+	if err != nil {
+		t.Error("Unexpected error getting a missing key: ", err)
+	}
+	if val != "" || exists {
+		t.Error("Expected to get nothing before store has data, got: ", val)
+	}
+}
+
+func testSet(t *testing.T, db store.ContextAdapter) {
+	if err := db.Set(context.Background(), "a", "b"); err != nil {
+		t.Error("Unexpected error setting 'a': ", err)
+	}
+	val, exists, _ := db.Get(context.Background(), "a")
+
+	if val != "b" || !exists {
+		t.Error("Stored 'a': 'b', expected to get it back", val)
+	}
+}
+
+func testDelete(t *testing.T, db store.ContextAdapter) {
+	db.Set(context.Background(), "a", "b")
+	if err := db.Delete(context.Background(), "a"); err != nil {
+		t.Error("Unexpected error deleting 'a': ", err)
+	}
+	val, exists, _ := db.Get(context.Background(), "a")
+	if val != "" || exists {
+		t.Error("Expected to get nothing after deleting key, got: ", val)
+	}
+	if err := db.Delete(context.Background(), "a"); err != nil {
+		t.Error("Expected deleting a missing key to succeed, got: ", err)
+	}
+}
+
+func testCancelledContext(t *testing.T, db store.ContextAdapter) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Set(ctx, "a", "b"); err != context.Canceled {
+		t.Error("Expected a cancelled context to fail, got: ", err)
+	}
+	if _, _, err := db.Get(ctx, "a"); err != context.Canceled {
+		t.Error("Expected a cancelled context to fail, got: ", err)
+	}
+}
+
+func testNamespace(t *testing.T, db store.ContextAdapter) {
+	ctx := context.Background()
+	karma := db.Namespace("karma")
+	db.Set(ctx, "a", "root")
+	karma.Set(ctx, "a", "karma")
+	karma.Namespace("nested").Set(ctx, "a", "nested")
+
+	val, _, _ := db.Get(ctx, "a")
+	if val != "root" {
+		t.Error("Expected namespaces not to change the root's keys, got: ", val)
+	}
+	val, _, _ = karma.Get(ctx, "a")
+	if val != "karma" {
+		t.Error("Expected to get the namespace's value, got: ", val)
+	}
+	val, _, _ = db.Namespace("karma").Namespace("nested").Get(ctx, "a")
+	if val != "nested" {
+		t.Error("Expected to get the nested namespace's value, got: ", val)
+	}
+	if _, exists, _ := db.Namespace("other").Get(ctx, "a"); exists {
+		t.Error("Expected nothing in a namespace that was never written to")
+	}
+
+	names, err := db.Namespaces(ctx)
+	if err != nil || len(names) != 1 || names[0] != "karma" {
+		t.Error("Expected to list the karma namespace, got: ", names, err)
+	}
+
+	if err := db.DeleteNamespace(ctx, "karma"); err != nil {
+		t.Error("Unexpected error deleting namespace: ", err)
+	}
+	if _, exists, _ := karma.Get(ctx, "a"); exists {
+		t.Error("Expected deleted namespace to be empty")
+	}
+	if _, exists, _ := karma.Namespace("nested").Get(ctx, "a"); exists {
+		t.Error("Expected deleting a namespace to delete its nested namespaces")
+	}
+	if err := db.DeleteNamespace(ctx, "karma"); err != nil {
+		t.Error("Expected deleting a missing namespace to succeed, got: ", err)
+	}
+
+	db.Namespace("emptied").Set(ctx, "a", "b")
+	db.Namespace("emptied").Delete(ctx, "a")
+	db.Namespace("parent").Namespace("child").Set(ctx, "a", "b")
+	if names, _ := db.Namespaces(ctx); len(names) != 1 || names[0] != "parent" {
+		t.Error("Expected only namespaces holding keys to be listed, got: ", names)
+	}
+	if err := db.Namespace("").Set(ctx, "a", "b"); err != store.ErrInvalidNamespace {
+		t.Error("Expected an empty namespace name to be rejected, got: ", err)
+	}
+	if err := db.DeleteNamespace(ctx, ""); err != store.ErrInvalidNamespace {
+		t.Error("Expected deleting an empty namespace name to be rejected, got: ", err)
+	}
+}
+
+func testAllKeysScan(t *testing.T, db store.ContextAdapter) {
+	ctx := context.Background()
+	// enough keys to need more than one batch in adapters that read in
+	// batches
+	count := 250
+	for i := 0; i < count; i++ {
+		db.Set(ctx, fmt.Sprintf("karma.%03d", i), fmt.Sprint(i))
+	}
+	db.Set(ctx, "other", "x")
+	db.Namespace("karma.ns").Set(ctx, "a", "b")
+
+	all, err := db.All(ctx)
+	if err != nil || len(all) != count+1 || all["other"] != "x" {
+		t.Error("Expected All to return every key except namespaces, got: ", len(all), err)
+	}
+
+	keys, err := db.Keys(ctx, "karma.")
+	if err != nil || len(keys) != count {
+		t.Fatal("Expected Keys to return every matching key, got: ", len(keys), err)
+	}
+	for i, key := range keys {
+		if key != fmt.Sprintf("karma.%03d", i) {
+			t.Error("Expected keys in order, got: ", key)
+			break
+		}
+	}
+
+	seen := 0
+	err = db.Scan(ctx, "karma.", func(key, value string) bool {
+		// writing during a scan should not deadlock
+		db.Set(ctx, "other", value)
+		seen++
+		return seen < count-10
+	})
+	if err != nil || seen != count-10 {
+		t.Error("Expected Scan to stop when fn returns false, got: ", seen, err)
+	}
+}
+
+func testTTL(t *testing.T, db store.ContextAdapter) {
+	ctx := context.Background()
+	ns := db.Namespace("ns")
+	ttl := 20 * time.Millisecond
+	if err := db.SetWithTTL(ctx, "a", "b", 0); err != store.ErrInvalidTTL {
+		t.Error("Expected an invalid TTL error, got: ", err)
+	}
+	db.SetWithTTL(ctx, "a", "b", ttl)
+	ns.SetWithTTL(ctx, "c", "d", ttl)
+	db.SetWithTTL(ctx, "e", "f", ttl)
+	db.Set(ctx, "e", "g")
+	if val, exists, _ := db.Get(ctx, "a"); !exists || val != "b" {
+		t.Error("Expected key to exist until it expires, got: ", val)
+	}
+	if expirer, ok := db.(store.Expirer); ok {
+		if expires, _ := expirer.Expires(ctx, "a"); expires.IsZero() || expires.After(time.Now().Add(ttl)) {
+			t.Error("Expected the key's expiry time, got: ", expires)
+		}
+		if expires, _ := expirer.Expires(ctx, "e"); !expires.IsZero() {
+			t.Error("Expected no expiry time for a key without a TTL, got: ", expires)
+		}
+	}
+
+	time.Sleep(2 * ttl)
+	if _, exists, _ := db.Get(ctx, "a"); exists {
+		t.Error("Expected expired key not to be returned")
+	}
+	if keys, _ := db.Keys(ctx, ""); len(keys) != 1 || keys[0] != "e" {
+		t.Error("Expected Set to remove a key's TTL, got: ", keys)
+	}
+	if names, _ := db.Namespaces(ctx); len(names) != 0 {
+		t.Error("Expected namespaces with only expired keys not to be listed, got: ", names)
+	}
+
+	if sweeper, ok := db.(store.Sweeper); ok {
+		if err := sweeper.Sweep(ctx); err != nil {
+			t.Error("Unexpected error sweeping: ", err)
+		}
+		if val, _, _ := db.Get(ctx, "e"); val != "g" {
+			t.Error("Expected Sweep to keep keys without a TTL, got: ", val)
+		}
+	}
+}
+
+func testAtomic(t *testing.T, db store.ContextAdapter) {
+	ctx := context.Background()
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				db.Incr(ctx, "karma", 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+	if val, _, _ := db.Get(ctx, "karma"); val != "100" {
+		t.Error("Expected concurrent increments not to be lost, got: ", val)
+	}
+	if n, err := db.Incr(ctx, "karma", -100); err != nil || n != 0 {
+		t.Error("Expected Incr to return the new value, got: ", n, err)
+	}
+	db.Set(ctx, "text", "abc")
+	if _, err := db.Incr(ctx, "text", 1); err != store.ErrNotInteger {
+		t.Error("Expected incrementing text to fail, got: ", err)
+	}
+
+	if swapped, _ := db.CompareAndSwap(ctx, "text", "xyz", "def"); swapped {
+		t.Error("Expected swap to fail on a different value")
+	}
+	if swapped, _ := db.CompareAndSwap(ctx, "text", "abc", "def"); !swapped {
+		t.Error("Expected swap to succeed on the same value")
+	}
+	if swapped, _ := db.CompareAndSwap(ctx, "missing", "", "def"); swapped {
+		t.Error("Expected swap to fail on a missing key")
+	}
+
+	err := db.Update(ctx, func(tx store.Tx) error {
+		tx.Set("a", "1")
+		if val, _, _ := tx.Get("a"); val != "1" {
+			t.Error("Expected transaction to see its own writes, got: ", val)
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Error("Expected Update to return fn's error, got: ", err)
+	}
+	if _, exists, _ := db.Get(ctx, "a"); exists {
+		t.Error("Expected failed transaction to be rolled back")
+	}
+
+	err = db.Update(ctx, func(tx store.Tx) error {
+		tx.Set("a", "1")
+		return tx.Delete("text")
+	})
+	if err != nil {
+		t.Error("Unexpected error updating: ", err)
+	}
+	if val, _, _ := db.Get(ctx, "a"); val != "1" {
+		t.Error("Expected transaction to be applied, got: ", val)
+	}
+	if _, exists, _ := db.Get(ctx, "text"); exists {
+		t.Error("Expected transaction's delete to be applied")
+	}
+}
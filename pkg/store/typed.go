@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codec converts values to and from the strings saved in a store adapter.
+// Encoded values must be valid UTF-8 so every adapter can save them.
+type Codec interface {
+	Encode(v interface{}) (string, error)
+	Decode(data string, v interface{}) error
+}
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+
+	// Gob encodes values with encoding/gob and then base64 so the result is
+	// safe to save in any adapter.
+	Gob Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (jsonCodec) Decode(data string, v interface{}) error {
+	return json.Unmarshal([]byte(data), v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (gobCodec) Decode(data string, v interface{}) error {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(raw)).Decode(v)
+}
+
+// MigrateFunc converts a value that was saved with an older schema version
+// into the current type. It is given the version the value was saved with
+// (0 for values saved without a version tag, ex: before Typed was used) and
+// the encoded value which can be decoded with the given codec into whatever
+// type that version used.
+type MigrateFunc[T any] func(version int, data string, codec Codec) (T, error)
+
+// Typed saves values of type T in a store adapter using a codec. Each value
+// is tagged with the schema version it was written with ("v1:" followed by
+// the encoded value) so values written by older versions of a handler can be
+// migrated when they are read. Migrated values are saved in the current
+// version the next time they are Put.
+//
+// Adapters written against the original Adapter interface can be used by
+// wrapping them with WithContext.
+type Typed[T any] struct {
+	adapter ContextAdapter
+	codec   Codec
+	version int
+	migrate MigrateFunc[T]
+}
+
+// NewTyped returns a Typed for the given adapter which encodes values with
+// the given codec (JSON if it is nil) at schema version 1.
+func NewTyped[T any](adapter ContextAdapter, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSON
+	}
+	return &Typed[T]{
+		adapter: adapter,
+		codec:   codec,
+		version: 1,
+	}
+}
+
+// Versioned returns a copy of the Typed which writes values at the given
+// schema version and calls migrate when it reads a value written at any
+// other version. If migrate is nil such values are decoded as if they were
+// written at the current version.
+func (t *Typed[T]) Versioned(version int, migrate MigrateFunc[T]) *Typed[T] {
+	versioned := *t
+	versioned.version = version
+	versioned.migrate = migrate
+	return &versioned
+}
+
+// Get returns the value saved under the given key. The second return value
+// is false if there is no such key.
+func (t *Typed[T]) Get(ctx context.Context, key string) (T, bool, error) {
+	var value T
+	data, exists, err := t.adapter.Get(ctx, key)
+	if err != nil || !exists {
+		return value, false, err
+	}
+	value, err = t.decode(key, data)
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+// Put saves the given value under the given key at the current schema
+// version.
+func (t *Typed[T]) Put(ctx context.Context, key string, value T) error {
+	data, err := t.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return t.adapter.Set(ctx, key, data)
+}
+
+// PutWithTTL is like Put but the key expires once the given TTL has elapsed.
+func (t *Typed[T]) PutWithTTL(ctx context.Context, key string, value T, ttl time.Duration) error {
+	data, err := t.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return t.adapter.SetWithTTL(ctx, key, data, ttl)
+}
+
+// Delete removes the given key.
+func (t *Typed[T]) Delete(ctx context.Context, key string) error {
+	return t.adapter.Delete(ctx, key)
+}
+
+// List returns every value whose key starts with the given prefix. It stops
+// at the first value that cannot be decoded and returns its error.
+func (t *Typed[T]) List(ctx context.Context, prefix string) (map[string]T, error) {
+	values := make(map[string]T)
+	var decodeErr error
+	err := t.adapter.Scan(ctx, prefix, func(key, data string) bool {
+		value, err := t.decode(key, data)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		values[key] = value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return values, nil
+}
+
+// encode returns the tagged and encoded form of the given value.
+func (t *Typed[T]) encode(key string, value T) (string, error) {
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return "", fmt.Errorf("store: error encoding %q: %s", key, err)
+	}
+	return "v" + strconv.Itoa(t.version) + ":" + data, nil
+}
+
+// decode reads a tagged value, migrating it if it was written at a different
+// schema version.
+func (t *Typed[T]) decode(key, data string) (T, error) {
+	var value T
+	version, data := splitVersion(data)
+	var err error
+	if version != t.version && t.migrate != nil {
+		value, err = t.migrate(version, data, t.codec)
+	} else {
+		err = t.codec.Decode(data, &value)
+	}
+	if err != nil {
+		return value, fmt.Errorf("store: error decoding %q (version %d): %s", key, version, err)
+	}
+	return value, nil
+}
+
+// splitVersion returns the schema version a value was tagged with and the
+// value without its tag. Values without a tag are version 0.
+func splitVersion(data string) (int, string) {
+	if !strings.HasPrefix(data, "v") {
+		return 0, data
+	}
+	i := strings.IndexByte(data, ':')
+	if i < 2 {
+		return 0, data
+	}
+	version, err := strconv.Atoi(data[1:i])
+	if err != nil || version < 0 {
+		return 0, data
+	}
+	return version, data[i+1:]
+}
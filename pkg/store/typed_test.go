@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/FogCreek/victor/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type reminder struct {
+	Text  string
+	Users []string
+}
+
+func TestTyped(t *testing.T) {
+	for _, codec := range []store.Codec{store.JSON, store.Gob} {
+		ctx := context.Background()
+		s := newMemoryStore(t)
+		reminders := store.NewTyped[reminder](s, codec)
+
+		_, exists, err := reminders.Get(ctx, "missing")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		r := reminder{Text: "standup", Users: []string{"U1", "U2"}}
+		assert.NoError(t, reminders.Put(ctx, "reminders.1", r))
+		assert.NoError(t, reminders.Put(ctx, "reminders.2", reminder{Text: "lunch"}))
+		got, exists, err := reminders.Get(ctx, "reminders.1")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, r, got)
+
+		raw, _, _ := s.Get(ctx, "reminders.1")
+		assert.Regexp(t, "^v1:", raw, "Values should be tagged with their version.")
+
+		all, err := reminders.List(ctx, "reminders.")
+		assert.NoError(t, err)
+		assert.Len(t, all, 2)
+		assert.Equal(t, "lunch", all["reminders.2"].Text)
+
+		s.Set(ctx, "reminders.3", "not encoded")
+		_, err = reminders.List(ctx, "reminders.")
+		assert.Error(t, err, "Undecodable values should fail.")
+	}
+}
+
+func TestTypedMigration(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(t)
+	// a value hand-marshaled before Typed was used and one from version 1
+	s.Set(ctx, "old", `"standup"`)
+	store.NewTyped[string](s, store.JSON).Put(ctx, "v1", "lunch")
+
+	migrated := 0
+	reminders := store.NewTyped[reminder](s, store.JSON).Versioned(2,
+		func(version int, data string, codec store.Codec) (reminder, error) {
+			migrated++
+			var text string
+			err := codec.Decode(data, &text)
+			return reminder{Text: text}, err
+		})
+
+	got, _, err := reminders.Get(ctx, "old")
+	assert.NoError(t, err)
+	assert.Equal(t, reminder{Text: "standup"}, got)
+	got, _, err = reminders.Get(ctx, "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, reminder{Text: "lunch"}, got)
+	assert.Equal(t, 2, migrated)
+
+	assert.NoError(t, reminders.Put(ctx, "v1", got))
+	reminders.Get(ctx, "v1")
+	assert.Equal(t, 2, migrated, "Current versions should not be migrated.")
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// EventType describes the change that a StoreEvent reports.
+type EventType int
+
+const (
+	// EventSet is sent when a key is set (including by Incr, CompareAndSwap,
+	// and Update).
+	EventSet EventType = iota + 1
+	// EventDelete is sent when a key is deleted, either on its own or with
+	// its namespace.
+	EventDelete
+	// EventExpire is sent when a key whose TTL has elapsed is removed, either
+	// by Sweep or by deleting it before Sweep has run.
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// StoreEvent reports a change to a single key. Value is the key's new value
+// for EventSet and empty otherwise. Namespace is the path of names from the
+// root store to the key's namespace.
+type StoreEvent struct {
+	Type      EventType
+	Namespace []string
+	Key,
+	Value string
+}
+
+// Watcher is implemented by adapters that can report changes to their keys.
+type Watcher interface {
+	// Watch returns a channel which receives an event for every change to a
+	// key with the given prefix in the adapter's namespace (not including
+	// nested namespaces). The channel is closed once the context is done or
+	// if the receiver falls more than WatchQueueLimit events behind, in which
+	// case later events are missed and the keys should be read again.
+	Watch(ctx context.Context, prefix string) <-chan StoreEvent
+}
+
+// WatchQueueLimit is the number of undelivered events a watcher may have
+// queued before the Hub gives up on it and closes its channel.
+const WatchQueueLimit = 1000
+
+// Hub delivers events to watchers for adapters that implement Watcher.
+// Publish never blocks: each watcher has its own queue which is drained into
+// its channel by a goroutine, so a slow watcher only delays itself. A watcher
+// whose queue grows past WatchQueueLimit is removed and its channel closed
+// rather than letting its queue grow without bound.
+type Hub struct {
+	mutex    *sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+// NewHub returns a hub without any watchers.
+func NewHub() *Hub {
+	return &Hub{
+		mutex:    &sync.Mutex{},
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// watcher is a single call to Hub.Watch.
+type watcher struct {
+	namespace string
+	prefix    string
+	mutex     *sync.Mutex
+	queue     []StoreEvent
+	overflow  bool
+	notify    chan struct{}
+}
+
+// namespaceKey joins a namespace path so it can be compared.
+func namespaceKey(namespace []string) string {
+	return strings.Join(namespace, "\x00")
+}
+
+// Watch registers a watcher for keys with the given prefix in the given
+// namespace. See Watcher.Watch.
+func (h *Hub) Watch(ctx context.Context, namespace []string, prefix string) <-chan StoreEvent {
+	w := &watcher{
+		namespace: namespaceKey(namespace),
+		prefix:    prefix,
+		mutex:     &sync.Mutex{},
+		notify:    make(chan struct{}, 1),
+	}
+	events := make(chan StoreEvent)
+	h.mutex.Lock()
+	h.watchers[w] = struct{}{}
+	h.mutex.Unlock()
+
+	go func() {
+		defer close(events)
+		defer func() {
+			h.mutex.Lock()
+			delete(h.watchers, w)
+			h.mutex.Unlock()
+		}()
+		for {
+			w.mutex.Lock()
+			queue, overflow := w.queue, w.overflow
+			w.queue = nil
+			w.mutex.Unlock()
+			if overflow {
+				return
+			}
+			for _, e := range queue {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-w.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Publish queues the given events for every matching watcher. Adapters should
+// publish while holding the lock that orders their writes so watchers see
+// events in the order that they happened.
+func (h *Hub) Publish(events ...StoreEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	for _, e := range events {
+		namespace := namespaceKey(e.Namespace)
+		for w := range h.watchers {
+			if w.namespace != namespace || !strings.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			w.mutex.Lock()
+			if len(w.queue) < WatchQueueLimit {
+				w.queue = append(w.queue, e)
+			} else {
+				w.queue, w.overflow = nil, true
+				delete(h.watchers, w)
+			}
+			w.mutex.Unlock()
+			select {
+			case w.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package victor
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/FogCreek/victor/pkg/chat"
 	"github.com/FogCreek/victor/pkg/events"
+	"github.com/FogCreek/victor/pkg/events/definedEvents"
 	// Blank import used init adapters which registers them with victor
 	_ "github.com/FogCreek/victor/pkg/chat/shell"
 	_ "github.com/FogCreek/victor/pkg/chat/slackRealtime"
@@ -21,7 +26,8 @@ import (
 // Robot provides an interface for a victor chat robot.
 type Robot interface {
 	Run()
-	Stop()
+	RunContext(context.Context) error
+	Stop() error
 	Name() string
 	RefreshUserName()
 	HandleCommand(HandlerDocPair)
@@ -33,54 +39,165 @@ type Robot interface {
 	HandlePattern(string, HandlerFunc)
 	HandleRegexp(*regexp.Regexp, HandlerFunc)
 	SetDefaultHandler(HandlerFunc)
+	Use(Middleware)
 	EnableHelpCommand()
+	EnableRoleCommands()
+	EnableBackupCommand(string)
+	Schedule(string, JobFunc) (string, error)
+	ScheduleAt(time.Time, string, string) (string, error)
+	HandleJob(string, OneShotJobFunc)
+	Unschedule(string) bool
 	Commands() map[string]HandlerDocPair
 	Receive(chat.Message)
 	Chat() chat.Adapter
 	Store() store.Adapter
+	ContextStore() store.ContextAdapter
+	Roles() Roles
 	AdapterConfig() (interface{}, bool)
 	StoreConfig() (interface{}, bool)
 	ChatErrors() chan events.ErrorEvent
 	ChatEvents() chan events.ChatEvent
+	Context() context.Context
 }
 
 // Config provides all of the configuration parameters needed in order to
 // initialize a robot. It also allows for optional configuration structs for
 // both the chat and storage adapters which they may or may not require.
+//
+// StoreAdapter names the store adapter to use (defaults to "memory"). The
+// memory and bolt adapters are always available while the other adapters in
+// pkg/store are only registered once their package is imported, for example:
+//
+//	import _ "github.com/FogCreek/victor/pkg/store/sqlitestore"
+//
+// ShutdownTimeout sets how long Stop waits for running handlers to finish
+// (defaults to 10 seconds).
+//
+// Workers sets the number of goroutines that process incoming messages and
+// QueueSize sets the number of messages each of them may have waiting.
+// Messages from the same channel are always processed in order. When a queue
+// is full the robot waits for room unless DropWhenFull is set, in which case
+// the message is dropped and a MessageDropped error is sent to ChatErrors().
+//
+// SweepInterval sets how often expired keys are removed from the store
+// adapter while the robot is running if the adapter implements store.Sweeper
+// (defaults to 1 minute).
 type Config struct {
 	Name,
 	ChatAdapter,
 	StoreAdapter string
 	AdapterConfig,
 	StoreConfig interface{}
+	Workers,
+	QueueSize int
+	DropWhenFull bool
+	ShutdownTimeout,
+	SweepInterval time.Duration
 }
 
+// defaultShutdownTimeout is used by Stop if no ShutdownTimeout is set in the
+// robot's Config.
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultSweepInterval is used if no SweepInterval is set in the robot's
+// Config.
+const defaultSweepInterval = time.Minute
+
+// ErrShutdownTimeout is returned by Stop when handlers or scheduled jobs are
+// still running once the shutdown timeout has elapsed.
+var ErrShutdownTimeout = errors.New("timed out waiting for handlers to finish")
+
 type robot struct {
 	*dispatch
-	name     string
-	store    store.Adapter
-	chat     chat.Adapter
-	incoming chan chat.Message
-	stop     chan struct{}
+	*scheduler
+	name        string
+	configName  string
+	store       store.ContextAdapter
+	legacyStore store.ExtendedAdapter
+	roles       Roles
+	chat        chat.Adapter
+	incoming    chan chat.Message
+	stop        chan struct{}
 	adapterConfig,
 	storeConfig interface{}
 	chatErrorChannel chan events.ErrorEvent
 	chatEventChannel chan events.ChatEvent
+	workers          *workerPool
+	ctx              context.Context
+	cancel           context.CancelFunc
+	shutdownTimeout  time.Duration
+	sweepInterval    time.Duration
+	sweeper          *sync.WaitGroup
+	runMutex         *sync.Mutex
+	running          bool
+	loopDone         chan struct{}
+	senders          *sync.WaitGroup
+	dropped          chan *definedEvents.MessageDropped
+	reportOnce       *sync.Once
+	stopOnce         *sync.Once
+	stopped          chan struct{}
+	stopErr          error
+}
+
+// ConfigError is returned by NewE when one of the robot's own Config fields
+// is invalid. Errors for the chat and store adapters are returned as
+// *chat.ConfigError and *store.ConfigError respectively.
+type ConfigError struct {
+	Field,
+	Reason string
 }
 
-// New returns a robot
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// New returns a robot. It panics if the robot cannot be created, use NewE to
+// handle invalid configurations.
 func New(config Config) *robot {
+	bot, err := newRobot(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	return bot
+}
+
+// NewE returns a robot or an error if the given configuration is invalid. The
+// error is a *chat.UnknownAdapterError or *store.UnknownAdapterError if an
+// adapter is not registered, a *chat.ConfigError or *store.ConfigError if an
+// adapter rejects its configuration, or a *ConfigError if one of the robot's
+// own settings is invalid.
+func NewE(config Config) (Robot, error) {
+	bot, err := newRobot(config)
+	if err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+// newRobot does the work of New and NewE.
+func newRobot(config Config) (*robot, error) {
+	if config.Workers < 0 {
+		return nil, &ConfigError{Field: "Workers", Reason: "must not be negative"}
+	}
+	if config.QueueSize < 0 {
+		return nil, &ConfigError{Field: "QueueSize", Reason: "must not be negative"}
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, &ConfigError{Field: "ShutdownTimeout", Reason: "must not be negative"}
+	}
+	if config.SweepInterval < 0 {
+		return nil, &ConfigError{Field: "SweepInterval", Reason: "must not be negative"}
+	}
+
 	chatAdapter := config.ChatAdapter
 	if chatAdapter == "" {
-		log.Println("Shell adapter has been removed.")
+		log.Println("No chat adapter set, defaulting to the shell adapter.")
 		chatAdapter = "shell"
 	}
 
-	chatInitFunc, err := chat.Load(config.ChatAdapter)
-
+	chatInitFunc, err := chat.Load(chatAdapter)
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	storeAdapter := config.StoreAdapter
@@ -89,10 +206,8 @@ func New(config Config) *robot {
 	}
 
 	storeInitFunc, err := store.Load(storeAdapter)
-
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	botName := config.Name
@@ -101,59 +216,279 @@ func New(config Config) *robot {
 	}
 
 	bot := &robot{
+		configName:       botName,
 		incoming:         make(chan chat.Message),
 		stop:             make(chan struct{}),
 		chatErrorChannel: make(chan events.ErrorEvent),
 		chatEventChannel: make(chan events.ChatEvent),
 		adapterConfig:    config.AdapterConfig,
+		storeConfig:      config.StoreConfig,
+		shutdownTimeout:  config.ShutdownTimeout,
+		sweepInterval:    config.SweepInterval,
+		sweeper:          &sync.WaitGroup{},
+		runMutex:         &sync.Mutex{},
+		loopDone:         make(chan struct{}),
+		senders:          &sync.WaitGroup{},
+		dropped:          make(chan *definedEvents.MessageDropped, defaultQueueSize),
+		reportOnce:       &sync.Once{},
+		stopOnce:         &sync.Once{},
+		stopped:          make(chan struct{}),
+	}
+	if bot.shutdownTimeout == 0 {
+		bot.shutdownTimeout = defaultShutdownTimeout
+	}
+	if bot.sweepInterval == 0 {
+		bot.sweepInterval = defaultSweepInterval
 	}
 
-	bot.store = storeInitFunc(bot)
-	bot.chat = chatInitFunc(bot)
+	bot.store, err = storeInitFunc(bot)
+	if err != nil {
+		return nil, err
+	}
+	bot.chat, err = chatInitFunc(bot)
+	if err != nil {
+		closeStore(bot.store)
+		return nil, err
+	}
+	bot.ctx, bot.cancel = context.WithCancel(context.Background())
+	bot.legacyStore = store.Legacy(bot.store)
+	bot.roles = newStoreRoles(bot.store)
 	bot.dispatch = newDispatch(bot)
-	return bot
+	bot.scheduler = newScheduler(bot)
+	bot.workers = newWorkerPool(config.Workers, config.QueueSize, config.DropWhenFull,
+		bot.ProcessMessage, bot.dropMessage)
+	return bot, nil
 }
 
-// Receive accepts messages for processing
+// Receive accepts messages for processing. Messages received after the robot
+// has been stopped are discarded.
 func (r *robot) Receive(m chat.Message) {
-	r.incoming <- m
+	select {
+	case r.incoming <- m:
+	case <-r.stop:
+	}
 }
 
-// Run starts the robot.
+// Run starts the robot and its scheduled jobs. Incoming messages are
+// processed by the robot's worker pool.
 func (r *robot) Run() {
+	r.runMutex.Lock()
+	defer r.runMutex.Unlock()
+	select {
+	case <-r.stop:
+		log.Println("Cannot run a robot that has been stopped.")
+		return
+	default:
+	}
+	r.running = true
 	r.chat.Run()
+	r.scheduler.start()
+	r.workers.start()
+	if sweeper, ok := r.store.(store.Sweeper); ok {
+		r.sweeper.Add(1)
+		go r.sweep(sweeper)
+	}
 
 	go func() {
+		defer close(r.loopDone)
 		for {
 			select {
 			case <-r.stop:
-				close(r.incoming)
 				return
 			case m := <-r.incoming:
-				if strings.ToLower(m.User().Name()) != r.name {
-					go r.ProcessMessage(m)
+				if strings.ToLower(m.User().Name()) == r.name {
+					continue
+				}
+				// answers must skip the queue since the handler waiting
+				// for them is occupying the channel's worker
+				if !r.conversations.deliver(m) {
+					r.workers.submit(m, r.stop)
 				}
 			}
 		}
 	}()
 }
 
-// Stop shuts down the bot
-func (r *robot) Stop() {
-	r.chat.Stop()
+// RunContext starts the robot and blocks until either the given context is
+// done, in which case the robot is stopped, or the robot is stopped by a call
+// to Stop. It returns the result of stopping the robot.
+func (r *robot) RunContext(ctx context.Context) error {
+	r.Run()
+	select {
+	case <-ctx.Done():
+		return r.Stop()
+	case <-r.stopped:
+		return r.stopErr
+	}
+}
+
+// dropMessage reports a message that was dropped because the worker pool's
+// queue was full. Reports are queued for a single goroutine which sends them
+// to ChatErrors so a full worker queue never blocks on an unread ChatErrors
+// channel. If the report queue is also full then the drop is only logged.
+func (r *robot) dropMessage(m chat.Message) {
+	dropped := &definedEvents.MessageDropped{Text: m.Text()}
+	if m.Channel() != nil {
+		dropped.ChannelID = m.Channel().ID()
+	}
+	r.reportOnce.Do(func() {
+		r.senders.Add(1)
+		go r.reportDropped()
+	})
+	select {
+	case r.dropped <- dropped:
+	default:
+		log.Println(dropped.Error())
+	}
+}
+
+// reportDropped sends queued dropped message reports to ChatErrors until the
+// robot is stopped.
+func (r *robot) reportDropped() {
+	defer r.senders.Done()
+	for {
+		select {
+		case dropped := <-r.dropped:
+			select {
+			case r.chatErrorChannel <- dropped:
+			case <-r.stop:
+				return
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop shuts down the bot. It immediately stops accepting new messages and
+// cancels the robot's context so running handlers (ex: those waiting in
+// State.Ask) and scheduled jobs know to return. It then waits up to the
+// configured ShutdownTimeout for queued messages, running handlers, and
+// scheduled jobs to finish. Once they have (or the timeout elapses) the chat
+// adapter is stopped, the store adapter is closed if it implements io.Closer,
+// and finally the ChatErrors() and ChatEvents() channels are closed.
+//
+// This returns ErrShutdownTimeout if handlers or jobs were still running when
+// the timeout elapsed or otherwise any error from closing the store. The store
+// is left open after a timeout since the handlers and jobs that are still
+// running may continue to use it. It is
+// safe to call more than once and every call returns the result of the first.
+func (r *robot) Stop() error {
+	r.stopOnce.Do(func() {
+		r.stopErr = r.shutdown()
+		close(r.stopped)
+	})
+	<-r.stopped
+	return r.stopErr
+}
+
+// shutdown performs the work of Stop.
+func (r *robot) shutdown() error {
+	var err error
+	// closed rather than sent on so every wait below sees the deadline
+	expired := make(chan struct{})
+	deadline := time.AfterFunc(r.shutdownTimeout, func() { close(expired) })
+	defer deadline.Stop()
+	r.runMutex.Lock()
 	close(r.stop)
+	running := r.running
+	r.runMutex.Unlock()
+	if running {
+		// nothing else submits to the worker queues once the loop is done
+		<-r.loopDone
+	}
+	r.cancel()
+	r.workers.close()
+	if !waitUntil(r.workers.wait, expired) {
+		err = ErrShutdownTimeout
+	}
+	if !waitUntil(r.scheduler.wait, expired) {
+		err = ErrShutdownTimeout
+	}
+	r.chat.Stop()
+	r.sweeper.Wait()
+	if err == nil {
+		err = closeStore(r.store)
+	} else {
+		log.Println("Not closing store since handlers or jobs are still running.")
+	}
+	r.senders.Wait()
+	close(r.chatErrorChannel)
+	close(r.chatEventChannel)
+	return err
+}
+
+// sweep periodically removes expired keys from the store until the robot's
+// context is cancelled.
+func (r *robot) sweep(sweeper store.Sweeper) {
+	defer r.sweeper.Done()
+	ticker := time.NewTicker(r.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sweeper.Sweep(r.ctx); err != nil && r.ctx.Err() == nil {
+				log.Println("Error removing expired keys from store:", err.Error())
+			}
+		}
+	}
+}
+
+// closeStore closes the given store adapter if it holds resources that need
+// to be released (ex: an open database file).
+func closeStore(s store.ContextAdapter) error {
+	if closer, ok := s.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
-// Name returns the name of the bot
+// waitUntil calls the given wait function and returns true if it returns
+// before the given timeout channel is closed.
+func waitUntil(wait func(), timeout <-chan struct{}) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// Name returns the name of the bot. This falls back to the configured name
+// until the chat adapter has been initialized.
 func (r *robot) Name() string {
+	if r.chat == nil {
+		return r.configName
+	}
 	return r.Chat().GetBot().Name()
 }
 
-// Store returns the data store adapter
+// Store returns the data store adapter. Errors from the underlying adapter
+// are logged, use ContextStore to handle them and to reach the store's other
+// features such as ContextStore().Namespace(name).
 func (r *robot) Store() store.Adapter {
+	return r.legacyStore
+}
+
+// ContextStore returns the data store adapter with its context and error
+// returning interface.
+func (r *robot) ContextStore() store.ContextAdapter {
 	return r.store
 }
 
+// Roles returns the robot's role based access control which is persisted in
+// the data store adapter
+func (r *robot) Roles() Roles {
+	return r.roles
+}
+
 // Chat returns the chat adapter
 func (r *robot) Chat() chat.Adapter {
 	return r.chat
@@ -175,8 +510,16 @@ func (r *robot) ChatEvents() chan events.ChatEvent {
 	return r.chatEventChannel
 }
 
+// Context returns the robot's context which is cancelled when the robot is
+// stopped. All handler contexts are derived from it.
+func (r *robot) Context() context.Context {
+	return r.ctx
+}
+
 // OnlyAllow provides a way of permitting specific users
 // to execute a handler registered with the bot
+//
+// Deprecated: set the CmdRoles property of a command's HandlerDoc instead.
 func OnlyAllow(userNames []string, action func(s State)) func(State) {
 	return func(s State) {
 		actual := s.Message().User().Name()
@@ -0,0 +1,221 @@
+package victor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getMockBotWithTimeout(timeout time.Duration) *robot {
+	return New(Config{
+		Name:            botName[1:],
+		ChatAdapter:     "mockAdapter",
+		ShutdownTimeout: timeout,
+	})
+}
+
+func TestStopWaitsForHandlers(t *testing.T) {
+	bot := getMockBotWithTimeout(time.Second)
+	started := make(chan struct{})
+	finished := false
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "slow",
+		CmdHandler: func(s State) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			finished = true
+		},
+	})
+	bot.Run()
+	bot.Receive(&chat.BaseMessage{
+		MsgText:     "slow",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	})
+	<-started
+	assert.NoError(t, bot.Stop())
+	assert.True(t, finished, "Stop should wait for running handlers.")
+}
+
+func TestStopTimeout(t *testing.T) {
+	bot := getMockBotWithTimeout(20 * time.Millisecond)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "stuck",
+		CmdHandler: func(s State) {
+			close(started)
+			<-release
+		},
+	})
+	bot.Run()
+	bot.Receive(&chat.BaseMessage{
+		MsgText:     "stuck",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	})
+	<-started
+	assert.Equal(t, ErrShutdownTimeout, bot.Stop())
+	assert.Equal(t, ErrShutdownTimeout, bot.Stop(), "Later calls should return the first result.")
+}
+
+func TestStopClosesChannels(t *testing.T) {
+	bot := getMockBot()
+	bot.Run()
+	assert.NoError(t, bot.Stop())
+	_, open := <-bot.ChatErrors()
+	assert.False(t, open, "ChatErrors should be closed after Stop.")
+	_, open = <-bot.ChatEvents()
+	assert.False(t, open, "ChatEvents should be closed after Stop.")
+	// receiving after stopping should not panic or block
+	bot.Receive(&chat.BaseMessage{MsgUser: testUser, MsgChannel: testChannel})
+}
+
+func TestRunContext(t *testing.T) {
+	bot := getMockBot()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- bot.RunContext(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "RunContext did not return after its context was cancelled.")
+	}
+	assert.Error(t, bot.Context().Err(), "The robot should be stopped.")
+}
+
+func TestNewEUnknownAdapters(t *testing.T) {
+	_, err := NewE(Config{ChatAdapter: "nonexistent"})
+	if assert.IsType(t, &chat.UnknownAdapterError{}, err) {
+		assert.Equal(t, "nonexistent", err.(*chat.UnknownAdapterError).Name)
+	}
+	_, err = NewE(Config{ChatAdapter: "mockAdapter", StoreAdapter: "nonexistent"})
+	if assert.IsType(t, &store.UnknownAdapterError{}, err) {
+		assert.Equal(t, "nonexistent", err.(*store.UnknownAdapterError).Name)
+	}
+}
+
+func TestNewEInvalidConfig(t *testing.T) {
+	_, err := NewE(Config{ChatAdapter: "slackRealtime"})
+	assert.IsType(t, &chat.ConfigError{}, err, "Slack adapter should require a config.")
+	_, err = NewE(Config{ChatAdapter: "slackRealtime", AdapterConfig: "token"})
+	assert.IsType(t, &chat.ConfigError{}, err, "Slack adapter should require a Config implementation.")
+	_, err = NewE(Config{ChatAdapter: "mockAdapter", Workers: -1})
+	if assert.IsType(t, &ConfigError{}, err) {
+		assert.Equal(t, "Workers", err.(*ConfigError).Field)
+	}
+	assert.Panics(t, func() { New(Config{ChatAdapter: "nonexistent"}) })
+}
+
+func TestNewEStoreConfig(t *testing.T) {
+	bot, err := NewE(Config{ChatAdapter: "mockAdapter", StoreConfig: "config"})
+	assert.NoError(t, err)
+	config, ok := bot.StoreConfig()
+	assert.True(t, ok, "StoreConfig should be set.")
+	assert.Equal(t, "config", config)
+}
+
+// closingStore records whether the robot closed its store adapter.
+type closingStore struct {
+	store.ContextAdapter
+	closed bool
+}
+
+func (s *closingStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStopClosesStore(t *testing.T) {
+	s := &closingStore{}
+	store.Register("closingStore", func(r store.Robot) (store.ContextAdapter, error) {
+		return s, nil
+	})
+	bot, err := NewE(Config{ChatAdapter: "mockAdapter", StoreAdapter: "closingStore"})
+	assert.NoError(t, err)
+	assert.NoError(t, bot.Stop())
+	assert.True(t, s.closed, "Stop should close the store adapter.")
+}
+
+func TestStopTimeoutLeavesStoreOpen(t *testing.T) {
+	s := &closingStore{}
+	store.Register("closingStoreTimeout", func(r store.Robot) (store.ContextAdapter, error) {
+		memoryInit, _ := store.Load("memory")
+		s.ContextAdapter, _ = memoryInit(r)
+		return s, nil
+	})
+	bot, err := NewE(Config{
+		ChatAdapter:     "mockAdapter",
+		StoreAdapter:    "closingStoreTimeout",
+		ShutdownTimeout: 20 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	bot.HandleCommand(&HandlerDoc{
+		CmdName: "stuck",
+		CmdHandler: func(s State) {
+			close(started)
+			<-release
+		},
+	})
+	bot.Run()
+	bot.Receive(&chat.BaseMessage{
+		MsgText:     "stuck",
+		MsgIsDirect: true,
+		MsgUser:     testUser,
+		MsgChannel:  testChannel,
+	})
+	<-started
+	assert.Equal(t, ErrShutdownTimeout, bot.Stop())
+	assert.False(t, s.closed, "Stop should not close the store while handlers are running.")
+}
+
+// sweepingStore counts the number of times the robot sweeps its store.
+type sweepingStore struct {
+	store.ContextAdapter
+	sweeps chan struct{}
+}
+
+func (s *sweepingStore) Sweep(ctx context.Context) error {
+	select {
+	case s.sweeps <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func TestSweep(t *testing.T) {
+	s := &sweepingStore{sweeps: make(chan struct{}, 1)}
+	store.Register("sweepingStore", func(r store.Robot) (store.ContextAdapter, error) {
+		memoryInit, _ := store.Load("memory")
+		s.ContextAdapter, _ = memoryInit(r)
+		return s, nil
+	})
+	bot, err := NewE(Config{
+		ChatAdapter:   "mockAdapter",
+		StoreAdapter:  "sweepingStore",
+		SweepInterval: time.Millisecond,
+	})
+	assert.NoError(t, err)
+	bot.Run()
+	select {
+	case <-s.sweeps:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Store was not swept while the robot was running.")
+	}
+	assert.NoError(t, bot.Stop())
+}
@@ -0,0 +1,291 @@
+package victor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/schedule"
+)
+
+// jobsKeyPrefix is prepended to a one-shot job's ID to build the store key
+// under which that job is persisted.
+const jobsKeyPrefix = "victor.jobs."
+
+// JobFunc is called by the scheduler when a recurring job activates.
+type JobFunc func(Robot)
+
+// OneShotJobFunc is called by the scheduler when a one-shot job activates. It
+// is given the payload that the job was scheduled with.
+type OneShotJobFunc func(r Robot, payload string)
+
+// persistedJob is the form in which one-shot jobs are saved to the store.
+type persistedJob struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	At      time.Time `json:"at"`
+	Payload string    `json:"payload"`
+}
+
+// scheduledJob is a job that is known to the scheduler. Recurring jobs have a
+// schedule while one-shot jobs have a persisted job.
+type scheduledJob struct {
+	id       string
+	schedule schedule.Schedule
+	job      JobFunc
+	oneShot  *persistedJob
+	cancel   chan struct{}
+}
+
+// scheduler runs recurring (cron-style) and one-shot jobs for a robot.
+// One-shot jobs are persisted to the robot's store so they survive restarts
+// as long as a handler is registered under their name with HandleJob.
+type scheduler struct {
+	robot    Robot
+	mutex    *sync.Mutex
+	jobs     map[string]*scheduledJob
+	handlers map[string]OneShotJobFunc
+	running  bool
+	nextID   int
+	wg       *sync.WaitGroup
+}
+
+// newScheduler returns a new scheduler for the given robot. Jobs do not run
+// until start is called.
+func newScheduler(r Robot) *scheduler {
+	return &scheduler{
+		robot:    r,
+		mutex:    &sync.Mutex{},
+		jobs:     make(map[string]*scheduledJob),
+		handlers: make(map[string]OneShotJobFunc),
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+// Schedule adds a recurring job using a cron specification (see
+// schedule.Parse for the supported syntax). This returns the job's ID which
+// can be given to Unschedule or an error if the spec is invalid.
+//
+// Recurring jobs are not persisted and should be added every time the robot
+// is created.
+func (s *scheduler) Schedule(spec string, job JobFunc) (string, error) {
+	sched, err := schedule.Parse(spec)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("cron-%d", s.nextID)
+	s.add(&scheduledJob{
+		id:       id,
+		schedule: sched,
+		job:      job,
+	})
+	return id, nil
+}
+
+// HandleJob registers the function that is called when a one-shot job with
+// the given name activates. Handlers must be registered before the robot is
+// run in order for persisted jobs to be resumed.
+func (s *scheduler) HandleJob(name string, handler OneShotJobFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.handlers[name]; exists {
+		log.Printf("Job handler \"%s\" has been set more than once.", name)
+	}
+	s.handlers[name] = handler
+}
+
+// ScheduleAt adds a one-shot job which calls the handler registered under the
+// given name with the given payload at the given time. The job is persisted to
+// the robot's store until its handler has returned or it is unscheduled. Times
+// in the past run as soon as the robot is running.
+//
+// A job whose handler was interrupted (ex: by a crash) runs again once the
+// robot is restarted so handlers should be safe to run more than once.
+//
+// This returns the job's ID which can be given to Unschedule.
+func (s *scheduler) ScheduleAt(at time.Time, name, payload string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.handlers[name]; !exists {
+		return "", fmt.Errorf("no job handler registered under name \"%s\"", name)
+	}
+	s.nextID++
+	pj := &persistedJob{
+		ID:      fmt.Sprintf("%d-%d", time.Now().UnixNano(), s.nextID),
+		Name:    name,
+		At:      at,
+		Payload: payload,
+	}
+	encoded, err := json.Marshal(pj)
+	if err != nil {
+		return "", err
+	}
+	if err := s.robot.ContextStore().Set(context.Background(), jobsKeyPrefix+pj.ID, string(encoded)); err != nil {
+		return "", err
+	}
+	s.add(&scheduledJob{
+		id:      pj.ID,
+		oneShot: pj,
+	})
+	return pj.ID, nil
+}
+
+// Unschedule removes the job with the given ID. This returns false if there
+// is no such job.
+func (s *scheduler) Unschedule(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, exists := s.jobs[id]
+	if !exists {
+		return false
+	}
+	s.remove(job)
+	return true
+}
+
+// start loads any persisted one-shot jobs and begins running all jobs.
+func (s *scheduler) start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	err := s.robot.ContextStore().Scan(context.Background(), jobsKeyPrefix, func(key, value string) bool {
+		id := key[len(jobsKeyPrefix):]
+		if _, exists := s.jobs[id]; exists {
+			return true
+		}
+		pj := &persistedJob{}
+		if err := json.Unmarshal([]byte(value), pj); err != nil {
+			log.Printf("Unable to load scheduled job \"%s\": %s", id, err.Error())
+			return true
+		}
+		if _, exists := s.handlers[pj.Name]; !exists {
+			log.Printf("No job handler registered for persisted job \"%s\" (%s)", id, pj.Name)
+			return true
+		}
+		s.jobs[id] = &scheduledJob{
+			id:      id,
+			oneShot: pj,
+			cancel:  make(chan struct{}),
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("Unable to load scheduled jobs:", err.Error())
+	}
+	for _, job := range s.jobs {
+		s.run(job)
+	}
+}
+
+// wait blocks until all job goroutines have returned. The robot's context
+// must be cancelled first.
+func (s *scheduler) wait() {
+	s.wg.Wait()
+}
+
+// add registers a job and starts it if the scheduler is running. The mutex
+// should be held before calling this method.
+func (s *scheduler) add(job *scheduledJob) {
+	job.cancel = make(chan struct{})
+	s.jobs[job.id] = job
+	if s.running {
+		s.run(job)
+	}
+}
+
+// remove unregisters and stops a job and deletes it from the store if it is a
+// one-shot job. The mutex should be held before calling this method.
+func (s *scheduler) remove(job *scheduledJob) {
+	if !s.unregister(job) {
+		return
+	}
+	if job.oneShot != nil {
+		s.unpersist(job.id)
+	}
+}
+
+// unregister removes a job from the scheduler and stops its goroutine. This
+// returns false if the job had already been removed. The mutex should be held
+// before calling this method.
+func (s *scheduler) unregister(job *scheduledJob) bool {
+	if _, exists := s.jobs[job.id]; !exists {
+		return false
+	}
+	delete(s.jobs, job.id)
+	close(job.cancel)
+	return true
+}
+
+// unpersist deletes the one-shot job with the given ID from the store.
+func (s *scheduler) unpersist(id string) {
+	err := s.robot.ContextStore().Delete(context.Background(), jobsKeyPrefix+id)
+	if err != nil {
+		log.Printf("Unable to delete scheduled job \"%s\": %s", id, err.Error())
+	}
+}
+
+// run starts the goroutine which waits for a job's activation times. The
+// goroutine returns when the job is removed or the robot's context is done.
+func (s *scheduler) run(job *scheduledJob) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		done := s.robot.Context().Done()
+		for {
+			var next time.Time
+			if job.oneShot != nil {
+				next = job.oneShot.At
+			} else {
+				next = job.schedule.Next(time.Now())
+				if next.IsZero() {
+					return
+				}
+			}
+			timer := time.NewTimer(next.Sub(time.Now()))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-job.cancel:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if job.oneShot != nil {
+				s.mutex.Lock()
+				handler := s.handlers[job.oneShot.Name]
+				exists := s.unregister(job)
+				s.mutex.Unlock()
+				if !exists {
+					return
+				}
+				s.call(job.id, func() { handler(s.robot, job.oneShot.Payload) })
+				// the job stays in the store while its handler runs so it
+				// is resumed if the robot stops before the handler returns
+				s.unpersist(job.id)
+				return
+			}
+			s.call(job.id, func() { job.job(s.robot) })
+		}
+	}()
+}
+
+// call runs a job and recovers from any panic so one job cannot take down the
+// robot.
+func (s *scheduler) call(id string, f func()) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("Unexpected Panic Running Job:", id, " -- Error:", e)
+		}
+	}()
+	f()
+}
@@ -0,0 +1,106 @@
+package victor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleInvalidSpec(t *testing.T) {
+	bot := getMockBot()
+	_, err := bot.Schedule("not a spec", func(Robot) {})
+	assert.Error(t, err)
+}
+
+func TestScheduleAtRequiresHandler(t *testing.T) {
+	bot := getMockBot()
+	_, err := bot.ScheduleAt(time.Now(), "missing", "")
+	assert.Error(t, err, "Scheduling a job without a handler should fail.")
+}
+
+func TestScheduleAt(t *testing.T) {
+	bot := getMockBot()
+	payloads := make(chan string, 1)
+	var id string
+	var persistedWhileRunning bool
+	bot.HandleJob("remind", func(r Robot, payload string) {
+		_, persistedWhileRunning = r.Store().Get(jobsKeyPrefix + id)
+		payloads <- payload
+	})
+	id, err := bot.ScheduleAt(time.Now().Add(-time.Minute), "remind", "stand up")
+	assert.NoError(t, err)
+	_, persisted := bot.Store().Get(jobsKeyPrefix + id)
+	assert.True(t, persisted, "One-shot jobs should be persisted.")
+
+	bot.Run()
+	defer bot.Stop()
+	select {
+	case payload := <-payloads:
+		assert.Equal(t, "stand up", payload)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Past due job did not run.")
+	}
+	assert.True(t, persistedWhileRunning, "Jobs should stay in the store while they run.")
+	for i := 0; i < 100 && persisted; i++ {
+		time.Sleep(time.Millisecond)
+		_, persisted = bot.Store().Get(jobsKeyPrefix + id)
+	}
+	assert.False(t, persisted, "Jobs should be removed from the store after running.")
+}
+
+func TestScheduleAtResumesPersistedJobs(t *testing.T) {
+	bot := getMockBot()
+	payloads := make(chan string, 1)
+	bot.HandleJob("remind", func(r Robot, payload string) {
+		payloads <- payload
+	})
+	bot.Store().Set(jobsKeyPrefix+"old",
+		`{"id":"old","name":"remind","at":"2015-01-01T00:00:00Z","payload":"from before"}`)
+	bot.Run()
+	defer bot.Stop()
+	select {
+	case payload := <-payloads:
+		assert.Equal(t, "from before", payload)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Persisted job was not resumed.")
+	}
+}
+
+func TestUnschedule(t *testing.T) {
+	bot := getMockBot()
+	ran := make(chan struct{}, 1)
+	bot.HandleJob("remind", func(r Robot, payload string) {
+		ran <- struct{}{}
+	})
+	id, err := bot.ScheduleAt(time.Now().Add(50*time.Millisecond), "remind", "")
+	assert.NoError(t, err)
+	bot.Run()
+	defer bot.Stop()
+	assert.True(t, bot.Unschedule(id))
+	assert.False(t, bot.Unschedule(id), "A job can only be unscheduled once.")
+	_, persisted := bot.Store().Get(jobsKeyPrefix + id)
+	assert.False(t, persisted, "Unscheduled jobs should be removed from the store.")
+	select {
+	case <-ran:
+		assert.Fail(t, "Unscheduled job ran.")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStopEndsScheduler(t *testing.T) {
+	bot := getMockBot()
+	_, err := bot.Schedule("@every 1h", func(Robot) {})
+	assert.NoError(t, err)
+	bot.Run()
+	stopped := make(chan struct{})
+	go func() {
+		bot.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Stop did not return while a job was scheduled.")
+	}
+}
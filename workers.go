@@ -0,0 +1,117 @@
+package victor
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/FogCreek/victor/pkg/chat"
+)
+
+const (
+	// defaultWorkers is the number of message processing goroutines used if
+	// none is set in the robot's Config.
+	defaultWorkers = 10
+
+	// defaultQueueSize is the number of messages each worker may have queued
+	// if none is set in the robot's Config.
+	defaultQueueSize = 100
+)
+
+// workerPool processes messages on a fixed number of goroutines. Each worker
+// has its own queue and messages are assigned to a worker by their channel so
+// messages from the same channel are processed in the order received.
+type workerPool struct {
+	queues       []chan chat.Message
+	process      func(chat.Message)
+	dropped      func(chat.Message)
+	dropWhenFull bool
+	wg           *sync.WaitGroup
+}
+
+// newWorkerPool returns a new worker pool which calls process for each
+// submitted message. If dropWhenFull is true then messages submitted to a full
+// queue are passed to dropped instead of blocking until there is room.
+func newWorkerPool(workers, queueSize int, dropWhenFull bool, process, dropped func(chat.Message)) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	queues := make([]chan chat.Message, workers)
+	for i := range queues {
+		queues[i] = make(chan chat.Message, queueSize)
+	}
+	return &workerPool{
+		queues:       queues,
+		process:      process,
+		dropped:      dropped,
+		dropWhenFull: dropWhenFull,
+		wg:           &sync.WaitGroup{},
+	}
+}
+
+// start launches the pool's workers. They return once the pool is closed and
+// their queues have been drained.
+func (p *workerPool) start() {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go p.work(queue)
+	}
+}
+
+// work processes messages from a single queue until it is closed and empty.
+func (p *workerPool) work(queue chan chat.Message) {
+	defer p.wg.Done()
+	for m := range queue {
+		p.process(m)
+	}
+}
+
+// close closes all of the pool's queues so the workers return once they have
+// processed the remaining messages. Nothing may be submitted to the pool after
+// it is closed.
+func (p *workerPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+}
+
+// wait blocks until all of the pool's workers have returned.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// submit queues a message on its channel's worker. This blocks while the
+// queue is full unless the pool drops messages when full. It returns false if
+// the message was dropped or stop was closed before it could be queued.
+func (p *workerPool) submit(m chat.Message, stop <-chan struct{}) bool {
+	queue := p.queues[p.shard(m)]
+	if p.dropWhenFull {
+		select {
+		case queue <- m:
+			return true
+		default:
+			p.dropped(m)
+			return false
+		}
+	}
+	select {
+	case queue <- m:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// shard returns the index of the worker which processes messages from the
+// given message's channel.
+func (p *workerPool) shard(m chat.Message) int {
+	var channelID string
+	if m.Channel() != nil {
+		channelID = m.Channel().ID()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(channelID))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
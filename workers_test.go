@@ -0,0 +1,79 @@
+package victor
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FogCreek/victor/pkg/chat"
+	"github.com/FogCreek/victor/pkg/events/definedEvents"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolChannelOrder(t *testing.T) {
+	var mutex sync.Mutex
+	received := make(map[string][]string)
+	wg := &sync.WaitGroup{}
+	pool := newWorkerPool(4, 10, false, func(m chat.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received[m.Channel().ID()] = append(received[m.Channel().ID()], m.Text())
+		wg.Done()
+	}, nil)
+	stop := make(chan struct{})
+	pool.start()
+	defer pool.close()
+	channels := []string{"C1", "C2", "C3"}
+	texts := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, text := range texts {
+		for _, channelID := range channels {
+			wg.Add(1)
+			pool.submit(&chat.BaseMessage{
+				MsgText:    text,
+				MsgChannel: &chat.BaseChannel{ChannelID: channelID},
+			}, stop)
+		}
+	}
+	wg.Wait()
+	for _, channelID := range channels {
+		assert.Equal(t, texts, received[channelID], "Messages from a channel should be processed in order.")
+	}
+}
+
+func TestWorkerPoolDropWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	var dropped []chat.Message
+	pool := newWorkerPool(1, 1, true, func(m chat.Message) {
+		<-block
+	}, func(m chat.Message) {
+		dropped = append(dropped, m)
+	})
+	stop := make(chan struct{})
+	pool.start()
+	defer pool.close()
+	msg := &chat.BaseMessage{MsgChannel: testChannel}
+	assert.True(t, pool.submit(msg, stop), "First message should be picked up by the worker.")
+	// wait for the worker to take the first message off its queue
+	for i := 0; i < 100 && len(pool.queues[0]) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, pool.submit(msg, stop), "Second message should be queued.")
+	assert.False(t, pool.submit(msg, stop), "Third message should be dropped.")
+	assert.Len(t, dropped, 1)
+	close(block)
+}
+
+func TestRobotReportsDroppedMessages(t *testing.T) {
+	bot := getMockBot()
+	bot.dropMessage(&chat.BaseMessage{MsgText: "hi", MsgChannel: testChannel})
+	select {
+	case err := <-bot.ChatErrors():
+		dropped, ok := err.(*definedEvents.MessageDropped)
+		assert.True(t, ok, "Dropped messages should be reported as MessageDropped.")
+		assert.Equal(t, testChannel.ID(), dropped.ChannelID)
+		assert.False(t, err.IsFatal())
+	case <-time.After(time.Second):
+		assert.Fail(t, "Dropped message was not reported.")
+	}
+}